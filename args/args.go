@@ -7,7 +7,14 @@ type Args struct {
 	ResumeCapability bool
 	Resume           bool
 	Verbose          bool
+	// ReadOnly opens existing files of a torrent for reading only, used to verify data
+	ReadOnly bool
+	// IncompleteDir is the folder files are downloaded into, they are moved to CompleteDir once complete
+	IncompleteDir string
+	CompleteDir   string
+	// PartSuffix adds .part to the names of files until they are complete
+	PartSuffix bool
 }
 
 // ARGS is an instance of Args
-var ARGS = &Args{make([]string, 0), "", true, false, true}
+var ARGS = &Args{make([]string, 0), "", true, false, true, false, "", "", false}
@@ -9,6 +9,11 @@ files=(
 	queue/*.go
 	piece/*.go
 	args/*.go
+	mse/*.go
+	utp/*.go
+	storage/*.go
+	resume/*.go
+	ratelimit/*.go
 )
 
 # script for formatting 
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/concurrency-8/args"
+	"github.com/concurrency-8/mse"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/ratelimit"
+	"github.com/concurrency-8/storage"
 	"github.com/concurrency-8/torrent"
 	"github.com/sethgrid/multibar"
 )
@@ -22,15 +31,83 @@ func main() {
 		  True if pause and resume feature is needed. False otherwise.
 	--resume -r
 		  True to resume partially downloaded files.
+	--encryption -e [disabled|prefer|require]
+		  Encryption policy for peer connections. Default is prefer.
+	--utp
+		  Try uTP before TCP when connecting to peers. Peers without uTP cost a timeout.
+	--lazy-bitfield
+		  Announce some of our pieces with have messages instead of the bitfield.
+	--storage [file|memory|mmap]
+		  Where downloaded data is kept. Default is file.
+	--allocation [none|sparse|full]
+		  How files are allocated on disk before downloading. Default is none.
+	--cache [megabytes]
+		  Size of the write-back cache of each torrent on disk, 0 disables it. Default is 32.
+	--disk-workers [count]
+		  Goroutines writing cached pieces to disk, per torrent. Default is 4.
+	--hash-workers [count]
+		  Goroutines verifying downloaded pieces. Default is the number of CPUs.
+	--incomplete [path]
+		  Download files into this folder. They are moved to the download folder once complete.
+	--complete [path]
+		  Folder complete files are moved to. Default is the current folder.
+	--part-suffix
+		  Add .part to the names of files until they are complete.
+	--priority [index]=[skip|low|normal|high]
+		  Priority of a file of the torrents, by its index. Skipped files are not downloaded.
+	--http [address]
+		  Serve the files of the torrents over HTTP at address, e.g. localhost:8080, while they download.
+	--sequential
+		  Download pieces in order, so that files can be used while they download.
+	--read-ahead [pieces]
+		  Pieces after the read position of a file being read that are downloaded first. Default is 4.
+	--max-connections [count]
+		  Peer connections of all torrents at once. Default is 200.
+	--max-connections-per-torrent [count]
+		  Peer connections of a torrent at once. Default is 50.
+	--max-half-open [count]
+		  Connection attempts to peers at once. Default is 16.
+	--download-rate [KiB/s]
+		  Download rate of all torrents together, 0 is unlimited. Default is 0.
+	--upload-rate [KiB/s]
+		  Upload rate of all torrents together, 0 is unlimited. Default is 0.
+	--torrent-download-rate [KiB/s]
+		  Download rate of every torrent, 0 is unlimited. Default is 0.
+	--torrent-upload-rate [KiB/s]
+		  Upload rate of every torrent, 0 is unlimited. Default is 0.
+	--rate-schedule [HH:MM-HH:MM=download:upload]
+		  Download and upload rates in KiB/s of all torrents between two times of the day. Can be repeated.
+	--ban-threshold [count]
+		  Hash failures shared with other peers before a peer is banned. Default is 3.
+	--ban-duration [seconds]
+		  How long a peer that sent bad data is banned. Default is 3600.
 	--files [path] [path] ...
 		  List of Torrent Files
+	verify [path] [path] ...
+		  Check downloaded data of the torrent files against their piece hashes.
+		  Exits with status 1 if any piece does not match.
 	Sample input:
-		  ./concurrency-8 --files File1 File2 File3 -v -d ../../`
+		  ./concurrency-8 --files File1 File2 File3 -v -d ../../
+		  ./concurrency-8 verify File1`
 	l := len(os.Args)
 	if l == 1 || os.Args[1] == "--help" {
 		fmt.Println(errormsg)
 		return
 	}
+	if os.Args[1] == "verify" {
+		valid := l > 2
+		for _, file := range os.Args[2:] {
+			ok, err := torrent.Verify(file, os.Stdout)
+			if err != nil {
+				fmt.Println(file, ":", err)
+			}
+			valid = valid && ok
+		}
+		if !valid {
+			os.Exit(1)
+		}
+		return
+	}
 	files := make([]string, 0)
 	filesflag := false
 	resumeflag := false
@@ -50,6 +127,150 @@ func main() {
 				rcflag = true
 			} else if arg == "--download" || arg == "-d" {
 				downloadpath = os.Args[i+1]
+			} else if arg == "--utp" {
+				torrent.UTP = true
+			} else if arg == "--lazy-bitfield" {
+				torrent.LazyBitfield = true
+			} else if arg == "--storage" && i+1 < l {
+				kind, err := storage.ParseKind(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.StorageKind = kind
+			} else if arg == "--allocation" && i+1 < l {
+				allocation, err := storage.ParseAllocation(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.AllocationMode = allocation
+			} else if arg == "--cache" && i+1 < l {
+				megabytes, err := strconv.ParseInt(os.Args[i+1], 10, 64)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.CacheSize = megabytes << 20
+			} else if arg == "--disk-workers" && i+1 < l {
+				workers, err := strconv.Atoi(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				storage.DiskWorkers = workers
+			} else if arg == "--hash-workers" && i+1 < l {
+				workers, err := strconv.Atoi(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.HashWorkers = workers
+			} else if arg == "--incomplete" && i+1 < l {
+				args.ARGS.IncompleteDir = os.Args[i+1]
+			} else if arg == "--complete" && i+1 < l {
+				args.ARGS.CompleteDir = os.Args[i+1]
+			} else if arg == "--part-suffix" {
+				args.ARGS.PartSuffix = true
+			} else if arg == "--priority" && i+1 < l {
+				file, priority, err := parsePriority(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.FilePriorities[file] = priority
+			} else if arg == "--http" && i+1 < l {
+				go func(address string) {
+					if err := torrent.ListenHTTP(address); err != nil {
+						fmt.Println(err)
+					}
+				}(os.Args[i+1])
+			} else if arg == "--sequential" {
+				torrent.Sequential = true
+			} else if arg == "--read-ahead" && i+1 < l {
+				pieces, err := strconv.ParseUint(os.Args[i+1], 10, 32)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.ReadAhead = uint32(pieces)
+			} else if arg == "--max-connections" && i+1 < l {
+				count, err := strconv.Atoi(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.MaxConnections = count
+			} else if arg == "--max-connections-per-torrent" && i+1 < l {
+				count, err := strconv.Atoi(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.MaxConnectionsPerTorrent = count
+			} else if arg == "--max-half-open" && i+1 < l {
+				count, err := strconv.Atoi(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.MaxHalfOpen = count
+			} else if arg == "--download-rate" && i+1 < l {
+				rate, err := strconv.ParseInt(os.Args[i+1], 10, 64)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.DownloadRate = rate << 10
+			} else if arg == "--upload-rate" && i+1 < l {
+				rate, err := strconv.ParseInt(os.Args[i+1], 10, 64)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.UploadRate = rate << 10
+			} else if arg == "--torrent-download-rate" && i+1 < l {
+				rate, err := strconv.ParseInt(os.Args[i+1], 10, 64)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.TorrentDownloadRate = rate << 10
+			} else if arg == "--torrent-upload-rate" && i+1 < l {
+				rate, err := strconv.ParseInt(os.Args[i+1], 10, 64)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.TorrentUploadRate = rate << 10
+			} else if arg == "--rate-schedule" && i+1 < l {
+				rule, err := ratelimit.ParseRule(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.RateSchedule = append(torrent.RateSchedule, rule)
+			} else if arg == "--ban-threshold" && i+1 < l {
+				threshold, err := strconv.Atoi(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.BanThreshold = threshold
+			} else if arg == "--ban-duration" && i+1 < l {
+				seconds, err := strconv.ParseInt(os.Args[i+1], 10, 64)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.BanDuration = time.Duration(seconds)
+			} else if (arg == "--encryption" || arg == "-e") && i+1 < l {
+				policy, err := mse.ParsePolicy(os.Args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				torrent.EncryptionPolicy = policy
 			}
 		}
 		if arg == "--files" {
@@ -70,6 +291,15 @@ func main() {
 
 	progressbars, _ := multibar.New()
 
+	// Interrupting stops the downloads, their files are written to disk before exiting
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
 	ports[0] = 20000
 	for i, file := range files {
 		if ports[i] == 0 {
@@ -77,8 +307,10 @@ func main() {
 		}
 		bar := progressbars.MakeBar(100, file)
 		go func(file string, port int) {
-			torrent.DownloadFromFile(file, port, &bar)
 			defer wait.Done()
+			if err := torrent.DownloadFromFileContext(ctx, file, port, &bar); err != nil && err != context.Canceled {
+				fmt.Fprintln(os.Stderr, "Unable to download", file+":", err)
+			}
 		}(file, ports[i])
 
 	}
@@ -87,3 +319,16 @@ func main() {
 
 	wait.Wait()
 }
+
+// parsePriority parses a file priority given as index=priority
+func parsePriority(arg string) (file int, priority piece.Priority, err error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 {
+		return 0, piece.Normal, fmt.Errorf("Priority must look like index=priority, got %q", arg)
+	}
+	if file, err = strconv.Atoi(parts[0]); err != nil {
+		return
+	}
+	priority, err = piece.ParsePriority(parts[1])
+	return
+}
@@ -0,0 +1,344 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy tells if and how connections are encrypted
+type Policy int
+
+const (
+	// Disabled never encrypts connections
+	Disabled Policy = iota
+	// Prefer encrypts connections but falls back to plaintext
+	Prefer
+	// Require refuses connections that are not encrypted
+	Require
+)
+
+// Crypto methods for crypto_provide and crypto_select
+const (
+	PlainText uint32 = 0x01
+	RC4       uint32 = 0x02
+)
+
+// MaxPadLen is the maximum length of the random padding
+const MaxPadLen = 512
+
+// prime P of the Diffie-Hellman key exchange, generator G = 2
+var prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+var generator = big.NewInt(2)
+
+// Length of a public key in bytes
+const keyLen = 96
+
+// verification constant VC - 8 zero bytes
+var vc = make([]byte, 8)
+
+// ParsePolicy returns the policy with name disabled, prefer or require
+func ParsePolicy(name string) (policy Policy, err error) {
+	switch name {
+	case "disabled":
+		policy = Disabled
+	case "prefer":
+		policy = Prefer
+	case "require":
+		policy = Require
+	default:
+		err = fmt.Errorf("Unknown encryption policy %s", name)
+	}
+	return
+}
+
+func (policy Policy) String() string {
+	switch policy {
+	case Disabled:
+		return "disabled"
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	}
+	return "unknown"
+}
+
+// Conn is a peer connection after the encryption handshake.
+// Reads and writes are RC4 encrypted if RC4 was selected
+type Conn struct {
+	net.Conn
+	// Selected is the crypto method both ends agreed on
+	Selected uint32
+	// InfoHash is the info hash the connection is for
+	InfoHash []byte
+
+	buffered []byte
+	decrypt  *rc4.Cipher
+	encrypt  *rc4.Cipher
+	lock     sync.Mutex
+}
+
+func (conn *Conn) Read(b []byte) (n int, err error) {
+	// bytes read ahead during the handshake are already decrypted
+	if len(conn.buffered) > 0 {
+		n = copy(b, conn.buffered)
+		conn.buffered = conn.buffered[n:]
+		return
+	}
+	n, err = conn.Conn.Read(b)
+	if conn.decrypt != nil && n > 0 {
+		conn.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return
+}
+
+func (conn *Conn) Write(b []byte) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.encrypt == nil {
+		return conn.Conn.Write(b)
+	}
+	data := make([]byte, len(b))
+	conn.encrypt.XORKeyStream(data, b)
+	return conn.Conn.Write(data)
+}
+
+// handshake holds the state of one encryption handshake
+type handshake struct {
+	conn     net.Conn
+	private  *big.Int
+	secret   []byte
+	writes   []chan error
+	encrypt  *rc4.Cipher
+	decrypt  *rc4.Cipher
+	infoHash []byte
+}
+
+func newHandshake(conn net.Conn) (hs *handshake, err error) {
+	key := make([]byte, 20)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+	hs = &handshake{conn: conn, private: new(big.Int).SetBytes(key)}
+	return
+}
+
+// write sends data without waiting for the other end to read it.
+// Both ends write before reading, so waiting could deadlock on unbuffered connections
+func (hs *handshake) write(data []byte) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := hs.conn.Write(data)
+		done <- err
+	}()
+	hs.writes = append(hs.writes, done)
+}
+
+// wait waits for all pending writes
+func (hs *handshake) wait() (err error) {
+	for _, done := range hs.writes {
+		if e := <-done; e != nil && err == nil {
+			err = e
+		}
+	}
+	hs.writes = nil
+	return
+}
+
+// publicKey returns our public key padded with random bytes
+func (hs *handshake) publicKey() (data []byte, err error) {
+	public := new(big.Int).Exp(generator, hs.private, prime).Bytes()
+	data = make([]byte, keyLen-len(public), keyLen+MaxPadLen)
+	data = append(data, public...)
+	pad, err := randomPad(MaxPadLen)
+	data = append(data, pad...)
+	return
+}
+
+// readPublicKey reads the public key of the other end and computes the shared secret S
+func (hs *handshake) readPublicKey(prefix []byte) (err error) {
+	key := make([]byte, keyLen)
+	copy(key, prefix)
+	if _, err = io.ReadFull(hs.conn, key[len(prefix):]); err != nil {
+		return
+	}
+	public := new(big.Int).SetBytes(key)
+	if public.Cmp(big.NewInt(1)) <= 0 || public.Cmp(prime) >= 0 {
+		return fmt.Errorf("Invalid public key")
+	}
+	secret := new(big.Int).Exp(public, hs.private, prime).Bytes()
+	hs.secret = make([]byte, keyLen-len(secret), keyLen)
+	hs.secret = append(hs.secret, secret...)
+	return
+}
+
+// ciphers creates the RC4 ciphers from S and SKEY. The initiator encrypts with keyA
+func (hs *handshake) ciphers(initiator bool) (err error) {
+	keyA, err := rc4.NewCipher(hash([]byte("keyA"), hs.secret, hs.infoHash))
+	if err != nil {
+		return
+	}
+	keyB, err := rc4.NewCipher(hash([]byte("keyB"), hs.secret, hs.infoHash))
+	if err != nil {
+		return
+	}
+	// discard the first 1024 bytes of both streams
+	discard := make([]byte, 1024)
+	keyA.XORKeyStream(discard, discard)
+	keyB.XORKeyStream(discard, discard)
+	if initiator {
+		hs.encrypt, hs.decrypt = keyA, keyB
+	} else {
+		hs.encrypt, hs.decrypt = keyB, keyA
+	}
+	return
+}
+
+// synchronize reads from the connection until pattern is found. At most max bytes are skipped
+func (hs *handshake) synchronize(pattern []byte, max int) error {
+	window := make([]byte, 0, len(pattern)+max)
+	b := make([]byte, 1)
+	for len(window) < cap(window) {
+		if _, err := io.ReadFull(hs.conn, b); err != nil {
+			return err
+		}
+		window = append(window, b[0])
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unable to synchronize encryption handshake")
+}
+
+// readEncrypted reads and decrypts exactly len(data) bytes
+func (hs *handshake) readEncrypted(data []byte) (err error) {
+	if _, err = io.ReadFull(hs.conn, data); err != nil {
+		return
+	}
+	hs.decrypt.XORKeyStream(data, data)
+	return
+}
+
+// Initiate performs the encryption handshake for an outgoing connection.
+// payload (usually the BitTorrent handshake) is sent as the initial payload
+func Initiate(conn net.Conn, infoHash []byte, policy Policy, payload []byte) (result *Conn, err error) {
+	var provide uint32
+	switch policy {
+	case Prefer:
+		provide = RC4 | PlainText
+	case Require:
+		provide = RC4
+	default:
+		return nil, fmt.Errorf("Encryption is disabled")
+	}
+	return initiate(conn, infoHash, provide, payload)
+}
+
+// initiate performs the handshake of Initiate offering the crypto methods in provide
+func initiate(conn net.Conn, infoHash []byte, provide uint32, payload []byte) (result *Conn, err error) {
+	hs, err := newHandshake(conn)
+	if err != nil {
+		return
+	}
+	hs.infoHash = infoHash
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	data, err := hs.publicKey()
+	if err != nil {
+		return
+	}
+	hs.write(data)
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	if err = hs.readPublicKey(nil); err != nil {
+		hs.wait()
+		return
+	}
+	if err = hs.wait(); err != nil {
+		return
+	}
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	if err = hs.ciphers(true); err != nil {
+		return
+	}
+	message := new(bytes.Buffer)
+	message.Write(hash([]byte("req1"), hs.secret))
+	message.Write(xor(hash([]byte("req2"), infoHash), hash([]byte("req3"), hs.secret)))
+	encrypted := new(bytes.Buffer)
+	encrypted.Write(vc)
+	binary.Write(encrypted, binary.BigEndian, provide)
+	binary.Write(encrypted, binary.BigEndian, uint16(0))
+	binary.Write(encrypted, binary.BigEndian, uint16(len(payload)))
+	encrypted.Write(payload)
+	data = encrypted.Bytes()
+	hs.encrypt.XORKeyStream(data, data)
+	message.Write(data)
+	hs.write(message.Bytes())
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	pattern := make([]byte, len(vc))
+	hs.decrypt.XORKeyStream(pattern, vc)
+	if err = hs.synchronize(pattern, MaxPadLen); err != nil {
+		hs.wait()
+		return
+	}
+	header := make([]byte, 6)
+	if err = hs.readEncrypted(header); err != nil {
+		hs.wait()
+		return
+	}
+	selected := binary.BigEndian.Uint32(header[:4])
+	if err = hs.readEncrypted(make([]byte, binary.BigEndian.Uint16(header[4:]))); err != nil {
+		hs.wait()
+		return
+	}
+	if err = hs.wait(); err != nil {
+		return
+	}
+	if selected&provide == 0 || (selected != RC4 && selected != PlainText) {
+		return nil, fmt.Errorf("Peer selected unsupported crypto method %d", selected)
+	}
+
+	result = &Conn{Conn: conn, Selected: selected, InfoHash: infoHash}
+	if selected == RC4 {
+		result.encrypt, result.decrypt = hs.encrypt, hs.decrypt
+	}
+	return
+}
+
+// hash returns the SHA1 of the concatenation of parts
+func hash(parts ...[]byte) []byte {
+	sha := sha1.New()
+	for _, part := range parts {
+		sha.Write(part)
+	}
+	return sha.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
+
+// randomPad returns between 0 and max random bytes
+func randomPad(max int) (pad []byte, err error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max+1)))
+	if err != nil {
+		return
+	}
+	pad = make([]byte, n.Int64())
+	_, err = rand.Read(pad)
+	return
+}
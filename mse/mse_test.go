@@ -0,0 +1,280 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getInfoHash() []byte {
+	infoHash := make([]byte, 20)
+	rand.Read(infoHash)
+	return infoHash
+}
+
+// handshakes runs Initiate and accept on the two ends of a pipe
+func handshakes(initiator, receiver Policy, infoHash []byte, infoHashes [][]byte, payload []byte) (outgoing, incoming *Conn, outErr, inErr error) {
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		incoming, inErr = accept(server, receiver, infoHashes)
+		if inErr != nil {
+			server.Close()
+		}
+		done <- true
+	}()
+	outgoing, outErr = Initiate(client, infoHash, initiator, payload)
+	if outErr != nil {
+		client.Close()
+	}
+	<-done
+	return
+}
+
+// accept performs the encryption handshake of the peer receiving the connection, as the peers we
+// connect to do. infoHashes are the torrents it serves. Plaintext BitTorrent handshakes are passed through unless policy is Require
+func accept(conn net.Conn, policy Policy, infoHashes [][]byte) (result *Conn, err error) {
+	prefix := make([]byte, 20)
+	if _, err = io.ReadFull(conn, prefix); err != nil {
+		return
+	}
+	if prefix[0] == 19 && string(prefix[1:]) == "BitTorrent protocol" {
+		if policy == Require {
+			return nil, fmt.Errorf("Plaintext connection refused")
+		}
+		return &Conn{Conn: conn, Selected: PlainText, buffered: prefix}, nil
+	}
+	if policy == Disabled {
+		return nil, fmt.Errorf("Encryption is disabled")
+	}
+
+	hs, err := newHandshake(conn)
+	if err != nil {
+		return
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	if err = hs.readPublicKey(prefix); err != nil {
+		return
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	data, err := hs.publicKey()
+	if err != nil {
+		return
+	}
+	hs.write(data)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	if err = hs.synchronize(hash([]byte("req1"), hs.secret), MaxPadLen); err != nil {
+		hs.wait()
+		return
+	}
+	obfuscated := make([]byte, 20)
+	if _, err = io.ReadFull(conn, obfuscated); err != nil {
+		hs.wait()
+		return
+	}
+	req2 := xor(obfuscated, hash([]byte("req3"), hs.secret))
+	for _, infoHash := range infoHashes {
+		if bytes.Equal(req2, hash([]byte("req2"), infoHash)) {
+			hs.infoHash = infoHash
+		}
+	}
+	if hs.infoHash == nil {
+		hs.wait()
+		return nil, fmt.Errorf("Connection for unknown torrent")
+	}
+	if err = hs.ciphers(false); err != nil {
+		hs.wait()
+		return
+	}
+	header := make([]byte, 14)
+	if err = hs.readEncrypted(header); err != nil {
+		hs.wait()
+		return
+	}
+	if !bytes.Equal(header[:8], vc) {
+		hs.wait()
+		return nil, fmt.Errorf("Invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	if err = hs.readEncrypted(make([]byte, binary.BigEndian.Uint16(header[12:]))); err != nil {
+		hs.wait()
+		return
+	}
+	length := make([]byte, 2)
+	if err = hs.readEncrypted(length); err != nil {
+		hs.wait()
+		return
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(length))
+	if err = hs.readEncrypted(payload); err != nil {
+		hs.wait()
+		return
+	}
+
+	var selected uint32
+	if provide&RC4 != 0 {
+		selected = RC4
+	} else if provide&PlainText != 0 && policy == Prefer {
+		selected = PlainText
+	} else {
+		hs.wait()
+		return nil, fmt.Errorf("No acceptable crypto method in %d", provide)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	message := new(bytes.Buffer)
+	message.Write(vc)
+	binary.Write(message, binary.BigEndian, selected)
+	binary.Write(message, binary.BigEndian, uint16(0))
+	data = message.Bytes()
+	hs.encrypt.XORKeyStream(data, data)
+	hs.write(data)
+	if err = hs.wait(); err != nil {
+		return
+	}
+
+	result = &Conn{Conn: conn, Selected: selected, InfoHash: hs.infoHash, buffered: payload}
+	if selected == RC4 {
+		result.encrypt, result.decrypt = hs.encrypt, hs.decrypt
+	}
+	return
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{Disabled, Prefer, Require} {
+		parsed, err := ParsePolicy(policy.String())
+		assert.Nil(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParsePolicy("sometimes")
+	assert.NotNil(t, err)
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	infoHash := getInfoHash()
+	payload := []byte("\x13BitTorrent protocol")
+	outgoing, incoming, outErr, inErr := handshakes(Require, Prefer, infoHash, [][]byte{getInfoHash(), infoHash}, payload)
+	assert.Nil(t, outErr)
+	assert.Nil(t, inErr)
+	assert.Equal(t, RC4, outgoing.Selected)
+	assert.Equal(t, RC4, incoming.Selected)
+	assert.Equal(t, infoHash, incoming.InfoHash)
+
+	// Initial payload is delivered to the receiving end
+	received := make([]byte, len(payload))
+	_, err := io.ReadFull(incoming, received)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, received)
+
+	// Both directions after the handshake
+	message := []byte("message from the initiator")
+	go outgoing.Write(message)
+	received = make([]byte, len(message))
+	_, err = io.ReadFull(incoming, received)
+	assert.Nil(t, err)
+	assert.Equal(t, message, received)
+
+	message = []byte("reply from the receiver")
+	go incoming.Write(message)
+	received = make([]byte, len(message))
+	_, err = io.ReadFull(outgoing, received)
+	assert.Nil(t, err)
+	assert.Equal(t, message, received)
+}
+
+func TestEncryptionIsOnTheWire(t *testing.T) {
+	infoHash := getInfoHash()
+	outgoing, incoming, outErr, inErr := handshakes(Require, Require, infoHash, [][]byte{infoHash}, nil)
+	assert.Nil(t, outErr)
+	assert.Nil(t, inErr)
+
+	// Read the raw connection under the receiving end
+	message := []byte("this must not be readable on the wire")
+	go outgoing.Write(message)
+	raw := make([]byte, len(message))
+	_, err := io.ReadFull(incoming.Conn, raw)
+	assert.Nil(t, err)
+	assert.NotEqual(t, message, raw)
+}
+
+func TestPlainTextSelected(t *testing.T) {
+	infoHash := getInfoHash()
+	client, server := net.Pipe()
+	done := make(chan bool)
+	var outgoing *Conn
+	var outErr error
+	go func() {
+		outgoing, outErr = initiate(client, infoHash, PlainText, nil)
+		done <- true
+	}()
+	incoming, err := accept(server, Prefer, [][]byte{infoHash})
+	<-done
+	assert.Nil(t, err)
+	assert.Nil(t, outErr)
+	assert.Equal(t, PlainText, incoming.Selected)
+	assert.Equal(t, PlainText, outgoing.Selected)
+
+	// Stream after the handshake is not encrypted
+	message := []byte("plaintext after the handshake")
+	go outgoing.Write(message)
+	raw := make([]byte, len(message))
+	_, err = io.ReadFull(incoming.Conn, raw)
+	assert.Nil(t, err)
+	assert.Equal(t, message, raw)
+
+	// Plaintext is refused when encryption is required
+	client, server = net.Pipe()
+	go func() {
+		initiate(client, infoHash, PlainText, nil)
+		done <- true
+	}()
+	_, err = accept(server, Require, [][]byte{infoHash})
+	assert.NotNil(t, err)
+	server.Close()
+	<-done
+}
+
+func TestPlainTextHandshakePassesThrough(t *testing.T) {
+	client, server := net.Pipe()
+	handshake := []byte("\x13BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00")
+	go client.Write(handshake)
+
+	incoming, err := accept(server, Prefer, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, PlainText, incoming.Selected)
+	received := make([]byte, len(handshake))
+	_, err = io.ReadFull(incoming, received)
+	assert.Nil(t, err)
+	assert.Equal(t, handshake, received)
+
+	client, server = net.Pipe()
+	go client.Write(handshake)
+	_, err = accept(server, Require, nil)
+	assert.NotNil(t, err, "Plaintext accepted when encryption is required")
+	client.Close()
+}
+
+func TestUnknownInfoHash(t *testing.T) {
+	_, _, outErr, inErr := handshakes(Prefer, Prefer, getInfoHash(), [][]byte{getInfoHash()}, nil)
+	assert.NotNil(t, inErr)
+	assert.NotNil(t, outErr)
+}
+
+func TestEncryptionDisabled(t *testing.T) {
+	_, _, outErr, inErr := handshakes(Require, Disabled, getInfoHash(), nil, nil)
+	assert.NotNil(t, inErr)
+	assert.NotNil(t, outErr)
+
+	client, _ := net.Pipe()
+	_, err := Initiate(client, getInfoHash(), Disabled, nil)
+	assert.NotNil(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/concurrency-8/args"
@@ -15,8 +16,38 @@ import (
 // BLOCK_LEN is length  of block
 var BLOCK_LEN = uint32(math.Pow(2, 14))
 
+// ErrInvalidMetainfo is wrapped by the errors of torrent files that cannot be decoded or are inconsistent
+var ErrInvalidMetainfo = fmt.Errorf("Invalid metainfo")
+
+// FileError is returned when a file of a torrent cannot be created or opened
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("Unable to open %s: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the error of the file system
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
 //Parse parses from a stream and returns a pointer to a TorrentFile.
 func Parse(reader io.Reader) (TorrentFile, error) {
+	return ParseSelected(reader, nil)
+}
+
+//ParseSelected parses from a stream like Parse. Only the files for which wanted returns true
+//are opened, the others are not created and have no FilePointer. A nil wanted opens every file.
+func ParseSelected(reader io.Reader, wanted func(file int) bool) (TorrentFile, error) {
+	return ParseWithArgs(reader, wanted, args.ARGS)
+}
+
+//ParseWithArgs parses from a stream like ParseSelected, with the folders and options of config
+//instead of args.ARGS.
+func ParseWithArgs(reader io.Reader, wanted func(file int) bool, config *args.Args) (TorrentFile, error) {
 	data, err := ioutil.ReadAll(reader)
 	//return an error if reading fails.
 	if err != nil {
@@ -27,61 +58,83 @@ func Parse(reader io.Reader) (TorrentFile, error) {
 	err = bencode.DecodeBytes(data, metadata)
 	//return an error if decode fails.
 	if err != nil {
-		return TorrentFile{}, err
+		return TorrentFile{}, fmt.Errorf("%w: %v", ErrInvalidMetainfo, err)
 	}
 
 	info := &InfoMetaData{}
 	err = bencode.DecodeBytes(metadata.Info, info)
 	//return an error if further decode fails.
 	if err != nil {
-		return TorrentFile{}, err
+		return TorrentFile{}, fmt.Errorf("%w: %v", ErrInvalidMetainfo, err)
+	}
+	if info.PieceLength == 0 || len(info.Piece) == 0 || len(info.Piece)%20 != 0 {
+		return TorrentFile{}, fmt.Errorf("%w: %d bytes of piece hashes, pieces of %d bytes", ErrInvalidMetainfo, len(info.Piece), info.PieceLength)
+	}
+	metadataFiles := make([]*FileMetaData, 0)
+	if info.Length == 0 {
+		if err = bencode.DecodeBytes(info.Files, &metadataFiles); err != nil {
+			return TorrentFile{}, fmt.Errorf("%w: %v", ErrInvalidMetainfo, err)
+		}
+	}
+	// there is a hash for every piece, the last one may be shorter
+	total := info.Length
+	for _, f := range metadataFiles {
+		total += f.Length
+	}
+	if pieces := (total + uint64(info.PieceLength) - 1) / uint64(info.PieceLength); uint64(len(info.Piece)/20) != pieces {
+		return TorrentFile{}, fmt.Errorf("%w: %d piece hashes for %d pieces", ErrInvalidMetainfo, len(info.Piece)/20, pieces)
 	}
 	//This variable refers to the Total torrent size.
 	var Length uint64
 	files := make([]*File, 0)
 	// single file context
-	os.Mkdir(info.Name, os.ModePerm)
+	if !config.ReadOnly {
+		os.MkdirAll(filepath.Join(config.IncompleteDir, info.Name), os.ModePerm)
+	}
 	if info.Length > 0 {
 		var filePointer *os.File
-		if !args.ARGS.Resume {
-			filePointer, err = os.Create(info.Name + "/" + info.Name)
-		} else {
-			filePointer, err = os.OpenFile(info.Name+"/"+info.Name, os.O_WRONLY, 0600)
+		relPath := info.Name + "/" + info.Name
+		diskPath, finalPath := placeFile(relPath, config)
+		if wanted == nil || wanted(0) {
+			filePointer, err = openFile(diskPath, config)
 		}
 
 		if err != nil {
-			fmt.Println(err)
-			panic(err)
+			return TorrentFile{}, &FileError{Path: diskPath, Err: err}
 		}
 		files = append(files, &File{
 			Path:        []string{info.Name},
 			Length:      info.Length,
 			FilePointer: filePointer,
+			DiskPath:    diskPath,
+			FinalPath:   finalPath,
+			RelPath:     relPath,
 		})
 		Length = info.Length
 	} else {
 		//multiple files are present.
-		metadataFiles := make([]*FileMetaData, 0)
-		err = bencode.DecodeBytes(info.Files, &metadataFiles)
-		if err != nil {
-			return TorrentFile{}, err
-		}
-
-		for _, f := range metadataFiles {
+		for i, f := range metadataFiles {
+			if len(f.Path) == 0 {
+				closeFiles(files)
+				return TorrentFile{}, fmt.Errorf("%w: file %d has no path", ErrInvalidMetainfo, i)
+			}
 			var filePointer *os.File
-			if !args.ARGS.Resume {
-				filePointer, err = os.Create(info.Name + "/" + f.Path[0])
-			} else {
-				filePointer, err = os.OpenFile(info.Name+"/"+f.Path[0], os.O_WRONLY, 0600)
+			relPath := info.Name + "/" + f.Path[0]
+			diskPath, finalPath := placeFile(relPath, config)
+			if wanted == nil || wanted(i) {
+				filePointer, err = openFile(diskPath, config)
 			}
 			if err != nil {
-				fmt.Println(err)
-				panic("Unable to create files ")
+				closeFiles(files)
+				return TorrentFile{}, &FileError{Path: diskPath, Err: err}
 			}
 			files = append(files, &File{
 				Path:        []string{info.Name + "/" + f.Path[0]},
 				Length:      f.Length,
 				FilePointer: filePointer,
+				DiskPath:    diskPath,
+				FinalPath:   finalPath,
+				RelPath:     relPath,
 			})
 			Length += f.Length
 		}
@@ -112,9 +165,54 @@ func Parse(reader io.Reader) (TorrentFile, error) {
 		Files:       files,
 		PieceLength: info.PieceLength,
 		Piece:       info.Piece,
+		Dir:         config.IncompleteDir,
 	}, nil
 }
 
+//closeFiles closes the files opened before a parse failed.
+func closeFiles(files []*File) {
+	for _, file := range files {
+		if file.FilePointer != nil {
+			file.FilePointer.Close()
+		}
+	}
+}
+
+//PartSuffix is added to the names of incomplete files when PartSuffix of the args is set.
+var PartSuffix = ".part"
+
+//placeFile returns where a file of the torrent is downloaded and where it is moved once complete.
+//A file already in the complete folder stays there.
+func placeFile(relPath string, config *args.Args) (diskPath string, finalPath string) {
+	finalPath = filepath.Join(config.CompleteDir, relPath)
+	diskPath = filepath.Join(config.IncompleteDir, relPath)
+	if config.PartSuffix {
+		diskPath += PartSuffix
+	}
+	if diskPath != finalPath {
+		if _, err := os.Stat(finalPath); err == nil {
+			diskPath = finalPath
+		}
+	}
+	return
+}
+
+//openFile opens a file of the torrent. It is created unless we resume or only read.
+//Missing files are left nil when only reading.
+func openFile(path string, config *args.Args) (*os.File, error) {
+	if config.ReadOnly {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return file, err
+	}
+	if config.Resume {
+		return os.OpenFile(path, os.O_RDWR, 0600)
+	}
+	return os.Create(path)
+}
+
 //ParseFromFile parses a .torrent file.
 func ParseFromFile(path string) (TorrentFile, error) {
 	file, err := os.Open(path)
@@ -127,6 +225,17 @@ func ParseFromFile(path string) (TorrentFile, error) {
 	return Parse(file)
 }
 
+//ParseFromFileSelected parses a .torrent file and opens only the wanted files. See ParseSelected.
+func ParseFromFileSelected(path string, wanted func(file int) bool) (TorrentFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	defer file.Close()
+
+	return ParseSelected(file, wanted)
+}
+
 // PieceLen returns the length of ith piece of file
 func PieceLen(torrent TorrentFile, index uint32) (length uint32, err error) {
 	totalLength := torrent.Length
@@ -183,3 +292,14 @@ func BlockLen(torrent TorrentFile, pieceIndex uint32, blockIndex uint32) (length
 	}
 	return
 }
+
+//ParseFromFileWithArgs parses a .torrent file with the folders and options of config. See ParseWithArgs.
+func ParseFromFileWithArgs(path string, wanted func(file int) bool, config *args.Args) (TorrentFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	defer file.Close()
+
+	return ParseWithArgs(file, wanted, config)
+}
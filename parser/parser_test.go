@@ -1,11 +1,16 @@
 package parser
 
 import (
+	"bytes"
+	"errors"
+	"github.com/concurrency-8/args"
 	"github.com/stretchr/testify/assert"
+	"github.com/zeebo/bencode"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 )
@@ -121,3 +126,70 @@ func TestBlockLen(t *testing.T) {
 	}
 
 }
+
+func TestPlaceFile(t *testing.T) {
+	config := &args.Args{}
+	dir, _ := ioutil.TempDir("", "parser")
+	defer os.RemoveAll(dir)
+
+	diskPath, finalPath := placeFile("name/a", config)
+	assert.Equal(t, "name/a", diskPath)
+	assert.Equal(t, diskPath, finalPath)
+
+	config.IncompleteDir = filepath.Join(dir, "incomplete")
+	config.CompleteDir = filepath.Join(dir, "complete")
+	config.PartSuffix = true
+	diskPath, finalPath = placeFile("name/a", config)
+	assert.Equal(t, filepath.Join(dir, "incomplete", "name", "a.part"), diskPath)
+	assert.Equal(t, filepath.Join(dir, "complete", "name", "a"), finalPath)
+
+	// A complete file stays where it is
+	os.MkdirAll(filepath.Dir(finalPath), os.ModePerm)
+	ioutil.WriteFile(finalPath, nil, 0600)
+	diskPath, _ = placeFile("name/a", config)
+	assert.Equal(t, finalPath, diskPath)
+}
+
+func TestParseErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "parser")
+	defer os.RemoveAll(dir)
+	config := &args.Args{IncompleteDir: dir}
+
+	_, err := ParseWithArgs(bytes.NewBufferString("not bencode"), nil, config)
+	assert.True(t, errors.Is(err, ErrInvalidMetainfo))
+
+	encode := func(info map[string]interface{}) *bytes.Buffer {
+		raw, _ := bencode.EncodeBytes(info)
+		data, _ := bencode.EncodeBytes(map[string]interface{}{"announce": "udp://tracker", "info": bencode.RawMessage(raw)})
+		return bytes.NewBuffer(data)
+	}
+	// piece hashes are 20 bytes each
+	_, err = ParseWithArgs(encode(map[string]interface{}{"name": "a", "length": 16, "piece length": 16, "pieces": "short"}), nil, config)
+	assert.True(t, errors.Is(err, ErrInvalidMetainfo))
+
+	// there is one hash per piece
+	_, err = ParseWithArgs(encode(map[string]interface{}{"name": "a", "length": 40, "piece length": 16, "pieces": string(make([]byte, 40))}), nil, config)
+	assert.True(t, errors.Is(err, ErrInvalidMetainfo))
+	_, err = ParseWithArgs(encode(map[string]interface{}{"name": "a", "length": 16, "piece length": 16, "pieces": string(make([]byte, 40))}), nil, config)
+	assert.True(t, errors.Is(err, ErrInvalidMetainfo))
+	files := []map[string]interface{}{{"length": 10, "path": []string{"b"}}, {"length": 10, "path": []string{"c"}}}
+	_, err = ParseWithArgs(encode(map[string]interface{}{"name": "m", "files": files, "piece length": 16, "pieces": string(make([]byte, 20))}), nil, config)
+	assert.True(t, errors.Is(err, ErrInvalidMetainfo))
+	_, err = os.Stat(filepath.Join(dir, "m"))
+	assert.True(t, os.IsNotExist(err), "Files created for an invalid torrent")
+	torrent, err := ParseWithArgs(encode(map[string]interface{}{"name": "m", "files": files, "piece length": 16, "pieces": string(make([]byte, 40))}), nil, config)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(20), torrent.Length)
+	closeFiles(torrent.Files)
+
+	// resuming opens the existing files only
+	config.Resume = true
+	_, err = ParseWithArgs(encode(map[string]interface{}{"name": "a", "length": 16, "piece length": 16, "pieces": string(make([]byte, 20))}), nil, config)
+	var fileErr *FileError
+	assert.True(t, errors.As(err, &fileErr))
+	assert.Equal(t, filepath.Join(dir, "a", "a"), fileErr.Path)
+	assert.True(t, os.IsNotExist(fileErr.Err))
+
+	_, err = RandomPieceBlock(TorrentFile{})
+	assert.True(t, errors.Is(err, ErrInvalidMetainfo))
+}
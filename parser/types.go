@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"fmt"
 	"github.com/zeebo/bencode"
 	"math/rand"
 	"os"
@@ -39,6 +40,12 @@ type File struct {
 	Path        []string
 	Length      uint64
 	FilePointer *os.File
+	//DiskPath is where the file is kept on disk.
+	DiskPath string
+	//FinalPath is where the file is moved once complete. It is DiskPath unless files are staged.
+	FinalPath string
+	//RelPath is the path of the file in the download folder.
+	RelPath string
 }
 
 //TorrentFile contains information about the torrent.
@@ -53,6 +60,8 @@ type TorrentFile struct {
 	Files       []*File
 	PieceLength uint32
 	Piece       []byte
+	// Dir is the folder the torrent is downloaded into, its side and resume files are kept there
+	Dir string
 }
 
 // PieceBlock is struct for a block of a piece
@@ -70,23 +79,26 @@ type Piece struct {
 }
 
 // RandomPieceBlock returns a random PieceBlock object from torrent
-func RandomPieceBlock(torrent TorrentFile) PieceBlock {
+func RandomPieceBlock(torrent TorrentFile) (PieceBlock, error) {
+	if len(torrent.Piece) < 20 {
+		return PieceBlock{}, fmt.Errorf("%w: no pieces", ErrInvalidMetainfo)
+	}
 	pieceIndex := rand.Uint32() % uint32(len(torrent.Piece)/20)
 	blocksPerPiece, err := BlocksPerPiece(torrent, pieceIndex)
 	if err != nil {
-		panic(err)
+		return PieceBlock{}, err
 	}
 	blockIndex := rand.Uint32() % blocksPerPiece
 	blockLength, err := BlockLen(torrent, pieceIndex, blockIndex)
 	if err != nil {
-		panic(err)
+		return PieceBlock{}, err
 	}
 	return PieceBlock{
 		Index:   pieceIndex,
 		Begin:   blockIndex * BLOCK_LEN,
 		Length:  blockLength,
 		Nblocks: blocksPerPiece,
-	}
+	}, nil
 }
 
 // GetTorrentFileList gives the list of torrentfiles (these should be alive, in test_torrents)
@@ -0,0 +1,29 @@
+package piece
+
+// Bitset is a packed set of bits. Bit 0 is the high bit of the first byte, as in the wire bitfield
+type Bitset []byte
+
+// NewBitset returns a bitset of n bits, all clear
+func NewBitset(n int) Bitset {
+	return make(Bitset, (n+7)/8)
+}
+
+// Get tells if bit i is set
+func (bitset Bitset) Get(i int) bool {
+	return bitset[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+// Set sets bit i
+func (bitset Bitset) Set(i int) {
+	bitset[i/8] |= 0x80 >> uint(i%8)
+}
+
+// Clear clears bit i
+func (bitset Bitset) Clear(i int) {
+	bitset[i/8] &^= 0x80 >> uint(i%8)
+}
+
+// Clone returns a copy of the bitset
+func (bitset Bitset) Clone() Bitset {
+	return append(Bitset(nil), bitset...)
+}
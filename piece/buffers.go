@@ -0,0 +1,88 @@
+package piece
+
+import (
+	"sync"
+
+	"github.com/concurrency-8/parser"
+)
+
+// MaxBuffers is the maximum number of pieces being downloaded at once by a new tracker. Every such piece
+// holds a buffer of its length until it is verified and written to storage
+var MaxBuffers = 32
+
+// Buffers holds the blocks of pieces that are not verified yet
+type Buffers struct {
+	Torrent parser.TorrentFile
+	Max     int
+	lock    sync.Mutex
+	buffers map[uint32][]byte
+}
+
+// NewBuffers returns buffers for at most max pieces of the torrent
+func NewBuffers(torrent parser.TorrentFile, max int) *Buffers {
+	return &Buffers{Torrent: torrent, Max: max, buffers: make(map[uint32][]byte)}
+}
+
+// Available tells if blocks of the piece can be requested without going over Max
+func (buffers *Buffers) Available(index uint32) bool {
+	buffers.lock.Lock()
+	defer buffers.lock.Unlock()
+	_, ok := buffers.buffers[index]
+	return ok || len(buffers.buffers) < buffers.Max
+}
+
+// Reserve allocates the buffer of the piece. It tells if the piece has a buffer, there is none past Max
+func (buffers *Buffers) Reserve(index uint32) bool {
+	buffers.lock.Lock()
+	defer buffers.lock.Unlock()
+	return buffers.reserve(index) != nil
+}
+
+func (buffers *Buffers) reserve(index uint32) []byte {
+	buffer, ok := buffers.buffers[index]
+	if !ok {
+		if len(buffers.buffers) >= buffers.Max {
+			return nil
+		}
+		length, _ := parser.PieceLen(buffers.Torrent, index)
+		buffer = make([]byte, length)
+		buffers.buffers[index] = buffer
+	}
+	return buffer
+}
+
+// Add copies the block into the buffer of its piece. It tells if the block was buffered,
+// it is not when the piece has no buffer and Max are taken
+func (buffers *Buffers) Add(block parser.PieceBlock) bool {
+	buffers.lock.Lock()
+	defer buffers.lock.Unlock()
+	buffer := buffers.reserve(block.Index)
+	if buffer == nil {
+		return false
+	}
+	if int(block.Begin) < len(buffer) {
+		copy(buffer[block.Begin:], block.Bytes)
+	}
+	return true
+}
+
+// Piece returns the buffered data of the piece
+func (buffers *Buffers) Piece(index uint32) []byte {
+	buffers.lock.Lock()
+	defer buffers.lock.Unlock()
+	return buffers.buffers[index]
+}
+
+// Release frees the buffer of the piece once it is written to storage or discarded
+func (buffers *Buffers) Release(index uint32) {
+	buffers.lock.Lock()
+	defer buffers.lock.Unlock()
+	delete(buffers.buffers, index)
+}
+
+// Len returns the number of pieces with a buffer
+func (buffers *Buffers) Len() int {
+	buffers.lock.Lock()
+	defer buffers.lock.Unlock()
+	return len(buffers.buffers)
+}
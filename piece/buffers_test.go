@@ -0,0 +1,33 @@
+package piece
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/concurrency-8/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuffers(t *testing.T) {
+	torrent, _ := parser.ParseFromFile("../test_torrents/big-buck-bunny.torrent")
+	buffers := NewBuffers(torrent, 1)
+	assert.True(t, buffers.Available(0))
+	assert.True(t, buffers.Reserve(0))
+	assert.True(t, buffers.Available(0), "Reserved piece not available")
+	assert.False(t, buffers.Available(1), "Cap not applied")
+
+	block := parser.PieceBlock{Index: 0, Begin: parser.BLOCK_LEN, Bytes: bytes.Repeat([]byte{7}, 10)}
+	assert.True(t, buffers.Add(block))
+	piece := buffers.Piece(0)
+	assert.Equal(t, int(torrent.PieceLength), len(piece))
+	assert.Equal(t, block.Bytes, piece[block.Begin:block.Begin+10])
+
+	// No buffer past Max, even for a block of another piece
+	assert.False(t, buffers.Reserve(1))
+	assert.False(t, buffers.Add(parser.PieceBlock{Index: 1, Bytes: block.Bytes}))
+	assert.Equal(t, 1, buffers.Len())
+
+	buffers.Release(0)
+	assert.Equal(t, 0, buffers.Len())
+	assert.True(t, buffers.Available(1))
+}
@@ -8,41 +8,182 @@ import (
 	"github.com/concurrency-8/parser"
 )
 
-// PieceTracker stores flags for blocks of pieces requested and received
-// Requested[i][j] = true => jth block of ith piece has been requested
+// PieceTracker stores flags for blocks of pieces requested and received, packed in bitsets.
+// Blocks are numbered across the torrent, block j of piece i is bit i*BlocksPerPiece+j.
+// Counters of the flags are kept up to date so that progress is known without scanning
 type PieceTracker struct {
-	Torrent   parser.TorrentFile
-	Requested [][]bool
-	Received  [][]bool
-	Lock      sync.Mutex
+	Torrent parser.TorrentFile
+	Lock    sync.Mutex
+	// Buffers holds the received blocks of pieces that are not verified yet
+	Buffers *Buffers
+
+	numPieces      int
+	blocksPerPiece int
+	requested      Bitset
+	received       Bitset
+	// complete has the pieces with every block received
+	complete Bitset
+
+	// counters of flags per piece, and for the whole torrent
+	blocks         []int
+	requestedCount []int
+	receivedCount  []int
+	piecesDone     int
+	bytesDone      uint64
+	inFlight       int
+
+	// counters over wanted pieces only
+	wanted          []bool
+	wantedBlocks    int
+	wantedRequested int
+	wantedReceived  int
+	wantedPieces    int
+	wantedVerified  int
+
+	filePriorities  []Priority
+	piecePriorities []Priority
+	windows         map[interface{}]window
+
+	// verified pieces passed the hash check and are in storage
+	verified     []bool
+	verifiedCond *sync.Cond
 }
 
 // NewPieceTracker returns a new PieceTracker object for the torrent
 func NewPieceTracker(torrent parser.TorrentFile) (tracker *PieceTracker) {
 	tracker = new(PieceTracker)
 	tracker.Torrent = torrent
-	numPieces := uint32(len(torrent.Piece) / 20)
-	for i := uint32(0); i < numPieces; i++ {
-		blocksPerPiece, _ := parser.BlocksPerPiece(torrent, i)
-		tracker.Requested = append(tracker.Requested, make([]bool, blocksPerPiece))
-		tracker.Received = append(tracker.Received, make([]bool, blocksPerPiece))
+	tracker.Buffers = NewBuffers(torrent, MaxBuffers)
+	tracker.numPieces = len(torrent.Piece) / 20
+	tracker.blocksPerPiece = int(math.Ceil(float64(torrent.PieceLength) / float64(parser.BLOCK_LEN)))
+	tracker.blocks = make([]int, tracker.numPieces)
+	for i := range tracker.blocks {
+		blocksPerPiece, _ := parser.BlocksPerPiece(torrent, uint32(i))
+		tracker.blocks[i] = int(blocksPerPiece)
 	}
+	numBlocks := tracker.numPieces * tracker.blocksPerPiece
+	tracker.requested = NewBitset(numBlocks)
+	tracker.received = NewBitset(numBlocks)
+	tracker.complete = NewBitset(tracker.numPieces)
+	tracker.requestedCount = make([]int, tracker.numPieces)
+	tracker.receivedCount = make([]int, tracker.numPieces)
+	tracker.verified = make([]bool, tracker.numPieces)
+	for i, blocks := range tracker.blocks {
+		if blocks == 0 {
+			tracker.complete.Set(i)
+			tracker.piecesDone++
+			tracker.verified[i] = true
+		}
+	}
+	tracker.verifiedCond = sync.NewCond(&tracker.Lock)
+	tracker.initPriorities()
 
 	return
 }
 
+// bit returns the bit of a block in the bitsets
+func (tracker *PieceTracker) bit(index uint32, block uint32) int {
+	return int(index)*tracker.blocksPerPiece + int(block)
+}
+
+// NumPieces returns the number of pieces of the torrent
+func (tracker *PieceTracker) NumPieces() int {
+	return tracker.numPieces
+}
+
+// Blocks returns the number of blocks of a piece
+func (tracker *PieceTracker) Blocks(index uint32) int {
+	return tracker.blocks[index]
+}
+
+// BlockRequested tells if a block of a piece has been requested.
+// Not putting locks here, the caller must hold Lock
+func (tracker *PieceTracker) BlockRequested(index uint32, block uint32) bool {
+	return tracker.requested.Get(tracker.bit(index, block))
+}
+
+// BlockReceived tells if a block of a piece has been received.
+// Not putting locks here, the caller must hold Lock
+func (tracker *PieceTracker) BlockReceived(index uint32, block uint32) bool {
+	return tracker.received.Get(tracker.bit(index, block))
+}
+
+// setRequested sets or clears the requested flag of a block and updates the counters
+func (tracker *PieceTracker) setRequested(index uint32, block uint32, requested bool) {
+	bit := tracker.bit(index, block)
+	if tracker.requested.Get(bit) == requested {
+		return
+	}
+	change := 1
+	if requested {
+		tracker.requested.Set(bit)
+	} else {
+		tracker.requested.Clear(bit)
+		change = -1
+	}
+	tracker.requestedCount[index] += change
+	if tracker.wanted[index] {
+		tracker.wantedRequested += change
+	}
+	if !tracker.received.Get(bit) {
+		tracker.inFlight += change
+	}
+}
+
+// setReceived sets or clears the received flag of a block and updates the counters
+func (tracker *PieceTracker) setReceived(index uint32, block uint32, received bool) {
+	bit := tracker.bit(index, block)
+	if tracker.received.Get(bit) == received {
+		return
+	}
+	wasComplete := tracker.complete.Get(int(index))
+	change := 1
+	if received {
+		tracker.received.Set(bit)
+	} else {
+		tracker.received.Clear(bit)
+		change = -1
+	}
+	length, _ := parser.BlockLen(tracker.Torrent, index, block)
+	if received {
+		tracker.bytesDone += uint64(length)
+	} else {
+		tracker.bytesDone -= uint64(length)
+	}
+	tracker.receivedCount[index] += change
+	if tracker.wanted[index] {
+		tracker.wantedReceived += change
+	}
+	if tracker.requested.Get(bit) {
+		tracker.inFlight -= change
+	}
+	if isComplete := tracker.receivedCount[index] == tracker.blocks[index]; isComplete != wasComplete {
+		if isComplete {
+			tracker.complete.Set(int(index))
+			tracker.piecesDone++
+		} else {
+			tracker.complete.Clear(int(index))
+			tracker.piecesDone--
+		}
+	}
+}
+
 // AddRequested flags the request value of a block in a piece
 // Invoked while requesting the block of a piece
 func (tracker *PieceTracker) AddRequested(block parser.PieceBlock) {
-	index := block.Begin / parser.BLOCK_LEN
-	tracker.Requested[block.Index][index] = true
+	tracker.setRequested(block.Index, block.Begin/parser.BLOCK_LEN, true)
+}
+
+// RemoveRequested clears the request flag of a block in a piece
+// Invoked when the peer rejects our request for the block
+func (tracker *PieceTracker) RemoveRequested(block parser.PieceBlock) {
+	tracker.setRequested(block.Index, block.Begin/parser.BLOCK_LEN, false)
 }
 
 // AddReceived flags the received value of a block in a piece
 // Invoked when a block is received
 func (tracker *PieceTracker) AddReceived(block parser.PieceBlock) {
-	index := block.Begin / parser.BLOCK_LEN
-	tracker.Received[block.Index][index] = true
+	tracker.setReceived(block.Index, block.Begin/parser.BLOCK_LEN, true)
 }
 
 // Needed checks if we want a block. If we have already requested all,
@@ -50,73 +191,84 @@ func (tracker *PieceTracker) AddReceived(block parser.PieceBlock) {
 // Not putting locks here, the caller must make sure that this runs at once by a single thread
 func (tracker *PieceTracker) Needed(block parser.PieceBlock) bool {
 
-	// Check if all have been requested...
-	allRequested := true
-	for _, i := range tracker.Requested {
-		if !allRequested {
-			break
-		}
-		for _, j := range i {
-			allRequested = allRequested && j
-		}
-	}
-
-	// If yes, copy received into request...
-	if allRequested {
-		tracker.Requested = clone(tracker.Received)
+	// Check if all wanted have been requested...
+	if tracker.wantedRequested == tracker.wantedBlocks {
+		// If yes, copy received into request...
+		tracker.requested = tracker.received.Clone()
+		copy(tracker.requestedCount, tracker.receivedCount)
+		tracker.wantedRequested = tracker.wantedReceived
+		tracker.inFlight = 0
 	}
 
-	return !tracker.Requested[block.Index][block.Begin/parser.BLOCK_LEN]
-}
-
-// Deep clones 2-D bool array
-func clone(array [][]bool) (result [][]bool) {
-	for _, i := range array {
-		temp := make([]bool, len(i))
-		for index, j := range i {
-			temp[index] = j
-		}
-		result = append(result, temp)
-	}
-	return
+	return !tracker.BlockRequested(block.Index, block.Begin/parser.BLOCK_LEN)
 }
 
 // PieceIsDone tells if the pieceIndex piece has been downloaded successfully
 func (tracker *PieceTracker) PieceIsDone(pieceIndex uint32) (result bool) {
 	tracker.Lock.Lock()
-	result = true
-	for _, i := range tracker.Received[pieceIndex] {
-		result = result && i
-	}
+	result = tracker.complete.Get(int(pieceIndex))
 	tracker.Lock.Unlock()
 	return
 }
 
-// IsDone tells if the torrent file has been successfully received
-func (tracker *PieceTracker) IsDone() (result bool) {
+// PieceReceived tells if every block of the piece has been received.
+// Not putting locks here, the caller must hold Lock
+func (tracker *PieceTracker) PieceReceived(index uint32) bool {
+	return tracker.complete.Get(int(index))
+}
+
+// Bitfield returns the pieces that are verified and in storage, the high bit of the first byte is piece 0.
+// Pieces with every block received are left out until they pass their hash check
+func (tracker *PieceTracker) Bitfield() (bitfield []byte) {
 	tracker.Lock.Lock()
-	result = true
-	for _, i := range tracker.Received {
-		for _, j := range i {
-			result = result && j
+	defer tracker.Lock.Unlock()
+	bitfield = make([]byte, (tracker.numPieces+7)/8)
+	for i, verified := range tracker.verified {
+		if verified {
+			bitfield[i/8] |= 0x80 >> uint(i%8)
 		}
 	}
+	return
+}
+
+// IsDone tells if every wanted piece of the torrent file is verified and in storage.
+// Pieces with every block received may still fail their hash check
+func (tracker *PieceTracker) IsDone() (result bool) {
+	tracker.Lock.Lock()
+	result = tracker.wantedVerified == tracker.wantedPieces
 	tracker.Lock.Unlock()
 	return
 }
 
-// PrintPercentageDone prints the percentage of download completed on the screen
+// PiecesDone returns the number of pieces with every block received
+func (tracker *PieceTracker) PiecesDone() int {
+	tracker.Lock.Lock()
+	defer tracker.Lock.Unlock()
+	return tracker.piecesDone
+}
+
+// BytesDone returns the number of bytes received
+func (tracker *PieceTracker) BytesDone() uint64 {
+	tracker.Lock.Lock()
+	defer tracker.Lock.Unlock()
+	return tracker.bytesDone
+}
+
+// InFlight returns the number of blocks requested and not received yet
+func (tracker *PieceTracker) InFlight() int {
+	tracker.Lock.Lock()
+	defer tracker.Lock.Unlock()
+	return tracker.inFlight
+}
+
+// PrintPercentageDone returns the percentage of wanted blocks received
 func (tracker *PieceTracker) PrintPercentageDone() (percent int) {
-	downloaded, total := 0.0, 0
-	for _, i := range tracker.Received {
-		for _, j := range i {
-			total++
-			if j {
-				downloaded++
-			}
-		}
+	tracker.Lock.Lock()
+	defer tracker.Lock.Unlock()
+	if tracker.wantedBlocks == 0 {
+		return 100
 	}
-	percent = int(math.Round(float64(downloaded*100) / float64(total)))
+	percent = int(math.Round(float64(tracker.wantedReceived*100) / float64(tracker.wantedBlocks)))
 	// fmt.Print("progress:", percent, "\r")
 	return
 }
@@ -124,26 +276,69 @@ func (tracker *PieceTracker) PrintPercentageDone() (percent int) {
 // Reset the piece - Called when invalid SHA
 func (tracker *PieceTracker) Reset(index uint32) {
 	tracker.Lock.Lock()
-	for i := range tracker.Requested[index] {
-		tracker.Requested[index][i] = false
-		tracker.Received[index][i] = false
+	for i := 0; i < tracker.blocks[index]; i++ {
+		tracker.setRequested(index, uint32(i), false)
+		tracker.setReceived(index, uint32(i), false)
 	}
+	tracker.setVerified(index, false)
 	tracker.Lock.Unlock()
 }
 
 // Fill is used to revive the piecetracker while resuming the torrent
 func (tracker *PieceTracker) Fill(index uint32) {
-	for i := range tracker.Requested[index] {
-		tracker.Requested[index][i] = true
-		tracker.Received[index][i] = true
+	for i := 0; i < tracker.blocks[index]; i++ {
+		tracker.setRequested(index, uint32(i), true)
+		tracker.setReceived(index, uint32(i), true)
 	}
+	tracker.setVerified(index, true)
+	tracker.verifiedCond.Broadcast()
+}
+
+// MarkVerified records that the piece passed its hash check and is in storage
+func (tracker *PieceTracker) MarkVerified(index uint32) {
+	tracker.Lock.Lock()
+	tracker.setVerified(index, true)
+	tracker.Lock.Unlock()
+	tracker.verifiedCond.Broadcast()
+}
+
+// setVerified sets or clears the verified flag of a piece and updates the counter of wanted pieces
+func (tracker *PieceTracker) setVerified(index uint32, verified bool) {
+	if tracker.verified[index] == verified {
+		return
+	}
+	tracker.verified[index] = verified
+	if tracker.wanted[index] {
+		if verified {
+			tracker.wantedVerified++
+		} else {
+			tracker.wantedVerified--
+		}
+	}
+}
+
+// Verified tells if the piece passed its hash check and can be read from storage.
+// Not putting locks here, the caller must hold Lock
+func (tracker *PieceTracker) Verified(index uint32) bool {
+	return tracker.verified[index]
+}
+
+// WaitVerified waits until a piece is verified or Wake is called.
+// The caller must hold Lock, it is released while waiting
+func (tracker *PieceTracker) WaitVerified() {
+	tracker.verifiedCond.Wait()
+}
+
+// Wake wakes everyone in WaitVerified
+func (tracker *PieceTracker) Wake() {
+	tracker.verifiedCond.Broadcast()
 }
 
 // PrintLeft prints left
 func (tracker *PieceTracker) PrintLeft() {
-	for i := range tracker.Received {
-		for j := range tracker.Received[i] {
-			if !tracker.Received[i][j] {
+	for i := 0; i < tracker.numPieces; i++ {
+		for j := 0; j < tracker.blocks[i]; j++ {
+			if !tracker.BlockReceived(uint32(i), uint32(j)) {
 				fmt.Print("[", i, "][", j, "]\t")
 			}
 		}
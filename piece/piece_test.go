@@ -12,24 +12,23 @@ func TestNewPieceTracker(t *testing.T) {
 	assert := assert.New(t)
 	torrent, _ := parser.ParseFromFile("../test_torrents/big-buck-bunny.torrent")
 	tracker := NewPieceTracker(torrent)
-	for _, i := range tracker.Requested {
-		for _, j := range i {
-			assert.Equal(j, false)
-		}
-	}
-
-	for _, i := range tracker.Received {
-		for _, j := range i {
-			assert.Equal(j, false)
+	assert.Equal(len(torrent.Piece)/20, tracker.NumPieces())
+	for i := 0; i < tracker.NumPieces(); i++ {
+		for j := 0; j < tracker.Blocks(uint32(i)); j++ {
+			assert.Equal(false, tracker.BlockRequested(uint32(i), uint32(j)))
+			assert.Equal(false, tracker.BlockReceived(uint32(i), uint32(j)))
 		}
 	}
+	assert.Equal(0, tracker.PiecesDone())
+	assert.Equal(uint64(0), tracker.BytesDone())
+	assert.Equal(0, tracker.InFlight())
 }
 
 func getTorrentBlockTracker() (torrent parser.TorrentFile,
 	pieceBlock parser.PieceBlock,
 	tracker *PieceTracker) {
 	torrent, _ = parser.ParseFromFile("../test_torrents/big-buck-bunny.torrent")
-	pieceBlock = parser.RandomPieceBlock(torrent)
+	pieceBlock, _ = parser.RandomPieceBlock(torrent)
 	tracker = NewPieceTracker(torrent)
 	return
 }
@@ -37,48 +36,70 @@ func getTorrentBlockTracker() (torrent parser.TorrentFile,
 func TestAddRequested(t *testing.T) {
 	_, pieceBlock, tracker := getTorrentBlockTracker()
 	tracker.AddRequested(pieceBlock)
-	assert.Equal(t, true, tracker.Requested[pieceBlock.Index][pieceBlock.Begin/parser.BLOCK_LEN])
+	assert.Equal(t, true, tracker.BlockRequested(pieceBlock.Index, pieceBlock.Begin/parser.BLOCK_LEN))
+	assert.Equal(t, 1, tracker.InFlight())
+	tracker.RemoveRequested(pieceBlock)
+	assert.Equal(t, false, tracker.BlockRequested(pieceBlock.Index, pieceBlock.Begin/parser.BLOCK_LEN))
+	assert.Equal(t, 0, tracker.InFlight())
 }
 
 func TestAddReceived(t *testing.T) {
-	_, pieceBlock, tracker := getTorrentBlockTracker()
+	torrent, pieceBlock, tracker := getTorrentBlockTracker()
+	tracker.AddRequested(pieceBlock)
 	tracker.AddReceived(pieceBlock)
-	assert.Equal(t, true, tracker.Received[pieceBlock.Index][pieceBlock.Begin/parser.BLOCK_LEN])
+	assert.Equal(t, true, tracker.BlockReceived(pieceBlock.Index, pieceBlock.Begin/parser.BLOCK_LEN))
+	assert.Equal(t, 0, tracker.InFlight())
+	blockLen, _ := parser.BlockLen(torrent, pieceBlock.Index, pieceBlock.Begin/parser.BLOCK_LEN)
+	assert.Equal(t, uint64(blockLen), tracker.BytesDone())
+
+	// receiving a block twice is counted once
+	tracker.AddReceived(pieceBlock)
+	assert.Equal(t, uint64(blockLen), tracker.BytesDone())
 }
 
 func TestIsDone(t *testing.T) {
-	_, _, tracker := getTorrentBlockTracker()
-	for _, piece := range tracker.Received {
-		for blockIndex := range piece {
-			piece[blockIndex] = true
+	torrent, _, tracker := getTorrentBlockTracker()
+	for index := 0; index < tracker.NumPieces(); index++ {
+		for block := 0; block < tracker.Blocks(uint32(index)); block++ {
+			assert.False(t, tracker.IsDone())
+			tracker.AddReceived(parser.PieceBlock{Index: uint32(index), Begin: uint32(block) * parser.BLOCK_LEN})
 		}
 	}
+	// received is not done until verified
+	assert.False(t, tracker.IsDone())
+	for index := 0; index < tracker.NumPieces(); index++ {
+		tracker.MarkVerified(uint32(index))
+	}
 	assert.True(t, tracker.IsDone())
+	assert.Equal(t, tracker.NumPieces(), tracker.PiecesDone())
+	assert.Equal(t, torrent.Length, tracker.BytesDone())
+	assert.Equal(t, 100, tracker.PrintPercentageDone())
+
+	tracker.Reset(0)
+	assert.False(t, tracker.IsDone())
+	assert.False(t, tracker.PieceIsDone(0))
+	assert.Equal(t, tracker.NumPieces()-1, tracker.PiecesDone())
 }
 
-func TestClone(t *testing.T) {
-
-	// Checking if clone
-	src1 := make([][]bool, 5)
-	for i := 0; i < 5; i++ {
-		src1[i] = make([]bool, 10)
-		for j := 0; j < 10; j++ {
-			src1[i][j] = rand.Uint32()%2 == 0
-		}
-	}
-	dest1 := clone(src1)
-
-	for i := range src1 {
-		for j := range src1[i] {
-			assert.Equal(t, src1[i][j], dest1[i][j])
+func TestBitset(t *testing.T) {
+	bitset := NewBitset(10)
+	assert.Len(t, bitset, 2)
+	for i := 0; i < 10; i++ {
+		if rand.Uint32()%2 == 0 {
+			bitset.Set(i)
 		}
 	}
+	bitset.Set(0)
+	bitset.Set(9)
+	assert.Equal(t, byte(0x80), bitset[0]&0x80)
+	assert.Equal(t, byte(0x40), bitset[1]&0x40)
 
 	// Checking if deep clone
-	src2 := [][]bool{{true}, {true, false}}
-	dest2 := clone(src2)
-	src2[1][1] = !src2[1][1]
-	assert.NotEqual(t, src2[1][1], dest2[1][1])
+	clone := bitset.Clone()
+	assert.Equal(t, bitset, clone)
+	bitset.Clear(9)
+	assert.False(t, bitset.Get(9))
+	assert.True(t, clone.Get(9))
 }
 
 func TestNeeded(t *testing.T) {
@@ -86,23 +107,45 @@ func TestNeeded(t *testing.T) {
 
 	assert.True(t, tracker.Needed(pieceBlock))
 
-	// Checking if the call for needed copies the received array
-	// in requested array when all true
-	tracker.Requested = [][]bool{{true, true, true}, {true, true, true}}
-	tracker.Received = [][]bool{{true, false, false}, {false, false, true}}
+	// Checking if the call for needed copies the received flags
+	// in requested flags when all are requested
+	tracker = getTwoFileTracker()
+	for index := uint32(0); index < 4; index++ {
+		tracker.AddRequested(parser.PieceBlock{Index: index})
+	}
+	tracker.AddReceived(parser.PieceBlock{Index: 0})
+	tracker.AddReceived(parser.PieceBlock{Index: 3})
+	assert.Equal(t, 2, tracker.InFlight())
 
-	pieceBlock = parser.PieceBlock{
-		Index:   1,
-		Begin:   200,
-		Length:  1000,
-		Nblocks: 3,
+	assert.True(t, tracker.Needed(parser.PieceBlock{Index: 1}))
+	for index := uint32(0); index < 4; index++ {
+		assert.Equal(t, tracker.BlockReceived(index, 0), tracker.BlockRequested(index, 0))
 	}
+	assert.Equal(t, 0, tracker.InFlight())
+}
 
-	tracker.Needed(pieceBlock)
+func TestBitfield(t *testing.T) {
+	torrent, _, tracker := getTorrentBlockTracker()
+	numPieces := len(torrent.Piece) / 20
+	bitfield := tracker.Bitfield()
+	assert.Len(t, bitfield, (numPieces+7)/8)
+	assert.Equal(t, make([]byte, len(bitfield)), bitfield)
+
+	tracker.Fill(0)
+	tracker.Fill(uint32(numPieces - 1))
+	bitfield = tracker.Bitfield()
+	assert.Equal(t, byte(0x80), bitfield[0]&0x80)
+	last := numPieces - 1
+	assert.NotEqual(t, byte(0), bitfield[last/8]&(0x80>>uint(last%8)))
+}
 
-	for i := range tracker.Requested {
-		for j := range tracker.Requested[i] {
-			assert.Equal(t, tracker.Requested[i][j], tracker.Received[i][j])
-		}
+func TestBitfieldVerified(t *testing.T) {
+	_, _, tracker := getTorrentBlockTracker()
+	for i := 0; i < tracker.blocks[0]; i++ {
+		tracker.AddReceived(parser.PieceBlock{Index: 0, Begin: uint32(i) * parser.BLOCK_LEN})
 	}
+	assert.True(t, tracker.PieceIsDone(0))
+	assert.Equal(t, byte(0), tracker.Bitfield()[0], "Unverified piece in the bitfield")
+	tracker.MarkVerified(0)
+	assert.Equal(t, byte(0x80), tracker.Bitfield()[0])
 }
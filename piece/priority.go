@@ -0,0 +1,160 @@
+package piece
+
+import (
+	"fmt"
+)
+
+// Priority of a file or piece. Pieces of skipped files are not downloaded
+type Priority int
+
+const (
+	// Skip does not download the file
+	Skip Priority = iota
+	// Low downloads the file after all others
+	Low
+	// Normal is the default priority
+	Normal
+	// High downloads the file before all others
+	High
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high"}
+
+func (priority Priority) String() string {
+	if priority < Skip || priority > High {
+		return fmt.Sprintf("Priority(%d)", int(priority))
+	}
+	return priorityNames[priority]
+}
+
+// ParsePriority parses the name of a priority
+func ParsePriority(name string) (Priority, error) {
+	for i, priorityName := range priorityNames {
+		if name == priorityName {
+			return Priority(i), nil
+		}
+	}
+	return Normal, fmt.Errorf("Unknown priority %q", name)
+}
+
+// initPriorities gives every file and piece of the torrent normal priority
+func (tracker *PieceTracker) initPriorities() {
+	tracker.filePriorities = make([]Priority, len(tracker.Torrent.Files))
+	for i := range tracker.filePriorities {
+		tracker.filePriorities[i] = Normal
+	}
+	tracker.piecePriorities = make([]Priority, tracker.numPieces)
+	tracker.wanted = make([]bool, tracker.numPieces)
+	tracker.updatePiecePriorities()
+}
+
+// updatePiecePriorities gives every piece the highest priority of the files it overlaps
+func (tracker *PieceTracker) updatePiecePriorities() {
+	for i := range tracker.piecePriorities {
+		tracker.piecePriorities[i] = Skip
+	}
+	if len(tracker.Torrent.Files) == 0 {
+		// without files, as in tests, every piece is wanted
+		for i := range tracker.piecePriorities {
+			tracker.piecePriorities[i] = Normal
+		}
+		tracker.updateWanted()
+		return
+	}
+	start := uint64(0)
+	for i, file := range tracker.Torrent.Files {
+		if file.Length > 0 && tracker.Torrent.PieceLength > 0 {
+			first := start / uint64(tracker.Torrent.PieceLength)
+			last := (start + file.Length - 1) / uint64(tracker.Torrent.PieceLength)
+			for index := first; index <= last && index < uint64(len(tracker.piecePriorities)); index++ {
+				if tracker.filePriorities[i] > tracker.piecePriorities[index] {
+					tracker.piecePriorities[index] = tracker.filePriorities[i]
+				}
+			}
+		}
+		start += file.Length
+	}
+	tracker.updateWanted()
+}
+
+// updateWanted caches which pieces are wanted and counts their blocks and verified pieces
+func (tracker *PieceTracker) updateWanted() {
+	tracker.wantedBlocks, tracker.wantedRequested, tracker.wantedReceived = 0, 0, 0
+	tracker.wantedPieces, tracker.wantedVerified = 0, 0
+	for i := range tracker.wanted {
+		tracker.wanted[i] = tracker.PiecePriority(uint32(i)) != Skip
+		if tracker.wanted[i] {
+			tracker.wantedBlocks += tracker.blocks[i]
+			tracker.wantedRequested += tracker.requestedCount[i]
+			tracker.wantedReceived += tracker.receivedCount[i]
+			tracker.wantedPieces++
+			if tracker.verified[i] {
+				tracker.wantedVerified++
+			}
+		}
+	}
+}
+
+// window is a range of pieces read soon, they are downloaded first
+type window struct {
+	first, last uint32
+}
+
+// SetWindow gives the pieces from first to last high priority, even in skipped files.
+// key identifies the window, setting it again moves the window
+func (tracker *PieceTracker) SetWindow(key interface{}, first uint32, last uint32) {
+	tracker.Lock.Lock()
+	defer tracker.Lock.Unlock()
+	if tracker.windows == nil {
+		tracker.windows = make(map[interface{}]window)
+	}
+	tracker.windows[key] = window{first, last}
+	tracker.updateWanted()
+}
+
+// ClearWindow removes the window set with key
+func (tracker *PieceTracker) ClearWindow(key interface{}) {
+	tracker.Lock.Lock()
+	defer tracker.Lock.Unlock()
+	delete(tracker.windows, key)
+	tracker.updateWanted()
+}
+
+// SetFilePriority sets the priority of a file of the torrent. It can be called while downloading
+func (tracker *PieceTracker) SetFilePriority(file int, priority Priority) error {
+	if priority < Skip || priority > High {
+		return fmt.Errorf("Invalid priority %v", priority)
+	}
+	tracker.Lock.Lock()
+	defer tracker.Lock.Unlock()
+	if file < 0 || file >= len(tracker.filePriorities) {
+		return fmt.Errorf("File index %d out of range", file)
+	}
+	tracker.filePriorities[file] = priority
+	tracker.updatePiecePriorities()
+	return nil
+}
+
+// FilePriority returns the priority of a file of the torrent
+func (tracker *PieceTracker) FilePriority(file int) Priority {
+	tracker.Lock.Lock()
+	defer tracker.Lock.Unlock()
+	return tracker.filePriorities[file]
+}
+
+// PiecePriority returns the priority of a piece.
+// Not putting locks here, the caller must hold Lock
+func (tracker *PieceTracker) PiecePriority(index uint32) Priority {
+	for _, w := range tracker.windows {
+		if w.first <= index && index <= w.last {
+			return High
+		}
+	}
+	return tracker.piecePriorities[index]
+}
+
+// Wanted tells if the piece overlaps a file that is not skipped, or a window.
+// Not putting locks here, the caller must hold Lock
+func (tracker *PieceTracker) Wanted(index uint32) bool {
+	return tracker.wanted[index]
+}
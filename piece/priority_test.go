@@ -0,0 +1,69 @@
+package piece
+
+import (
+	"testing"
+
+	"github.com/concurrency-8/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// getTwoFileTracker returns a tracker of 4 pieces of 16 bytes over files of 40 and 24 bytes
+func getTwoFileTracker() *PieceTracker {
+	torrent := parser.TorrentFile{PieceLength: 16, Length: 64, Piece: make([]byte, 4*20)}
+	torrent.Files = []*parser.File{{Length: 40}, {Length: 24}}
+	return NewPieceTracker(torrent)
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, priority := range []Priority{Skip, Low, Normal, High} {
+		parsed, err := ParsePriority(priority.String())
+		assert.Nil(t, err)
+		assert.Equal(t, priority, parsed)
+	}
+	_, err := ParsePriority("urgent")
+	assert.NotNil(t, err)
+}
+
+func TestSetFilePriority(t *testing.T) {
+	tracker := getTwoFileTracker()
+	for i := uint32(0); i < 4; i++ {
+		assert.Equal(t, Normal, tracker.PiecePriority(i))
+	}
+
+	assert.Nil(t, tracker.SetFilePriority(1, Skip))
+	assert.Equal(t, Skip, tracker.FilePriority(1))
+	// piece 2 overlaps both files, so it is still wanted
+	assert.True(t, tracker.Wanted(2))
+	assert.False(t, tracker.Wanted(3))
+
+	assert.Nil(t, tracker.SetFilePriority(1, High))
+	assert.Equal(t, Normal, tracker.PiecePriority(0))
+	assert.Equal(t, High, tracker.PiecePriority(2))
+	assert.Equal(t, High, tracker.PiecePriority(3))
+
+	assert.NotNil(t, tracker.SetFilePriority(2, High))
+	assert.NotNil(t, tracker.SetFilePriority(0, Priority(7)))
+}
+
+func TestIsDoneSkipped(t *testing.T) {
+	tracker := getTwoFileTracker()
+	assert.Nil(t, tracker.SetFilePriority(1, Skip))
+	for index := 0; index < 3; index++ {
+		tracker.AddReceived(parser.PieceBlock{Index: uint32(index)})
+		tracker.MarkVerified(uint32(index))
+	}
+	assert.True(t, tracker.IsDone())
+	assert.Nil(t, tracker.SetFilePriority(1, Low))
+	assert.False(t, tracker.IsDone())
+}
+
+func TestWindow(t *testing.T) {
+	tracker := getTwoFileTracker()
+	assert.Nil(t, tracker.SetFilePriority(1, Skip))
+	tracker.SetWindow("reader", 3, 3)
+	assert.Equal(t, High, tracker.PiecePriority(3))
+	assert.True(t, tracker.Wanted(3))
+	assert.Equal(t, Normal, tracker.PiecePriority(0))
+	tracker.ClearWindow("reader")
+	assert.False(t, tracker.Wanted(3))
+}
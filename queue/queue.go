@@ -2,6 +2,8 @@ package queue
 
 import (
 	"fmt"
+	"time"
+
 	"github.com/concurrency-8/parser"
 )
 
@@ -10,14 +12,46 @@ type Queue struct {
 	torrent parser.TorrentFile
 	Choked  bool
 	queue   []parser.PieceBlock
+
+	// Have holds the pieces the peer told us it has
+	Have map[uint32]bool
+	// HaveAll is set when the peer has every piece
+	HaveAll bool
+
+	// Fast is set when both ends advertised the Fast Extension (BEP 6)
+	Fast bool
+	// AllowedFast holds pieces the peer lets us request while it chokes us
+	AllowedFast map[uint32]bool
+
+	// Pending holds our requests to the peer that are not answered yet
+	Pending []parser.PieceBlock
+	// Rejected holds our requests the peer rejected, they are not sent again until it unchokes us
+	Rejected []parser.PieceBlock
+	// LastMessage is the time the peer last sent anything
+	LastMessage time.Time
+	// LastPiece is the time the peer last sent piece data, or unchoked us
+	LastPiece time.Time
+	// Snubbed is set when the peer stopped answering our requests
+	Snubbed bool
 }
 
 // NewQueue returns a fresh pointer to a Queue object
 func NewQueue(torrent parser.TorrentFile) (queue *Queue) {
-	queue = &Queue{torrent, true, make([]parser.PieceBlock, 0)}
+	queue = &Queue{
+		torrent:     torrent,
+		Choked:      true,
+		queue:       make([]parser.PieceBlock, 0),
+		Have:        make(map[uint32]bool),
+		AllowedFast: make(map[uint32]bool),
+	}
 	return
 }
 
+// Has tells if the peer has the piece
+func (queue *Queue) Has(pieceIndex uint32) bool {
+	return queue.HaveAll || queue.Have[pieceIndex]
+}
+
 // Enqueue adds a piece to queue
 func (queue *Queue) Enqueue(pieceIndex uint32) (err error) {
 	nBlocks, err := parser.BlocksPerPiece(queue.torrent, pieceIndex)
@@ -44,6 +78,47 @@ func (queue *Queue) Enqueue(pieceIndex uint32) (err error) {
 	return
 }
 
+// EnqueueFront adds the blocks of a piece to the front of the queue.
+// Used for pieces the peer suggests to us
+func (queue *Queue) EnqueueFront(pieceIndex uint32) (err error) {
+	rest := queue.queue
+	queue.queue = make([]parser.PieceBlock, 0, len(rest))
+	err = queue.Enqueue(pieceIndex)
+	queue.queue = append(queue.queue, rest...)
+	return
+}
+
+// DequeueWhere removes and returns the first block accepted by accept
+func (queue *Queue) DequeueWhere(accept func(parser.PieceBlock) bool) (block parser.PieceBlock, err error) {
+	for i, b := range queue.queue {
+		if accept(b) {
+			block = b
+			queue.queue = append(queue.queue[:i], queue.queue[i+1:]...)
+			return
+		}
+	}
+	err = fmt.Errorf("Queue has no block that can be requested")
+	return
+}
+
+// DequeueLowest removes and returns the block of the lowest piece accepted by accept.
+// Used to download pieces in order
+func (queue *Queue) DequeueLowest(accept func(parser.PieceBlock) bool) (block parser.PieceBlock, err error) {
+	lowest := -1
+	for i, b := range queue.queue {
+		if (lowest < 0 || b.Index < queue.queue[lowest].Index) && accept(b) {
+			lowest = i
+		}
+	}
+	if lowest < 0 {
+		err = fmt.Errorf("Queue has no block that can be requested")
+		return
+	}
+	block = queue.queue[lowest]
+	queue.queue = append(queue.queue[:lowest], queue.queue[lowest+1:]...)
+	return
+}
+
 // Dequeue removes first piece block
 func (queue *Queue) Dequeue() error {
 	if queue.Length() == 0 {
@@ -61,3 +61,28 @@ func TestQueue(t *testing.T) {
 
 	fmt.Println("PASS")
 }
+
+func TestDequeueLowest(t *testing.T) {
+	queue := NewQueue(getTorrentFile())
+	for _, index := range []uint32{5, 2, 7, 3} {
+		queue.Enqueue(index)
+	}
+	block, err := queue.DequeueLowest(func(b parser.PieceBlock) bool { return b.Index != 2 })
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), block.Index)
+	assert.Equal(t, uint32(0), block.Begin)
+
+	_, err = queue.DequeueLowest(func(b parser.PieceBlock) bool { return false })
+	assert.NotNil(t, err)
+}
+
+// TestHas checks the pieces a queue tells its peer has
+func TestHas(t *testing.T) {
+	queue := NewQueue(parser.TorrentFile{})
+	assert.False(t, queue.Has(3))
+	queue.Have[3] = true
+	assert.True(t, queue.Has(3))
+	assert.False(t, queue.Has(4))
+	queue.HaveAll = true
+	assert.True(t, queue.Has(4))
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket allowing rate bytes per second, with bursts of up to one second.
+// A rate of 0 or less is unlimited. It can be used by many goroutines at once
+type Limiter struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of rate bytes per second
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// SetRate changes the rate of the limiter, it applies to the next calls of Wait
+func (limiter *Limiter) SetRate(rate int64) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.refill(time.Now())
+	limiter.rate = rate
+	if limiter.tokens > float64(rate) {
+		limiter.tokens = float64(rate)
+	}
+}
+
+// Rate returns the rate of the limiter in bytes per second
+func (limiter *Limiter) Rate() int64 {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.rate
+}
+
+// refill adds the tokens earned since the last call. The caller must hold lock
+func (limiter *Limiter) refill(now time.Time) {
+	if limiter.rate > 0 {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * float64(limiter.rate)
+		if limiter.tokens > float64(limiter.rate) {
+			limiter.tokens = float64(limiter.rate)
+		}
+	}
+	limiter.last = now
+}
+
+// Reserve takes n bytes from the limiter and returns how long to wait before using them.
+// Tokens may go below zero, so that n can be larger than a burst
+func (limiter *Limiter) Reserve(n int) time.Duration {
+	if limiter == nil || n <= 0 {
+		return 0
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if limiter.rate <= 0 {
+		return 0
+	}
+	limiter.refill(time.Now())
+	limiter.tokens -= float64(n)
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / float64(limiter.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes are allowed by every limiter, nil limiters are unlimited
+func Wait(n int, limiters ...*Limiter) {
+	var wait time.Duration
+	for _, limiter := range limiters {
+		if d := limiter.Reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,31 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReserve(t *testing.T) {
+	limiter := NewLimiter(1000)
+	// a full bucket allows a burst of one second
+	assert.Equal(t, time.Duration(0), limiter.Reserve(1000))
+	wait := limiter.Reserve(500)
+	assert.True(t, wait > 400*time.Millisecond && wait <= 500*time.Millisecond, wait)
+
+	limiter.SetRate(0)
+	assert.Equal(t, int64(0), limiter.Rate())
+	assert.Equal(t, time.Duration(0), limiter.Reserve(1<<20))
+
+	var unlimited *Limiter
+	assert.Equal(t, time.Duration(0), unlimited.Reserve(1<<20))
+}
+
+func TestWait(t *testing.T) {
+	fast, slow := NewLimiter(1<<20), NewLimiter(1000)
+	start := time.Now()
+	Wait(1200, fast, slow, nil)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 150*time.Millisecond && elapsed < time.Second, elapsed)
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule gives the rates between two times of the day. The rule goes over midnight if End is before Start
+type Rule struct {
+	// Start and End are the times since midnight
+	Start    time.Duration
+	End      time.Duration
+	Download int64
+	Upload   int64
+}
+
+// Schedule is a list of rules, the first rule covering a time applies
+type Schedule []Rule
+
+// ParseRule parses a rule written as HH:MM-HH:MM=download:upload, with the rates in KiB per second
+func ParseRule(text string) (rule Rule, err error) {
+	parts := strings.SplitN(text, "=", 2)
+	times := strings.SplitN(parts[0], "-", 2)
+	if len(parts) != 2 || len(times) != 2 {
+		return rule, fmt.Errorf("Rule must look like HH:MM-HH:MM=download:upload, got %q", text)
+	}
+	if rule.Start, err = parseTimeOfDay(times[0]); err != nil {
+		return
+	}
+	if rule.End, err = parseTimeOfDay(times[1]); err != nil {
+		return
+	}
+	rates := strings.SplitN(parts[1], ":", 2)
+	if len(rates) != 2 {
+		return rule, fmt.Errorf("Rates must look like download:upload, got %q", parts[1])
+	}
+	if rule.Download, err = strconv.ParseInt(rates[0], 10, 64); err != nil {
+		return
+	}
+	if rule.Upload, err = strconv.ParseInt(rates[1], 10, 64); err != nil {
+		return
+	}
+	rule.Download <<= 10
+	rule.Upload <<= 10
+	return
+}
+
+// parseTimeOfDay parses HH:MM as the time since midnight
+func parseTimeOfDay(text string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q", text)
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+// covers tells if the rule applies at a time of the day
+func (rule Rule) covers(timeOfDay time.Duration) bool {
+	if rule.Start <= rule.End {
+		return rule.Start <= timeOfDay && timeOfDay < rule.End
+	}
+	return timeOfDay >= rule.Start || timeOfDay < rule.End
+}
+
+// Rates returns the rates of the first rule covering now, in local time, or download and upload if none does
+func (schedule Schedule) Rates(now time.Time, download int64, upload int64) (int64, int64) {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, rule := range schedule {
+		if rule.covers(now.Sub(midnight)) {
+			return rule.Download, rule.Upload
+		}
+	}
+	return download, upload
+}
@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("09:00-17:30=512:128")
+	assert.Nil(t, err)
+	assert.Equal(t, Rule{9 * time.Hour, 17*time.Hour + 30*time.Minute, 512 << 10, 128 << 10}, rule)
+
+	for _, text := range []string{"09:00-17:00", "09:00=1:1", "9-17=1:1", "09:00-17:00=1", "09:00-17:00=a:1"} {
+		_, err = ParseRule(text)
+		assert.NotNil(t, err, text)
+	}
+}
+
+func TestScheduleRates(t *testing.T) {
+	day := func(hour int) time.Time { return time.Date(2020, 1, 1, hour, 0, 0, 0, time.Local) }
+	schedule := Schedule{
+		{Start: 9 * time.Hour, End: 17 * time.Hour, Download: 100, Upload: 10},
+		{Start: 22 * time.Hour, End: 6 * time.Hour, Download: 0, Upload: 0},
+	}
+	download, upload := schedule.Rates(day(12), 50, 5)
+	assert.Equal(t, []int64{100, 10}, []int64{download, upload})
+	download, upload = schedule.Rates(day(17), 50, 5)
+	assert.Equal(t, []int64{50, 5}, []int64{download, upload})
+	// the second rule goes over midnight
+	download, upload = schedule.Rates(day(3), 50, 5)
+	assert.Equal(t, []int64{0, 0}, []int64{download, upload})
+	download, upload = schedule.Rates(day(23), 50, 5)
+	assert.Equal(t, []int64{0, 0}, []int64{download, upload})
+}
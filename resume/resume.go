@@ -0,0 +1,126 @@
+package resume
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/concurrency-8/parser"
+)
+
+// Version of the resume file format
+const Version = 1
+
+// FileState records a file of the torrent as it was when the resume file was written
+type FileState struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// Settings are the per torrent settings restored on resume
+type Settings struct {
+	Storage string `json:"storage"`
+	// Priorities of the files, by index, that do not have normal priority
+	Priorities map[int]string `json:"priorities,omitempty"`
+}
+
+// State is the content of a resume file
+type State struct {
+	Version  int         `json:"version"`
+	InfoHash []byte      `json:"info_hash"`
+	Bitfield []byte      `json:"bitfield"`
+	Files    []FileState `json:"files"`
+	Settings Settings    `json:"settings"`
+}
+
+// Snapshot records the pieces we have and the current state of the files of the torrent
+func Snapshot(torrent parser.TorrentFile, bitfield []byte, settings Settings) (state State, err error) {
+	state = State{Version: Version, InfoHash: []byte(torrent.InfoHash), Bitfield: bitfield, Settings: settings}
+	for _, file := range torrent.Files {
+		fileState := FileState{Path: filepath.Join(file.Path...)}
+		if file.FilePointer != nil {
+			info, err := os.Stat(file.FilePointer.Name())
+			if err != nil {
+				return state, err
+			}
+			fileState.Size = info.Size()
+			fileState.ModTime = info.ModTime().UnixNano()
+		}
+		state.Files = append(state.Files, fileState)
+	}
+	return
+}
+
+// Save writes the state to path atomically. A crash leaves either the old or the new file
+func Save(path string, state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = temp.Write(data); err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// Load reads the state from path
+func Load(path string) (state State, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return
+	}
+	if state.Version != Version {
+		err = fmt.Errorf("Unsupported resume file version %d", state.Version)
+	}
+	return
+}
+
+// Validate checks the state against the torrent and its files on disk.
+// A non nil error means the state can not be trusted
+func (state State) Validate(torrent parser.TorrentFile) error {
+	if !bytes.Equal(state.InfoHash, []byte(torrent.InfoHash)) {
+		return fmt.Errorf("Resume file is for another torrent")
+	}
+	numPieces := len(torrent.Piece) / 20
+	if len(state.Bitfield) != (numPieces+7)/8 {
+		return fmt.Errorf("Resume file has %d bytes of bitfield, expected %d", len(state.Bitfield), (numPieces+7)/8)
+	}
+	current, err := Snapshot(torrent, nil, state.Settings)
+	if err != nil {
+		return err
+	}
+	if len(current.Files) != len(state.Files) {
+		return fmt.Errorf("Resume file has %d files, torrent has %d", len(state.Files), len(current.Files))
+	}
+	for i, file := range current.Files {
+		saved := state.Files[i]
+		if file.Path != saved.Path || file.Size != saved.Size || file.ModTime != saved.ModTime {
+			return fmt.Errorf("File %s changed since %v", file.Path, time.Unix(0, saved.ModTime))
+		}
+	}
+	return nil
+}
+
+// Has tells if the piece is set in the bitfield of the state
+func (state State) Has(index uint32) bool {
+	return int(index/8) < len(state.Bitfield) && state.Bitfield[index/8]&(0x80>>(index%8)) != 0
+}
@@ -0,0 +1,83 @@
+package resume
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// getTorrent returns a torrent of two files in a temporary directory
+func getTorrent(t *testing.T) (torrent parser.TorrentFile, dir string) {
+	dir, err := ioutil.TempDir("", "resume")
+	assert.Nil(t, err)
+	torrent.InfoHash = "01234567890123456789"
+	torrent.Piece = make([]byte, 10*20)
+	for _, name := range []string{"a", "b"} {
+		file, err := os.Create(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		file.Write([]byte(name))
+		torrent.Files = append(torrent.Files, &parser.File{Path: []string{name}, Length: 1, FilePointer: file})
+	}
+	return
+}
+
+func TestSaveLoad(t *testing.T) {
+	torrent, dir := getTorrent(t)
+	defer os.RemoveAll(dir)
+
+	state, err := Snapshot(torrent, []byte{0xA0, 0x40}, Settings{Storage: "file"})
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "resume.json")
+	assert.Nil(t, Save(path, state))
+
+	loaded, err := Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, state, loaded)
+	assert.Nil(t, loaded.Validate(torrent))
+	assert.True(t, loaded.Has(0))
+	assert.False(t, loaded.Has(1))
+	assert.True(t, loaded.Has(2))
+	assert.True(t, loaded.Has(9))
+
+	// No temporary files are left behind
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 3)
+}
+
+func TestLoadVersion(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resume")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resume.json")
+	ioutil.WriteFile(path, []byte(`{"version": 99}`), 0600)
+	_, err := Load(path)
+	assert.NotNil(t, err)
+
+	ioutil.WriteFile(path, []byte(`{"version": 1, "bitf`), 0600)
+	_, err = Load(path)
+	assert.NotNil(t, err, "Truncated resume file accepted")
+}
+
+func TestValidate(t *testing.T) {
+	torrent, dir := getTorrent(t)
+	defer os.RemoveAll(dir)
+	state, err := Snapshot(torrent, []byte{0xFF, 0xC0}, Settings{})
+	assert.Nil(t, err)
+
+	other := torrent
+	other.InfoHash = "98765432109876543210"
+	assert.NotNil(t, state.Validate(other), "Other torrent accepted")
+
+	short := state
+	short.Bitfield = []byte{0xFF}
+	assert.NotNil(t, short.Validate(torrent), "Short bitfield accepted")
+
+	// A file written after the snapshot
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(torrent.Files[1].FilePointer.Name(), later, later)
+	assert.NotNil(t, state.Validate(torrent), "Modified file accepted")
+}
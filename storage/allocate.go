@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/concurrency-8/parser"
+)
+
+// Allocation selects how the files of a torrent are allocated on disk before downloading
+type Allocation int
+
+const (
+	// None leaves files empty, they grow as pieces are written
+	None Allocation = iota
+	// Sparse sets files to their full size without allocating disk space
+	Sparse
+	// Full allocates the disk space of the files before downloading
+	Full
+)
+
+var allocationNames = []string{"none", "sparse", "full"}
+
+func (allocation Allocation) String() string {
+	if allocation < 0 || int(allocation) >= len(allocationNames) {
+		return fmt.Sprintf("Allocation(%d)", int(allocation))
+	}
+	return allocationNames[allocation]
+}
+
+// ParseAllocation parses the name of an allocation mode
+func ParseAllocation(name string) (Allocation, error) {
+	for i, allocationName := range allocationNames {
+		if name == allocationName {
+			return Allocation(i), nil
+		}
+	}
+	return None, fmt.Errorf("Unknown allocation %q", name)
+}
+
+// ErrUnsupported is returned by FreeSpace where free space can not be found
+var ErrUnsupported = fmt.Errorf("Not supported on this system")
+
+// ErrNoSpace is wrapped by the error of CheckFreeSpace when the disk is too small for the torrent
+var ErrNoSpace = fmt.Errorf("Not enough free space")
+
+// Missing returns the number of bytes the opened files of the torrent still have to grow by
+func Missing(torrent parser.TorrentFile) (missing uint64, err error) {
+	for _, file := range torrent.Files {
+		if file.FilePointer == nil {
+			continue
+		}
+		info, err := file.FilePointer.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if size := uint64(info.Size()); size < file.Length {
+			missing += file.Length - size
+		}
+	}
+	return
+}
+
+// Dir returns the folder holding the opened files of the torrent
+func Dir(torrent parser.TorrentFile) string {
+	for _, file := range torrent.Files {
+		if file.FilePointer != nil {
+			return filepath.Dir(file.FilePointer.Name())
+		}
+	}
+	return torrent.Name
+}
+
+// CheckFreeSpace fails if the disk holding the torrent does not have room for the rest of its files
+func CheckFreeSpace(torrent parser.TorrentFile) error {
+	missing, err := Missing(torrent)
+	if err != nil || missing == 0 {
+		return err
+	}
+	dir := Dir(torrent)
+	free, err := FreeSpace(dir)
+	if err == ErrUnsupported {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if missing > free {
+		return fmt.Errorf("%w in %s: %d bytes needed, %d bytes free", ErrNoSpace, dir, missing, free)
+	}
+	return nil
+}
+
+// Allocate allocates the opened files of the torrent
+func Allocate(torrent parser.TorrentFile, allocation Allocation) error {
+	for _, file := range torrent.Files {
+		if file.FilePointer == nil || allocation == None {
+			continue
+		}
+		info, err := file.FilePointer.Stat()
+		if err != nil {
+			return err
+		}
+		if uint64(info.Size()) >= file.Length {
+			continue
+		}
+		if allocation == Full {
+			err = fallocate(file.FilePointer, info.Size(), int64(file.Length))
+		} else {
+			err = file.FilePointer.Truncate(int64(file.Length))
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to allocate %s: %v", file.FilePointer.Name(), err)
+		}
+	}
+	return nil
+}
+
+// zeroFill allocates a file by writing zeros from size to length
+func zeroFill(file *os.File, size int64, length int64) error {
+	zeros := make([]byte, 1<<16)
+	for size < length {
+		chunk := int64(len(zeros))
+		if length-size < chunk {
+			chunk = length - size
+		}
+		written, err := file.WriteAt(zeros[:chunk], size)
+		if err != nil {
+			return err
+		}
+		size += int64(written)
+	}
+	return nil
+}
+
+// IsDiskFull tells if a write failed because the disk is full
+func IsDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate allocates the disk space of the file up to length
+func fallocate(file *os.File, size int64, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP {
+		// not every filesystem supports fallocate
+		return zeroFill(file, size, length)
+	}
+	return err
+}
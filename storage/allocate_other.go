@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+// fallocate allocates the disk space of the file up to length by writing zeros
+func fallocate(file *os.File, size int64, length int64) error {
+	return zeroFill(file, size, length)
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAllocation(t *testing.T) {
+	for _, allocation := range []Allocation{None, Sparse, Full} {
+		parsed, err := ParseAllocation(allocation.String())
+		assert.Nil(t, err)
+		assert.Equal(t, allocation, parsed)
+	}
+	_, err := ParseAllocation("lazy")
+	assert.NotNil(t, err)
+}
+
+func TestAllocate(t *testing.T) {
+	for _, allocation := range []Allocation{None, Sparse, Full} {
+		torrent, dir := getTorrent(t)
+		missing, err := Missing(torrent)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(64), missing)
+
+		assert.Nil(t, Allocate(torrent, allocation), allocation.String())
+		for _, file := range torrent.Files {
+			info, err := file.FilePointer.Stat()
+			assert.Nil(t, err)
+			if allocation == None {
+				assert.Equal(t, int64(0), info.Size())
+			} else {
+				assert.Equal(t, int64(file.Length), info.Size(), allocation.String())
+			}
+		}
+		assert.Nil(t, CheckFreeSpace(torrent))
+		NewFiles(torrent).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	torrent, dir := getTorrent(t)
+	defer os.RemoveAll(dir)
+	defer NewFiles(torrent).Close()
+	if _, err := FreeSpace(dir); err == ErrUnsupported {
+		t.Skip(err)
+	}
+	torrent.Files[1].Length = 1 << 62
+	assert.True(t, errors.Is(CheckFreeSpace(torrent), ErrNoSpace))
+}
+
+func TestIsDiskFull(t *testing.T) {
+	assert.True(t, IsDiskFull(&os.PathError{Op: "write", Path: "a", Err: syscall.ENOSPC}))
+	assert.False(t, IsDiskFull(os.ErrClosed))
+}
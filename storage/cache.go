@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/concurrency-8/parser"
+)
+
+// DiskWorkers is the number of goroutines writing cached pieces to disk
+var DiskWorkers = 4
+
+// Flusher is implemented by storage that holds writes back
+type Flusher interface {
+	Flush() error
+}
+
+// cacheEntry holds data of a piece starting at begin. A dirty entry is not written yet
+type cacheEntry struct {
+	piece   uint32
+	begin   uint32
+	data    []byte
+	dirty   bool
+	element *list.Element
+}
+
+// diskJob writes an entry, or completes a piece once its writes are done
+type diskJob struct {
+	entry    *cacheEntry
+	piece    uint32
+	complete bool
+}
+
+// Cache is a write-back cache in front of storage on disk. Writes return at once and are written
+// by DiskWorkers goroutines, reads of cached pieces, as when seeding, do not reach the disk.
+// The jobs of a piece always go to the same worker, so they are done in order
+type Cache struct {
+	torrent parser.TorrentFile
+	backend Storage
+	size    int64
+
+	lock    sync.Mutex
+	changed *sync.Cond
+	entries map[uint32]*cacheEntry
+	// lru orders the entries, least recently used first
+	lru     *list.List
+	used    int64
+	dirty   int64
+	pending int
+	// err is the last write error, failed jobs are kept until Retry
+	err    error
+	failed []diskJob
+	closed bool
+
+	workers []chan diskJob
+	done    sync.WaitGroup
+}
+
+// NewCache returns a cache of size bytes in front of backend, written by DiskWorkers goroutines
+func NewCache(torrent parser.TorrentFile, backend Storage, size int64) *Cache {
+	return NewCacheWorkers(torrent, backend, size, DiskWorkers)
+}
+
+// NewCacheWorkers returns a cache of size bytes in front of backend, written by workers goroutines
+func NewCacheWorkers(torrent parser.TorrentFile, backend Storage, size int64, workers int) *Cache {
+	c := &Cache{
+		torrent: torrent,
+		backend: backend,
+		size:    size,
+		entries: make(map[uint32]*cacheEntry),
+		lru:     list.New(),
+	}
+	c.changed = sync.NewCond(&c.lock)
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		jobs := make(chan diskJob, 64)
+		c.workers = append(c.workers, jobs)
+		c.done.Add(1)
+		go c.work(jobs)
+	}
+	return c
+}
+
+// work runs the jobs of a worker until its channel is closed
+func (c *Cache) work(jobs chan diskJob) {
+	defer c.done.Done()
+	for job := range jobs {
+		if job.complete && c.failedPiece(job.piece) {
+			// the piece is completed once its failed writes are retried
+			c.lock.Lock()
+			c.failed = append(c.failed, job)
+			c.pending--
+			c.changed.Broadcast()
+			c.lock.Unlock()
+			continue
+		}
+		var err error
+		if job.complete {
+			err = c.backend.MarkComplete(job.piece)
+		} else {
+			_, err = c.backend.WriteAt(job.entry.data, job.entry.piece, job.entry.begin)
+		}
+		c.lock.Lock()
+		if err != nil {
+			c.err = err
+			c.failed = append(c.failed, job)
+		} else if !job.complete && c.entries[job.piece] == job.entry {
+			job.entry.dirty = false
+			c.dirty -= int64(len(job.entry.data))
+			c.evict()
+		}
+		c.pending--
+		c.changed.Broadcast()
+		c.lock.Unlock()
+	}
+}
+
+// failedPiece tells if a write of the piece failed
+func (c *Cache) failedPiece(piece uint32) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, job := range c.failed {
+		if job.piece == piece {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch queues a job. The caller must hold lock
+func (c *Cache) dispatch(job diskJob) {
+	c.pending++
+	jobs := c.workers[int(job.piece)%len(c.workers)]
+	// the channel may be full, do not hold the lock while waiting for a worker
+	c.lock.Unlock()
+	jobs <- job
+	c.lock.Lock()
+}
+
+// evict drops clean entries, least recently used first, until the cache fits its size.
+// The caller must hold lock
+func (c *Cache) evict() {
+	for element := c.lru.Front(); element != nil && c.used > c.size; {
+		next := element.Next()
+		if entry := element.Value.(*cacheEntry); !entry.dirty {
+			c.remove(entry)
+		}
+		element = next
+	}
+}
+
+// remove drops an entry. The caller must hold lock
+func (c *Cache) remove(entry *cacheEntry) {
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.piece)
+	c.used -= int64(len(entry.data))
+	if entry.dirty {
+		c.dirty -= int64(len(entry.data))
+	}
+}
+
+// insert adds an entry, replacing the entry of its piece. The caller must hold lock
+func (c *Cache) insert(entry *cacheEntry) {
+	if old, ok := c.entries[entry.piece]; ok {
+		c.remove(old)
+	}
+	entry.element = c.lru.PushBack(entry)
+	c.entries[entry.piece] = entry
+	c.used += int64(len(entry.data))
+	if entry.dirty {
+		c.dirty += int64(len(entry.data))
+	}
+	c.evict()
+}
+
+// WriteAt caches p and has it written in the background. It waits while the cache is full of
+// unwritten data, and fails once a background write failed until Retry is called
+func (c *Cache) WriteAt(p []byte, piece uint32, begin uint32) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		if c.closed {
+			return 0, errClosed
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		old, ok := c.entries[piece]
+		// one piece larger than the cache is still written
+		if (!ok || !old.dirty) && (c.dirty == 0 || c.dirty+int64(len(p)) <= c.size) {
+			break
+		}
+		c.changed.Wait()
+	}
+	entry := &cacheEntry{piece: piece, begin: begin, data: append([]byte(nil), p...), dirty: true}
+	c.insert(entry)
+	c.dispatch(diskJob{entry: entry, piece: piece})
+	return len(p), nil
+}
+
+// ReadAt reads from the cache. A miss inside a piece caches the whole piece for the next reads.
+// It waits while the piece has unwritten data, and fails if writing it failed
+func (c *Cache) ReadAt(p []byte, piece uint32, begin uint32) (n int, err error) {
+	c.lock.Lock()
+	if entry, ok := c.entries[piece]; ok && entry.begin <= begin && int(begin-entry.begin)+len(p) <= len(entry.data) {
+		c.lru.MoveToBack(entry.element)
+		n = copy(p, entry.data[begin-entry.begin:])
+		c.lock.Unlock()
+		return
+	}
+	// the disk must not be read under unwritten data of the piece
+	for entry, ok := c.entries[piece]; ok && entry.dirty; entry, ok = c.entries[piece] {
+		if c.err != nil {
+			err = c.err
+			c.lock.Unlock()
+			return
+		}
+		c.changed.Wait()
+	}
+	c.lock.Unlock()
+
+	pieceLen, lenErr := parser.PieceLen(c.torrent, piece)
+	if lenErr != nil || int64(begin)+int64(len(p)) > int64(pieceLen) || int64(pieceLen) > c.size {
+		return c.backend.ReadAt(p, piece, begin)
+	}
+	data := make([]byte, pieceLen)
+	if _, err = c.backend.ReadAt(data, piece, 0); err != nil {
+		return c.backend.ReadAt(p, piece, begin)
+	}
+	n = copy(p, data[begin:])
+	c.lock.Lock()
+	if _, ok := c.entries[piece]; !ok && !c.closed {
+		c.insert(&cacheEntry{piece: piece, data: data})
+	}
+	c.lock.Unlock()
+	return
+}
+
+// MarkComplete completes the piece on disk once its writes are done
+func (c *Cache) MarkComplete(piece uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.dispatch(diskJob{piece: piece, complete: true})
+	return nil
+}
+
+// Flush waits until everything cached is written, or a write fails
+func (c *Cache) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.pending > 0 {
+		c.changed.Wait()
+	}
+	return c.err
+}
+
+// Err returns the error of the last failed background write, nil if none failed since Retry
+func (c *Cache) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Retry queues the failed writes again, as when the disk has free space again
+func (c *Cache) Retry() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	failed := c.failed
+	c.failed, c.err = nil, nil
+	for _, job := range failed {
+		c.dispatch(job)
+	}
+}
+
+// Want creates a skipped file once the cache is written, see Selector
+func (c *Cache) Want(file int) error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if selector, ok := c.backend.(Selector); ok {
+		return selector.Want(file)
+	}
+	return nil
+}
+
+// Move moves a file once the cache is written, see Mover
+func (c *Cache) Move(file int, path string) error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if mover, ok := c.backend.(Mover); ok {
+		return mover.Move(file, path)
+	}
+	return nil
+}
+
+// Close writes everything cached and closes the storage behind the cache
+func (c *Cache) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.changed.Broadcast()
+	for c.pending > 0 {
+		c.changed.Wait()
+	}
+	err := c.err
+	c.lock.Unlock()
+	for _, jobs := range c.workers {
+		close(jobs)
+	}
+	c.done.Wait()
+	if closeErr := c.backend.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
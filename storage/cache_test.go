@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingStorage records the order of writes and completions, and fails writes while full is set
+type recordingStorage struct {
+	Storage
+	lock  sync.Mutex
+	full  bool
+	calls []string
+	// gate, when set, holds every write until it is closed
+	gate chan struct{}
+}
+
+func (s *recordingStorage) WriteAt(p []byte, piece uint32, begin uint32) (int, error) {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.full {
+		return 0, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+	}
+	s.calls = append(s.calls, "write")
+	return s.Storage.WriteAt(p, piece, begin)
+}
+
+func (s *recordingStorage) MarkComplete(piece uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls = append(s.calls, "complete")
+	return s.Storage.MarkComplete(piece)
+}
+
+func TestCache(t *testing.T) {
+	torrent, dir := getTorrent(t)
+	defer os.RemoveAll(dir)
+	backend := &recordingStorage{Storage: NewFiles(torrent)}
+	cache := NewCache(torrent, backend, 64)
+
+	data := bytes.Repeat([]byte{5}, 16)
+	_, err := cache.WriteAt(data, 1, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.MarkComplete(1))
+	assert.Nil(t, cache.Flush())
+	assert.Equal(t, []string{"write", "complete"}, backend.calls)
+
+	// Reads are served from the cache
+	backend.Storage.WriteAt(make([]byte, 16), 1, 0)
+	read := make([]byte, 8)
+	_, err = cache.ReadAt(read, 1, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, data[8:], read)
+
+	// A miss caches the piece
+	backend.Storage.WriteAt(data, 2, 0)
+	_, err = cache.ReadAt(read, 2, 0)
+	assert.Nil(t, err)
+	backend.Storage.WriteAt(make([]byte, 16), 2, 0)
+	_, err = cache.ReadAt(read, 2, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:8], read)
+
+	assert.Nil(t, cache.Close())
+	assert.Nil(t, cache.Close())
+	_, err = cache.WriteAt(data, 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestCacheDiskFull(t *testing.T) {
+	torrent, dir := getTorrent(t)
+	defer os.RemoveAll(dir)
+	backend := &recordingStorage{Storage: NewFiles(torrent), full: true}
+	cache := NewCache(torrent, backend, 64)
+
+	data := bytes.Repeat([]byte{6}, 16)
+	_, err := cache.WriteAt(data, 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.MarkComplete(0))
+	assert.True(t, IsDiskFull(cache.Flush()))
+	_, err = cache.WriteAt(data, 1, 0)
+	assert.True(t, IsDiskFull(err))
+	assert.Empty(t, backend.calls)
+
+	// The piece is written, then completed, once there is room again
+	backend.lock.Lock()
+	backend.full = false
+	backend.lock.Unlock()
+	cache.Retry()
+	assert.Nil(t, cache.Flush())
+	assert.Equal(t, []string{"write", "complete"}, backend.calls)
+	assert.Nil(t, cache.Close())
+}
+
+func TestCacheFull(t *testing.T) {
+	torrent, dir := getTorrent(t)
+	defer os.RemoveAll(dir)
+	backend := &recordingStorage{Storage: NewFiles(torrent), gate: make(chan struct{})}
+	cache := NewCache(torrent, backend, 16)
+
+	_, err := cache.WriteAt(make([]byte, 16), 0, 0)
+	assert.Nil(t, err)
+	written := make(chan struct{})
+	go func() {
+		cache.WriteAt(make([]byte, 16), 1, 0)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Error("Write did not wait for the full cache")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(backend.gate)
+	<-written
+	assert.Nil(t, cache.Close())
+}
+
+// TestCacheReadDirty checks that a read only waits for unwritten data of its own piece
+func TestCacheReadDirty(t *testing.T) {
+	torrent, dir := getTorrent(t)
+	defer os.RemoveAll(dir)
+	backend := &recordingStorage{Storage: NewFiles(torrent), gate: make(chan struct{})}
+	cache := NewCache(torrent, backend, 64)
+
+	_, err := cache.WriteAt(bytes.Repeat([]byte{7}, 8), 0, 0)
+	assert.Nil(t, err)
+	read := make(chan error)
+	go func() {
+		_, err := cache.ReadAt(make([]byte, 8), 2, 0)
+		read <- err
+	}()
+	// the files are empty, the read ends with EOF
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Error("Read of a clean piece waited for another piece")
+	}
+	go func() {
+		_, err := cache.ReadAt(make([]byte, 8), 0, 8)
+		read <- err
+	}()
+	select {
+	case <-read:
+		t.Error("Read did not wait for unwritten data of its piece")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(backend.gate)
+	<-read
+	assert.Nil(t, cache.Close())
+}
+
+// TestCacheReadFailed checks that the disk is not read under data that could not be written
+func TestCacheReadFailed(t *testing.T) {
+	torrent, dir := getTorrent(t)
+	defer os.RemoveAll(dir)
+	backend := &recordingStorage{Storage: NewFiles(torrent), full: true}
+	cache := NewCache(torrent, backend, 64)
+
+	_, err := cache.WriteAt(bytes.Repeat([]byte{8}, 8), 1, 0)
+	assert.Nil(t, err)
+	assert.True(t, IsDiskFull(cache.Flush()))
+	_, err = cache.ReadAt(make([]byte, 8), 1, 8)
+	assert.True(t, IsDiskFull(err))
+
+	backend.lock.Lock()
+	backend.full = false
+	backend.lock.Unlock()
+	cache.Retry()
+	assert.Nil(t, cache.Close())
+}
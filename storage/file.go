@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/concurrency-8/parser"
+)
+
+// SideFile is the name of the file, in the download folder, that keeps data of pieces
+// overlapping skipped files. Without it such pieces could not be verified again
+var SideFile = ".parts"
+
+// Selector is implemented by storage that does not keep skipped files.
+// Want must be called before data of a skipped file is wanted again
+type Selector interface {
+	Want(file int) error
+}
+
+// sideChunk is the size of the reads copying a file out of the side file
+const sideChunk = 64 << 10
+
+// sideFile holds the data of skipped files at its position in the torrent
+type sideFile struct {
+	path string
+	lock sync.Mutex
+	file *os.File
+}
+
+func newSideFile(torrent parser.TorrentFile) *sideFile {
+	return &sideFile{path: filepath.Join(torrent.Dir, torrent.Name, SideFile)}
+}
+
+// open opens the side file. It is only created for writing
+func (side *sideFile) open(create bool) (*os.File, error) {
+	side.lock.Lock()
+	defer side.lock.Unlock()
+	if side.file != nil {
+		return side.file, nil
+	}
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(side.path, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	side.file = file
+	return file, nil
+}
+
+// copyTo copies length bytes of the side file at start into file, a chunk at a time.
+// The side file is sparse, only what was written to it is copied
+func (side *sideFile) copyTo(file *os.File, start int64, length int64) error {
+	from, err := side.open(false)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	chunk := make([]byte, sideChunk)
+	for done := int64(0); done < length; {
+		if length-done < int64(len(chunk)) {
+			chunk = chunk[:length-done]
+		}
+		read, err := from.ReadAt(chunk, start+done)
+		if read > 0 {
+			if _, writeErr := file.WriteAt(chunk[:read], done); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		done += int64(read)
+	}
+	return nil
+}
+
+func (side *sideFile) close() {
+	side.lock.Lock()
+	defer side.lock.Unlock()
+	if side.file != nil {
+		side.file.Close()
+		side.file = nil
+	}
+}
+
+// fileStart returns the position of a file of the torrent
+func fileStart(torrent parser.TorrentFile, index int) (start int64) {
+	for _, f := range torrent.Files[:index] {
+		start += int64(f.Length)
+	}
+	return
+}
+
+// fileStorage writes into the files opened by the parser. Files without FilePointer are skipped,
+// their data goes to the side file at its position in the torrent
+type fileStorage struct {
+	torrent   parser.TorrentFile
+	side      *sideFile
+	lock      sync.RWMutex
+	closeOnce sync.Once
+}
+
+// NewFiles returns storage backed by the files of the torrent
+func NewFiles(torrent parser.TorrentFile) Storage {
+	return &fileStorage{torrent: torrent, side: newSideFile(torrent)}
+}
+
+// spanFile returns the file holding the span and the position of the span in it
+func (s *fileStorage) spanFile(span Span, position int64, create bool) (*os.File, int64, error) {
+	if file := s.torrent.Files[span.File].FilePointer; file != nil {
+		return file, span.Offset, nil
+	}
+	side, err := s.side.open(create)
+	return side, position, err
+}
+
+func (s *fileStorage) ReadAt(p []byte, piece uint32, begin uint32) (n int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	position := offset(s.torrent, piece, begin)
+	for _, span := range FileSpans(s.torrent, position, int64(len(p))) {
+		file, at, err := s.spanFile(span, position+int64(n), false)
+		if err != nil {
+			return n, err
+		}
+		read, err := file.ReadAt(p[n:n+int(span.Length)], at)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (s *fileStorage) WriteAt(p []byte, piece uint32, begin uint32) (n int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	position := offset(s.torrent, piece, begin)
+	for _, span := range FileSpans(s.torrent, position, int64(len(p))) {
+		file, at, err := s.spanFile(span, position+int64(n), true)
+		if err != nil {
+			return n, err
+		}
+		written, err := file.WriteAt(p[n:n+int(span.Length)], at)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+// MarkComplete flushes the files holding the piece to disk
+func (s *fileStorage) MarkComplete(piece uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, span := range PieceSpans(s.torrent, piece) {
+		file, _, err := s.spanFile(span, 0, false)
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Want creates a skipped file and moves its data from the side file into it
+func (s *fileStorage) Want(index int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file := s.torrent.Files[index]
+	if file.FilePointer != nil {
+		return nil
+	}
+	created, err := os.OpenFile(file.DiskPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	file.FilePointer = created
+	return s.side.copyTo(created, fileStart(s.torrent, index), int64(file.Length))
+}
+
+// Move moves a file of the torrent to path. A skipped file is created at path once wanted
+func (s *fileStorage) Move(index int, path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file := s.torrent.Files[index]
+	if file.FilePointer == nil || file.DiskPath == path {
+		file.DiskPath = path
+		return nil
+	}
+	if err := file.FilePointer.Close(); err != nil {
+		return err
+	}
+	moveErr := moveFile(file.DiskPath, path)
+	if moveErr == nil {
+		file.DiskPath = path
+	}
+	reopened, err := os.OpenFile(file.DiskPath, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	file.FilePointer = reopened
+	return moveErr
+}
+
+func (s *fileStorage) Close() (err error) {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for _, file := range s.torrent.Files {
+			if file.FilePointer == nil {
+				continue
+			}
+			if closeErr := file.FilePointer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+		s.side.close()
+	})
+	return
+}
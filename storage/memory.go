@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"io"
+	"sync"
+
+	"github.com/concurrency-8/parser"
+)
+
+// memoryStorage keeps the whole torrent in one buffer
+type memoryStorage struct {
+	torrent parser.TorrentFile
+	data    []byte
+	lock    sync.RWMutex
+}
+
+// NewMemory returns storage that keeps the torrent in memory. Nothing is written to disk
+func NewMemory(torrent parser.TorrentFile) Storage {
+	return &memoryStorage{torrent: torrent, data: make([]byte, torrent.Length)}
+}
+
+func (s *memoryStorage) ReadAt(p []byte, piece uint32, begin uint32) (n int, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	position := offset(s.torrent, piece, begin)
+	if position >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, s.data[position:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (s *memoryStorage) WriteAt(p []byte, piece uint32, begin uint32) (n int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	position := offset(s.torrent, piece, begin)
+	if position < int64(len(s.data)) {
+		n = copy(s.data[position:], p)
+	}
+	if n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+func (s *memoryStorage) MarkComplete(piece uint32) error {
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
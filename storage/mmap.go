@@ -0,0 +1,227 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/concurrency-8/parser"
+)
+
+var errSkipped = fmt.Errorf("File is skipped")
+
+// mmapStorage maps every file of the torrent into memory. Skipped files, without FilePointer,
+// are not mapped, their data goes to the side file at its position in the torrent until Want
+type mmapStorage struct {
+	torrent parser.TorrentFile
+	maps    [][]byte
+	side    *sideFile
+	closed  bool
+	lock    sync.RWMutex
+}
+
+// NewMMap returns storage backed by memory mapped files of the torrent
+func NewMMap(torrent parser.TorrentFile) (Storage, error) {
+	s := &mmapStorage{torrent: torrent, maps: make([][]byte, len(torrent.Files)), side: newSideFile(torrent)}
+	for i, file := range torrent.Files {
+		if file.Length == 0 || file.FilePointer == nil {
+			continue
+		}
+		data, err := mapFile(file)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.maps[i] = data
+	}
+	return s, nil
+}
+
+// mapFile maps a file of the torrent into memory
+func mapFile(file *parser.File) ([]byte, error) {
+	// a file can only be mapped up to its size
+	if err := file.FilePointer.Truncate(int64(file.Length)); err != nil {
+		return nil, err
+	}
+	return syscall.Mmap(int(file.FilePointer.Fd()), 0, int(file.Length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func (s *mmapStorage) ReadAt(p []byte, piece uint32, begin uint32) (n int, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return 0, errClosed
+	}
+	position := offset(s.torrent, piece, begin)
+	for _, span := range FileSpans(s.torrent, position, int64(len(p))) {
+		if s.maps[span.File] == nil {
+			side, err := s.side.open(false)
+			if os.IsNotExist(err) {
+				return n, errSkipped
+			} else if err != nil {
+				return n, err
+			}
+			read, err := side.ReadAt(p[n:n+int(span.Length)], position+int64(n))
+			n += read
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		n += copy(p[n:n+int(span.Length)], s.maps[span.File][span.Offset:])
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (s *mmapStorage) WriteAt(p []byte, piece uint32, begin uint32) (n int, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return 0, errClosed
+	}
+	position := offset(s.torrent, piece, begin)
+	for _, span := range FileSpans(s.torrent, position, int64(len(p))) {
+		if s.maps[span.File] == nil {
+			side, err := s.side.open(true)
+			if err != nil {
+				return n, err
+			}
+			written, err := side.WriteAt(p[n:n+int(span.Length)], position+int64(n))
+			n += written
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		n += copy(s.maps[span.File][span.Offset:], p[n:n+int(span.Length)])
+	}
+	if n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+// MarkComplete flushes the mappings holding the piece to disk
+func (s *mmapStorage) MarkComplete(piece uint32) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, span := range PieceSpans(s.torrent, piece) {
+		if s.maps[span.File] != nil {
+			if err := msync(s.maps[span.File]); err != nil {
+				return err
+			}
+			continue
+		}
+		side, err := s.side.open(false)
+		if err == nil {
+			err = side.Sync()
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Want creates a skipped file, moves its data from the side file into it and maps it
+func (s *mmapStorage) Want(index int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errClosed
+	}
+	file := s.torrent.Files[index]
+	if file.FilePointer != nil {
+		return nil
+	}
+	created, err := os.OpenFile(file.DiskPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	file.FilePointer = created
+	if err = s.side.copyTo(created, fileStart(s.torrent, index), int64(file.Length)); err != nil {
+		return err
+	}
+	if file.Length > 0 {
+		s.maps[index], err = mapFile(file)
+	}
+	return err
+}
+
+// Move moves a file of the torrent to path and maps it again
+func (s *mmapStorage) Move(index int, path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errClosed
+	}
+	file := s.torrent.Files[index]
+	if file.FilePointer == nil || file.DiskPath == path {
+		file.DiskPath = path
+		return nil
+	}
+	if data := s.maps[index]; data != nil {
+		if err := msync(data); err != nil {
+			return err
+		}
+		if err := syscall.Munmap(data); err != nil {
+			return err
+		}
+		s.maps[index] = nil
+	}
+	if err := file.FilePointer.Close(); err != nil {
+		return err
+	}
+	moveErr := moveFile(file.DiskPath, path)
+	if moveErr == nil {
+		file.DiskPath = path
+	}
+	reopened, err := os.OpenFile(file.DiskPath, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	file.FilePointer = reopened
+	if file.Length > 0 {
+		if s.maps[index], err = mapFile(file); err != nil {
+			return err
+		}
+	}
+	return moveErr
+}
+
+func (s *mmapStorage) Close() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for i, data := range s.maps {
+		if data == nil {
+			continue
+		}
+		if unmapErr := syscall.Munmap(data); unmapErr != nil && err == nil {
+			err = unmapErr
+		}
+		s.maps[i] = nil
+	}
+	s.side.close()
+	return
+}
+
+func msync(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/concurrency-8/parser"
+)
+
+// NewMMap is not supported on this platform
+func NewMMap(torrent parser.TorrentFile) (Storage, error) {
+	return nil, fmt.Errorf("mmap storage is not supported on this platform")
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Mover is implemented by storage that keeps files on disk. Move moves a file of the torrent to path,
+// the file is reopened there
+type Mover interface {
+	Move(file int, path string) error
+}
+
+// moveFile renames from to to. Across filesystems the file is copied next to to and renamed,
+// so that to never holds part of the file
+func moveFile(from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	temp := filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".moving")
+	if err = copyFile(from, temp); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if err = os.Rename(temp, to); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// copyFile copies from to to with its modification time, so that resume files still match it
+func copyFile(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	target, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(target, source); err == nil {
+		err = target.Sync()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
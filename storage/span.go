@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"github.com/concurrency-8/parser"
+)
+
+// Span is the part of a file covered by a range of the torrent
+type Span struct {
+	// File is the index of the file in the torrent
+	File int
+	// Offset is the position in the file
+	Offset int64
+	// Length is the number of bytes in the file
+	Length int64
+}
+
+// FileSpans splits length bytes of the torrent starting at position into per file spans.
+// Zero length files never hold data and are skipped. Bytes beyond the last file are left out
+func FileSpans(torrent parser.TorrentFile, position int64, length int64) (spans []Span) {
+	start := int64(0)
+	for i, file := range torrent.Files {
+		end := start + int64(file.Length)
+		if length <= 0 {
+			break
+		}
+		if position < end {
+			span := Span{File: i, Offset: position - start, Length: end - position}
+			if span.Length > length {
+				span.Length = length
+			}
+			spans = append(spans, span)
+			position += span.Length
+			length -= span.Length
+		}
+		start = end
+	}
+	return
+}
+
+// PieceSpans returns the per file spans of a whole piece
+func PieceSpans(torrent parser.TorrentFile, piece uint32) []Span {
+	length, err := parser.PieceLen(torrent, piece)
+	if err != nil {
+		return nil
+	}
+	return FileSpans(torrent, offset(torrent, piece, 0), int64(length))
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/concurrency-8/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// getLayout returns a torrent with files of the given lengths, without opening them
+func getLayout(pieceLength uint32, lengths ...uint64) (torrent parser.TorrentFile) {
+	torrent.PieceLength = pieceLength
+	for _, length := range lengths {
+		torrent.Files = append(torrent.Files, &parser.File{Length: length})
+		torrent.Length += length
+	}
+	numPieces := (torrent.Length + uint64(pieceLength) - 1) / uint64(pieceLength)
+	torrent.Piece = make([]byte, numPieces*20)
+	return
+}
+
+func TestFileSpans(t *testing.T) {
+	tests := []struct {
+		name     string
+		lengths  []uint64
+		position int64
+		length   int64
+		spans    []Span
+	}{
+		{"single file", []uint64{10}, 2, 5, []Span{{0, 2, 5}}},
+		{"inside second file", []uint64{4, 4}, 5, 2, []Span{{1, 1, 2}}},
+		{"exact boundary", []uint64{4, 4}, 4, 4, []Span{{1, 0, 4}}},
+		{"ends at boundary", []uint64{4, 4}, 0, 4, []Span{{0, 0, 4}}},
+		{"straddles two files", []uint64{4, 4}, 2, 4, []Span{{0, 2, 2}, {1, 0, 2}}},
+		{"many small files", []uint64{1, 2, 1, 3}, 0, 7, []Span{{0, 0, 1}, {1, 0, 2}, {2, 0, 1}, {3, 0, 3}}},
+		{"zero length files", []uint64{0, 3, 0, 0, 3, 0}, 1, 4, []Span{{1, 1, 2}, {4, 0, 2}}},
+		{"zero length file at boundary", []uint64{3, 0, 3}, 3, 1, []Span{{2, 0, 1}}},
+		{"past the end", []uint64{4, 4}, 6, 4, []Span{{1, 2, 2}}},
+		{"empty range", []uint64{4}, 1, 0, nil},
+	}
+	for _, test := range tests {
+		torrent := getLayout(4, test.lengths...)
+		assert.Equal(t, test.spans, FileSpans(torrent, test.position, test.length), test.name)
+	}
+}
+
+func TestPieceSpans(t *testing.T) {
+	// Last piece is shorter than the piece length
+	torrent := getLayout(3, 2, 0, 2, 1, 2)
+	assert.Equal(t, []Span{{0, 0, 2}, {2, 0, 1}}, PieceSpans(torrent, 0))
+	assert.Equal(t, []Span{{2, 1, 1}, {3, 0, 1}, {4, 0, 1}}, PieceSpans(torrent, 1))
+	assert.Equal(t, []Span{{4, 1, 1}}, PieceSpans(torrent, 2))
+	assert.Nil(t, PieceSpans(torrent, 3))
+}
+
+func TestWriteAcrossFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "span")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	lengths := []uint64{3, 0, 1, 5, 0, 2, 4}
+	for _, kind := range []Kind{Files, MMap} {
+		torrent := getLayout(4, lengths...)
+		for i, file := range torrent.Files {
+			file.FilePointer, err = os.Create(filepath.Join(dir, kind.String()+string(rune('a'+i))))
+			assert.Nil(t, err)
+		}
+		s, err := New(kind, torrent)
+		assert.Nil(t, err)
+
+		// Write every piece with its index as content, one block per piece
+		var data []byte
+		for i := uint32(0); i < uint32(len(torrent.Piece)/20); i++ {
+			length, _ := parser.PieceLen(torrent, i)
+			block := bytes.Repeat([]byte{byte('0' + i)}, int(length))
+			_, err = s.WriteAt(block, i, 0)
+			assert.Nil(t, err, kind.String())
+			data = append(data, block...)
+		}
+
+		// Read back a range over several files
+		read := make([]byte, 9)
+		_, err = s.ReadAt(read, 0, 2)
+		assert.Nil(t, err, kind.String())
+		assert.Equal(t, data[2:11], read, kind.String())
+		assert.Nil(t, s.Close())
+
+		// Every file holds its part of the torrent
+		position := uint64(0)
+		for i, file := range torrent.Files {
+			content, _ := ioutil.ReadFile(file.FilePointer.Name())
+			assert.Equal(t, string(data[position:position+file.Length]), string(content), kind.String(), i)
+			position += file.Length
+			file.FilePointer.Close()
+		}
+	}
+}
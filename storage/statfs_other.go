@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package storage
+
+// FreeSpace is not supported on this system
+func FreeSpace(dir string) (uint64, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/concurrency-8/parser"
+)
+
+// Storage holds the data of a torrent. Positions are given as a piece index and an offset in that piece
+type Storage interface {
+	// ReadAt reads len(p) bytes of the piece starting at offset
+	ReadAt(p []byte, piece uint32, offset uint32) (n int, err error)
+	// WriteAt writes p into the piece starting at offset
+	WriteAt(p []byte, piece uint32, offset uint32) (n int, err error)
+	// MarkComplete is called once the piece is verified
+	MarkComplete(piece uint32) error
+	// Close releases the storage. It is safe to call Close more than once
+	Close() error
+}
+
+var errClosed = fmt.Errorf("Storage is closed")
+
+// Kind selects a Storage implementation
+type Kind int
+
+const (
+	// Files stores the torrent in its files on disk
+	Files Kind = iota
+	// Memory stores the torrent in a single memory buffer
+	Memory
+	// MMap stores the torrent in memory mapped files
+	MMap
+)
+
+var kindNames = []string{"file", "memory", "mmap"}
+
+func (kind Kind) String() string {
+	if kind < 0 || int(kind) >= len(kindNames) {
+		return fmt.Sprintf("Kind(%d)", int(kind))
+	}
+	return kindNames[kind]
+}
+
+// ParseKind parses the name of a storage kind
+func ParseKind(name string) (Kind, error) {
+	for i, kindName := range kindNames {
+		if name == kindName {
+			return Kind(i), nil
+		}
+	}
+	return Files, fmt.Errorf("Unknown storage %q", name)
+}
+
+// New opens storage of the given kind for the torrent
+func New(kind Kind, torrent parser.TorrentFile) (Storage, error) {
+	switch kind {
+	case Files:
+		return NewFiles(torrent), nil
+	case Memory:
+		return NewMemory(torrent), nil
+	case MMap:
+		return NewMMap(torrent)
+	}
+	return nil, fmt.Errorf("Unknown storage %v", kind)
+}
+
+// offset returns the position of offset in the piece from the start of the torrent
+func offset(torrent parser.TorrentFile, piece uint32, offset uint32) int64 {
+	return int64(piece)*int64(torrent.PieceLength) + int64(offset)
+}
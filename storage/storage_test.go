@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// getTorrent returns a torrent of two files in a temporary directory
+func getTorrent(t *testing.T) (torrent parser.TorrentFile, dir string) {
+	dir, err := ioutil.TempDir("", "storage")
+	assert.Nil(t, err)
+	torrent.PieceLength = 16
+	torrent.Piece = make([]byte, 4*20)
+	for i, length := range []uint64{40, 24} {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		file, err := os.Create(path)
+		assert.Nil(t, err)
+		torrent.Files = append(torrent.Files, &parser.File{Length: length, FilePointer: file, DiskPath: path})
+		torrent.Length += length
+	}
+	return
+}
+
+func TestParseKind(t *testing.T) {
+	for _, kind := range []Kind{Files, Memory, MMap} {
+		parsed, err := ParseKind(kind.String())
+		assert.Nil(t, err)
+		assert.Equal(t, kind, parsed)
+	}
+	_, err := ParseKind("tape")
+	assert.NotNil(t, err)
+}
+
+func TestStorage(t *testing.T) {
+	for _, kind := range []Kind{Files, Memory, MMap} {
+		torrent, dir := getTorrent(t)
+		s, err := New(kind, torrent)
+		assert.Nil(t, err, kind.String())
+
+		// One block in each file
+		first := bytes.Repeat([]byte{1}, 8)
+		second := bytes.Repeat([]byte{2}, 8)
+		_, err = s.WriteAt(first, 0, 4)
+		assert.Nil(t, err, kind.String())
+		_, err = s.WriteAt(second, 3, 0)
+		assert.Nil(t, err, kind.String())
+		assert.Nil(t, s.MarkComplete(0), kind.String())
+		assert.Nil(t, s.MarkComplete(3), kind.String())
+
+		read := make([]byte, 8)
+		_, err = s.ReadAt(read, 0, 4)
+		assert.Nil(t, err, kind.String())
+		assert.Equal(t, first, read, kind.String())
+		_, err = s.ReadAt(read, 3, 0)
+		assert.Nil(t, err, kind.String())
+		assert.Equal(t, second, read, kind.String())
+
+		assert.Nil(t, s.Close(), kind.String())
+		assert.Nil(t, s.Close(), kind.String())
+
+		// Nothing reaches the disk in memory
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "b"))
+		if kind == Memory {
+			assert.Empty(t, data)
+		} else {
+			assert.Equal(t, second, data[8:16], kind.String())
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// TestSkippedFile checks that data of a skipped file goes to the side file until it is wanted
+func TestSkippedFile(t *testing.T) {
+	for _, kind := range []Kind{Files, MMap} {
+		torrent, dir := getTorrent(t)
+		torrent.Name = dir
+		skipped := torrent.Files[1]
+		skipped.FilePointer.Close()
+		os.Remove(skipped.FilePointer.Name())
+		skipped.DiskPath = filepath.Join(dir, "b")
+		skipped.FilePointer = nil
+
+		s, err := New(kind, torrent)
+		assert.Nil(t, err, kind.String())
+		// piece 2 overlaps both files
+		data := bytes.Repeat([]byte{3}, 16)
+		_, err = s.WriteAt(data, 2, 0)
+		assert.Nil(t, err, kind.String())
+		assert.Nil(t, s.MarkComplete(2), kind.String())
+		_, err = os.Stat(skipped.DiskPath)
+		assert.True(t, os.IsNotExist(err), "Skipped file created")
+
+		read := make([]byte, 16)
+		_, err = s.ReadAt(read, 2, 0)
+		assert.Nil(t, err, kind.String())
+		assert.Equal(t, data, read, kind.String())
+
+		assert.Nil(t, s.(Selector).Want(1), kind.String())
+		// the wanted file is read and written like the others
+		_, err = s.ReadAt(read, 2, 0)
+		assert.Nil(t, err, kind.String())
+		assert.Equal(t, data, read, kind.String())
+		_, err = s.WriteAt(data, 3, 0)
+		assert.Nil(t, err, kind.String())
+		assert.Nil(t, s.Close(), kind.String())
+		written, err := ioutil.ReadFile(skipped.DiskPath)
+		assert.Nil(t, err, kind.String())
+		assert.Equal(t, append(data[8:], data...), written, kind.String())
+		os.RemoveAll(dir)
+	}
+}
+
+// TestSideFileCopy checks that a file larger than a chunk is copied out of the side file
+func TestSideFileCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	side := &sideFile{path: filepath.Join(dir, SideFile)}
+	defer side.close()
+	from, err := side.open(true)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte{4, 5, 6}, sideChunk)
+	_, err = from.WriteAt(data, 10)
+	assert.Nil(t, err)
+
+	to, err := os.Create(filepath.Join(dir, "to"))
+	assert.Nil(t, err)
+	defer to.Close()
+	assert.Nil(t, side.copyTo(to, 10, int64(len(data)-5)))
+	copied, err := ioutil.ReadFile(to.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, data[:len(data)-5], copied)
+}
+
+func TestMove(t *testing.T) {
+	for _, kind := range []Kind{Files, MMap} {
+		torrent, dir := getTorrent(t)
+		s, err := New(kind, torrent)
+		assert.Nil(t, err, kind.String())
+		data := bytes.Repeat([]byte{4}, 16)
+		_, err = s.WriteAt(data, 0, 0)
+		assert.Nil(t, err, kind.String())
+
+		moved := filepath.Join(dir, "complete", "a")
+		assert.Nil(t, s.(Mover).Move(0, moved), kind.String())
+		assert.Equal(t, moved, torrent.Files[0].DiskPath)
+		_, err = os.Stat(filepath.Join(dir, "a"))
+		assert.True(t, os.IsNotExist(err), kind.String())
+
+		// The moved file is still used
+		read := make([]byte, 16)
+		_, err = s.ReadAt(read, 0, 0)
+		assert.Nil(t, err, kind.String())
+		assert.Equal(t, data, read, kind.String())
+		_, err = s.WriteAt(data, 1, 0)
+		assert.Nil(t, err, kind.String())
+		assert.Nil(t, s.Close(), kind.String())
+		for _, file := range torrent.Files {
+			file.FilePointer.Close()
+		}
+		written, _ := ioutil.ReadFile(moved)
+		assert.Equal(t, data, written[16:32], kind.String())
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "to")
+	assert.Nil(t, ioutil.WriteFile(from, []byte("data"), 0600))
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Nil(t, os.Chtimes(from, modTime, modTime))
+
+	assert.Nil(t, copyFile(from, to))
+	data, _ := ioutil.ReadFile(to)
+	assert.Equal(t, []byte("data"), data)
+	info, err := os.Stat(to)
+	assert.Nil(t, err)
+	assert.True(t, modTime.Equal(info.ModTime()))
+}
@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/queue"
+	"github.com/concurrency-8/ratelimit"
+	"github.com/concurrency-8/tracker"
+)
+
+// KeepAliveInterval is the time without writing to a peer after which we send a keep-alive
+var KeepAliveInterval time.Duration = 120
+
+// IdleCheckInterval is how often a connection that receives nothing is checked for inactivity
+var IdleCheckInterval time.Duration = 10
+
+// InactivityTimeout is the time after which a peer that sent nothing is dropped
+var InactivityTimeout time.Duration = 180
+
+// NoDataTimeout is the time after which a peer that unchoked us but sent no piece data is dropped
+var NoDataTimeout time.Duration = 300
+
+// SnubTimeout is the time after which a peer that does not answer our requests is snubbed.
+// A snubbed peer gets at most one request at a time until it sends a piece
+var SnubTimeout time.Duration = 60
+
+// peerConn serialises writes to a peer and sends a keep-alive whenever nothing
+// was written for KeepAliveInterval. Reads and writes are limited by the rate limiters of the torrent
+type peerConn struct {
+	net.Conn
+	lock        sync.Mutex
+	lastWrite   time.Time
+	done        chan struct{}
+	closeOnce   sync.Once
+	readLimits  []*ratelimit.Limiter
+	writeLimits []*ratelimit.Limiter
+}
+
+// newPeerConn wraps a connection to a peer of the torrent of report in the session. A nil report is not rate limited
+func newPeerConn(conn net.Conn, session *Session, report *tracker.ClientStatusReport) *peerConn {
+	c := &peerConn{Conn: conn, lastWrite: time.Now(), done: make(chan struct{})}
+	if report != nil {
+		c.readLimits, c.writeLimits = session.rateLimiters(report.TorrentFile.InfoHash)
+	}
+	go c.keepAlive()
+	return c
+}
+
+func (c *peerConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	ratelimit.Wait(n, c.readLimits...)
+	return
+}
+
+func (c *peerConn) Write(b []byte) (n int, err error) {
+	ratelimit.Wait(len(b), c.writeLimits...)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n, err = c.Conn.Write(b)
+	c.lastWrite = time.Now()
+	return
+}
+
+func (c *peerConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *peerConn) keepAlive() {
+	timer := time.NewTimer(KeepAliveInterval * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-timer.C:
+			c.lock.Lock()
+			silence := time.Since(c.lastWrite)
+			c.lock.Unlock()
+			if silence >= KeepAliveInterval*time.Second {
+				if _, err := c.Write(BuildKeepAlive().Bytes()); err != nil {
+					return
+				}
+				silence = 0
+			}
+			timer.Reset(KeepAliveInterval*time.Second - silence)
+		}
+	}
+}
+
+// checkActivity applies the inactivity policy and snubbing detection to a peer.
+// A non nil error means the peer should be dropped
+func checkActivity(peer tracker.Peer, pieces *piece.PieceTracker, queue *queue.Queue, Log Log) error {
+	now := time.Now()
+	if now.Sub(queue.LastMessage) > InactivityTimeout*time.Second {
+		return fmt.Errorf("Peer sent nothing for %v", now.Sub(queue.LastMessage))
+	}
+	waiting := len(queue.Pending) > 0 || queue.Snubbed
+	if !queue.Choked && waiting && now.Sub(queue.LastPiece) > NoDataTimeout*time.Second {
+		return fmt.Errorf("Peer sent no data for %v while unchoked", now.Sub(queue.LastPiece))
+	}
+	if !queue.Snubbed && !queue.Choked && len(queue.Pending) > 0 && now.Sub(queue.LastPiece) > SnubTimeout*time.Second {
+		Log.Info.Println("peer: <", peer, ">: Snubbed - no piece for", now.Sub(queue.LastPiece))
+		queue.Snubbed = true
+		releasePending(pieces, queue)
+	}
+	return nil
+}
+
+// releasePending marks our outstanding requests to the peer as not requested and puts their
+// pieces back in the queues of the peers of the torrent, so that they can be asked for them.
+// The buffer of a piece left without requested or received blocks is freed
+func releasePending(pieces *piece.PieceTracker, queue *queue.Queue) {
+	if pieces != nil && len(queue.Pending) > 0 {
+		var indexes []uint32
+		released := make(map[uint32]bool)
+		pieces.Lock.Lock()
+		for _, block := range queue.Pending {
+			if !pieces.BlockReceived(block.Index, block.Begin/parser.BLOCK_LEN) {
+				pieces.RemoveRequested(block)
+			}
+			if !released[block.Index] {
+				released[block.Index] = true
+				indexes = append(indexes, block.Index)
+			}
+		}
+		for _, index := range indexes {
+			if idle(pieces, index) {
+				pieces.Buffers.Release(index)
+			}
+		}
+		pieces.Lock.Unlock()
+		requeue(pieces, indexes...)
+	}
+	queue.Pending = nil
+}
+
+// idle tells if no block of the piece is requested or received. pieces.Lock must be held
+func idle(pieces *piece.PieceTracker, index uint32) bool {
+	for block := 0; block < pieces.Blocks(index); block++ {
+		if pieces.BlockRequested(index, uint32(block)) || pieces.BlockReceived(index, uint32(block)) {
+			return false
+		}
+	}
+	return true
+}
+
+// removePending forgets an outstanding request once its block arrived. It tells if the block was requested
+func removePending(queue *queue.Queue, block parser.PieceBlock) bool {
+	for i, request := range queue.Pending {
+		if request.Index == block.Index && request.Begin == block.Begin {
+			queue.Pending = append(queue.Pending[:i], queue.Pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/queue"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepAlive(t *testing.T) {
+	interval := KeepAliveInterval
+	KeepAliveInterval = 1
+	defer func() { KeepAliveInterval = interval }()
+
+	client, server := net.Pipe()
+	conn := newPeerConn(server, nil, nil)
+	defer conn.Close()
+
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp := make([]byte, 4)
+	respLen, err := client.Read(resp)
+	assert.Nil(t, err, "Keep-alive not sent")
+	assert.Equal(t, BuildKeepAlive().Bytes(), resp[:respLen])
+}
+
+func TestKeepAliveIsNotChoke(t *testing.T) {
+	queue := queue.NewQueue(parser.TorrentFile{})
+	queue.Choked = false
+	err := msgHandler(tracker.Peer{}, BuildKeepAlive().Bytes(), nil, nil, queue, nil, getLog())
+	assert.Nil(t, err)
+	assert.False(t, queue.Choked)
+}
+
+func TestInactivity(t *testing.T) {
+	queue := queue.NewQueue(parser.TorrentFile{})
+	queue.LastMessage = time.Now()
+	assert.Nil(t, checkActivity(tracker.Peer{}, nil, queue, getLog()))
+
+	queue.LastMessage = time.Now().Add(-(InactivityTimeout + 1) * time.Second)
+	assert.NotNil(t, checkActivity(tracker.Peer{}, nil, queue, getLog()), "Idle peer not dropped")
+
+	// Unchoked, but no data for our requests
+	queue.LastMessage = time.Now()
+	queue.Choked = false
+	queue.Pending = []parser.PieceBlock{GetRandomPiece()}
+	queue.LastPiece = time.Now().Add(-(NoDataTimeout + 1) * time.Second)
+	assert.NotNil(t, checkActivity(tracker.Peer{}, nil, queue, getLog()), "Peer without data not dropped")
+}
+
+func TestSnubbing(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	pieces := piece.NewPieceTracker(file)
+	queue := queue.NewQueue(file)
+	queue.Choked = false
+	queue.LastMessage = time.Now()
+	block, _ := parser.RandomPieceBlock(file)
+	pieces.AddRequested(block)
+	queue.Pending = []parser.PieceBlock{block}
+
+	queue.LastPiece = time.Now()
+	assert.Nil(t, checkActivity(tracker.Peer{}, pieces, queue, getLog()))
+	assert.False(t, queue.Snubbed)
+
+	queue.LastPiece = time.Now().Add(-(SnubTimeout + 1) * time.Second)
+	assert.Nil(t, checkActivity(tracker.Peer{}, pieces, queue, getLog()))
+	assert.True(t, queue.Snubbed)
+	assert.Empty(t, queue.Pending)
+	// The block can be requested from other peers
+	assert.True(t, pieces.Needed(block))
+
+	// A snubbed peer with an outstanding request is not asked for more
+	queue.Pending = []parser.PieceBlock{block}
+	assert.Nil(t, RequestPiece(tracker.Peer{}, nil, pieces, queue, getLog()))
+	assert.Len(t, queue.Pending, 1)
+}
+
+// TestReleasePending checks that released blocks are put back in the queues of the other peers
+// that have their piece, and that an idle piece frees its buffer
+func TestReleasePending(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	pieces := piece.NewPieceTracker(file)
+	defer forgetRetries(pieces)
+	left, other, without := queue.NewQueue(file), queue.NewQueue(file), queue.NewQueue(file)
+	for _, q := range []*queue.Queue{left, other, without} {
+		joinQueues(pieces, q)
+	}
+	block, _ := parser.RandomPieceBlock(file)
+	other.Have[block.Index] = true
+	pieces.Buffers.Reserve(block.Index)
+	pieces.AddRequested(block)
+	left.Pending = []parser.PieceBlock{block}
+
+	releasePending(pieces, left)
+	assert.Empty(t, left.Pending)
+	assert.True(t, pieces.Needed(block))
+	assert.Equal(t, 0, pieces.Buffers.Len())
+
+	// only the peer having the piece asks for it
+	assert.Nil(t, RequestPiece(tracker.Peer{}, nil, pieces, without, getLog()))
+	assert.Equal(t, 0, without.Length())
+	other.Choked = true
+	assert.Nil(t, RequestPiece(tracker.Peer{}, nil, pieces, other, getLog()))
+	assert.NotEqual(t, 0, other.Length())
+}
@@ -0,0 +1,295 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/tracker"
+)
+
+// BanThreshold is how low the trust score of a peer may drop with hash failures before it is banned
+var BanThreshold = 3
+
+// BanDuration is the time in seconds for which a banned peer is refused
+var BanDuration time.Duration = 3600
+
+var errBanned = fmt.Errorf("Peer is banned")
+
+// banList holds the banned peers of a session by IP with the end of their ban, and the trust scores of peers
+type banList struct {
+	lock  sync.Mutex
+	until map[uint32]time.Time
+	trust map[uint32]int
+}
+
+func newBanList() *banList {
+	return &banList{until: make(map[uint32]time.Time), trust: make(map[uint32]int)}
+}
+
+// Ban refuses the peers at the IP of peer for duration in the default session, see Session.Ban
+func Ban(peer tracker.Peer, duration time.Duration) {
+	defaultSession().Ban(peer, duration)
+}
+
+// Unban lifts the ban of the IP of peer in the default session
+func Unban(peer tracker.Peer) {
+	defaultSession().Unban(peer)
+}
+
+// Banned tells if the IP of peer is banned in the default session
+func Banned(peer tracker.Peer) bool {
+	return defaultSession().Banned(peer)
+}
+
+// Trust returns the trust score of the IP of peer in the default session, see Session.Trust
+func Trust(peer tracker.Peer) int {
+	return defaultSession().Trust(peer)
+}
+
+// Ban refuses the peers at the IP of peer for duration, in every torrent of the session. Their connections are dropped
+func (session *Session) Ban(peer tracker.Peer, duration time.Duration) {
+	bans := session.bans
+	bans.lock.Lock()
+	bans.until[peer.IPAdress] = time.Now().Add(duration)
+	bans.lock.Unlock()
+
+	// the suspect pieces the peer was downloading again go to other peers
+	attribution := session.attribution
+	attribution.lock.Lock()
+	for _, suspects := range attribution.suspects {
+		for _, s := range suspects {
+			if s.owner.IPAdress == peer.IPAdress {
+				s.owner = tracker.Peer{}
+			}
+		}
+	}
+	attribution.lock.Unlock()
+
+	var conns []net.Conn
+	swarms := session.swarms
+	swarms.lock.Lock()
+	for _, peers := range swarms.peers {
+		for conn, p := range peers {
+			if p.IPAdress == peer.IPAdress {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	swarms.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Unban lifts the ban of the IP of peer
+func (session *Session) Unban(peer tracker.Peer) {
+	bans := session.bans
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+	delete(bans.until, peer.IPAdress)
+}
+
+// Banned tells if the IP of peer is banned. Expired bans are forgotten
+func (session *Session) Banned(peer tracker.Peer) bool {
+	bans := session.bans
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+	until, ok := bans.until[peer.IPAdress]
+	if ok && time.Now().After(until) {
+		delete(bans.until, peer.IPAdress)
+		ok = false
+	}
+	return ok
+}
+
+// Trust returns the trust score of the IP of peer. It drops by one for every hash failure
+// the peer took part in and recovers by one for every verified piece, up to 0
+func (session *Session) Trust(peer tracker.Peer) int {
+	bans := session.bans
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+	return bans.trust[peer.IPAdress]
+}
+
+// suspect is a piece that failed its hash check with blocks of several peers. It is downloaded again
+// from a single peer, the blocks that differ from the good piece tell which peers sent bad data
+type suspect struct {
+	data    []byte
+	senders []uint32
+	// owner is the peer downloading the piece again, the zero Peer until a peer requests it
+	owner tracker.Peer
+}
+
+// attributionSet holds the IP of the peer that sent every block of the pieces being downloaded,
+// and the suspect pieces, per torrent
+type attributionSet struct {
+	lock     sync.Mutex
+	senders  map[*piece.PieceTracker]map[uint32][]uint32
+	suspects map[*piece.PieceTracker]map[uint32]*suspect
+}
+
+func newAttributionSet() *attributionSet {
+	return &attributionSet{senders: make(map[*piece.PieceTracker]map[uint32][]uint32), suspects: make(map[*piece.PieceTracker]map[uint32]*suspect)}
+}
+
+// recordSender remembers the peer that sent a block
+func recordSender(pieces *piece.PieceTracker, block parser.PieceBlock, peer tracker.Peer) {
+	attribution := sessionOf(pieces).attribution
+	attribution.lock.Lock()
+	defer attribution.lock.Unlock()
+	if attribution.senders[pieces] == nil {
+		attribution.senders[pieces] = make(map[uint32][]uint32)
+	}
+	senders := attribution.senders[pieces][block.Index]
+	if senders == nil {
+		senders = make([]uint32, pieces.Blocks(block.Index))
+		attribution.senders[pieces][block.Index] = senders
+	}
+	if i := int(block.Begin / parser.BLOCK_LEN); i < len(senders) {
+		senders[i] = peer.IPAdress
+	}
+}
+
+// takeSenders returns and forgets the senders of the blocks of a piece, 0 for unknown senders
+func takeSenders(pieces *piece.PieceTracker, index uint32) []uint32 {
+	attribution := sessionOf(pieces).attribution
+	attribution.lock.Lock()
+	defer attribution.lock.Unlock()
+	senders := attribution.senders[pieces][index]
+	delete(attribution.senders[pieces], index)
+	return senders
+}
+
+// mayRequest tells if the peer may request blocks of the piece. A suspect piece
+// is downloaded again only by the peer that claimed it, or by any peer until one does
+func mayRequest(pieces *piece.PieceTracker, index uint32, peer tracker.Peer) bool {
+	attribution := sessionOf(pieces).attribution
+	attribution.lock.Lock()
+	defer attribution.lock.Unlock()
+	s := attribution.suspects[pieces][index]
+	return s == nil || s.owner == tracker.Peer{} || s.owner == peer
+}
+
+// claimSuspect makes the peer the one downloading a suspect piece again, once it requests a block of it
+func claimSuspect(pieces *piece.PieceTracker, index uint32, peer tracker.Peer) {
+	attribution := sessionOf(pieces).attribution
+	attribution.lock.Lock()
+	defer attribution.lock.Unlock()
+	if s := attribution.suspects[pieces][index]; s != nil && s.owner == (tracker.Peer{}) {
+		s.owner = peer
+	}
+}
+
+// releaseSuspects lets other peers download the suspect pieces taken by a peer that is gone
+func releaseSuspects(pieces *piece.PieceTracker, peer tracker.Peer) {
+	attribution := sessionOf(pieces).attribution
+	attribution.lock.Lock()
+	defer attribution.lock.Unlock()
+	for _, s := range attribution.suspects[pieces] {
+		if s.owner == peer {
+			s.owner = tracker.Peer{}
+		}
+	}
+}
+
+// forgetAttribution drops the senders and suspect pieces of a torrent that is done
+func forgetAttribution(pieces *piece.PieceTracker) {
+	attribution := sessionOf(pieces).attribution
+	attribution.lock.Lock()
+	defer attribution.lock.Unlock()
+	delete(attribution.senders, pieces)
+	delete(attribution.suspects, pieces)
+}
+
+// distinct returns the known senders once each
+func distinct(senders []uint32) (result []uint32) {
+	for _, sender := range senders {
+		seen := sender == 0
+		for _, s := range result {
+			seen = seen || s == sender
+		}
+		if !seen {
+			result = append(result, sender)
+		}
+	}
+	return
+}
+
+// hashPassed raises the trust of the senders of a verified piece. If the piece was suspect,
+// the peers whose blocks differ from the verified data are banned
+func hashPassed(pieces *piece.PieceTracker, index uint32, data []byte, senders []uint32, Log Log) {
+	session := sessionOf(pieces)
+	bans, attribution := session.bans, session.attribution
+	bans.lock.Lock()
+	for _, sender := range distinct(senders) {
+		if bans.trust[sender] < 0 {
+			bans.trust[sender]++
+		}
+	}
+	bans.lock.Unlock()
+
+	attribution.lock.Lock()
+	s := attribution.suspects[pieces][index]
+	delete(attribution.suspects[pieces], index)
+	attribution.lock.Unlock()
+	if s == nil {
+		return
+	}
+	var culprits []uint32
+	for i, sender := range s.senders {
+		begin := i * int(parser.BLOCK_LEN)
+		end := begin + int(parser.BLOCK_LEN)
+		if end > len(data) {
+			end = len(data)
+		}
+		if sender != 0 && begin < end && !bytes.Equal(s.data[begin:end], data[begin:end]) {
+			culprits = append(culprits, sender)
+		}
+	}
+	for _, culprit := range distinct(culprits) {
+		peer := tracker.Peer{IPAdress: culprit}
+		Log.Error.Println("peer: <", peer, ">: Sent bad blocks of piece", index, "- banning")
+		session.Ban(peer, session.config.BanDuration*time.Second)
+	}
+}
+
+// hashFailed lowers the trust of the senders of a piece that failed its hash check, and bans those whose
+// trust reaches -BanThreshold of the session. A piece of several peers is downloaded again from a single peer to find the culprit
+func hashFailed(pieces *piece.PieceTracker, index uint32, data []byte, senders []uint32, Log Log) {
+	session := sessionOf(pieces)
+	bans, attribution := session.bans, session.attribution
+	implicated := distinct(senders)
+	var banned []uint32
+	bans.lock.Lock()
+	for _, sender := range implicated {
+		bans.trust[sender]--
+		if bans.trust[sender] <= -session.config.BanThreshold {
+			banned = append(banned, sender)
+		}
+	}
+	bans.lock.Unlock()
+	for _, sender := range banned {
+		peer := tracker.Peer{IPAdress: sender}
+		Log.Error.Println("peer: <", peer, ">: Sent bad blocks of piece", index, "- banning")
+		session.Ban(peer, session.config.BanDuration*time.Second)
+	}
+	if len(implicated) < 2 {
+		return
+	}
+
+	attribution.lock.Lock()
+	if attribution.suspects[pieces] == nil {
+		attribution.suspects[pieces] = make(map[uint32]*suspect)
+	}
+	if s := attribution.suspects[pieces][index]; s != nil {
+		s.owner = tracker.Peer{}
+	} else {
+		attribution.suspects[pieces][index] = &suspect{data: append([]byte(nil), data...), senders: senders}
+	}
+	attribution.lock.Unlock()
+}
@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+// getBanTracker returns a tracker of one piece of two blocks
+func getBanTracker() *piece.PieceTracker {
+	return piece.NewPieceTracker(parser.TorrentFile{PieceLength: 2 * parser.BLOCK_LEN, Length: 2 * uint64(parser.BLOCK_LEN), Piece: make([]byte, 20)})
+}
+
+func TestBan(t *testing.T) {
+	peer := tracker.Peer{IPAdress: 0x0a000001, Port: 6881}
+	assert.False(t, Banned(peer))
+	Ban(peer, time.Hour)
+	assert.True(t, Banned(peer))
+	// the ban is by IP, whatever the port
+	assert.True(t, Banned(tracker.Peer{IPAdress: peer.IPAdress, Port: 6882}))
+	Unban(peer)
+	assert.False(t, Banned(peer))
+
+	Ban(peer, -time.Second)
+	assert.False(t, Banned(peer))
+}
+
+func TestHashFailedSingleSender(t *testing.T) {
+	pieces := getBanTracker()
+	defer forgetAttribution(pieces)
+	peer := tracker.Peer{IPAdress: 0x0a000002}
+	defer Unban(peer)
+	for _, begin := range []uint32{0, parser.BLOCK_LEN} {
+		recordSender(pieces, parser.PieceBlock{Index: 0, Begin: begin}, peer)
+	}
+	senders := takeSenders(pieces, 0)
+	assert.Equal(t, []uint32{peer.IPAdress, peer.IPAdress}, senders)
+	assert.Nil(t, takeSenders(pieces, 0))
+
+	hashFailed(pieces, 0, make([]byte, 2*parser.BLOCK_LEN), senders, getLog())
+	assert.False(t, Banned(peer))
+	assert.Equal(t, -1, Trust(peer))
+	for i := 1; i < BanThreshold; i++ {
+		hashFailed(pieces, 0, make([]byte, 2*parser.BLOCK_LEN), senders, getLog())
+	}
+	assert.True(t, Banned(peer))
+	assert.Equal(t, -BanThreshold, Trust(peer))
+}
+
+// TestSmartBan checks that a piece of two peers is downloaded again from one peer,
+// and that the peer whose block differs from the good piece is banned
+func TestSmartBan(t *testing.T) {
+	pieces := getBanTracker()
+	defer forgetAttribution(pieces)
+	honest, culprit, other := tracker.Peer{IPAdress: 0x0a000003}, tracker.Peer{IPAdress: 0x0a000004}, tracker.Peer{IPAdress: 0x0a000005}
+	defer Unban(culprit)
+
+	bad := make([]byte, 2*parser.BLOCK_LEN)
+	bad[parser.BLOCK_LEN] = 1
+	hashFailed(pieces, 0, bad, []uint32{honest.IPAdress, culprit.IPAdress}, getLog())
+	assert.False(t, Banned(honest))
+	assert.False(t, Banned(culprit))
+	assert.Equal(t, -1, Trust(honest))
+
+	// the first peer to request the piece downloads it alone, asking does not claim it
+	assert.True(t, mayRequest(pieces, 0, other))
+	assert.True(t, mayRequest(pieces, 0, honest))
+	claimSuspect(pieces, 0, other)
+	claimSuspect(pieces, 0, honest)
+	assert.True(t, mayRequest(pieces, 0, other))
+	assert.False(t, mayRequest(pieces, 0, honest))
+	// another peer at the same IP is another peer
+	assert.False(t, mayRequest(pieces, 0, tracker.Peer{IPAdress: other.IPAdress, Port: 1}))
+	releaseSuspects(pieces, other)
+	assert.True(t, mayRequest(pieces, 0, honest))
+
+	hashPassed(pieces, 0, make([]byte, 2*parser.BLOCK_LEN), []uint32{honest.IPAdress, honest.IPAdress}, getLog())
+	assert.False(t, Banned(honest))
+	assert.True(t, Banned(culprit))
+	assert.Equal(t, 0, Trust(honest))
+	assert.True(t, mayRequest(pieces, 0, other))
+}
+
+func TestBanThreshold(t *testing.T) {
+	pieces := getBanTracker()
+	defer forgetAttribution(pieces)
+	first, second := tracker.Peer{IPAdress: 0x0a000006}, tracker.Peer{IPAdress: 0x0a000007}
+	defer Unban(first)
+	defer Unban(second)
+
+	for i := 0; i < BanThreshold; i++ {
+		assert.False(t, Banned(first))
+		hashFailed(pieces, 0, make([]byte, 2*parser.BLOCK_LEN), []uint32{first.IPAdress, second.IPAdress}, getLog())
+	}
+	assert.True(t, Banned(first))
+	assert.True(t, Banned(second))
+	assert.Equal(t, -BanThreshold, Trust(first))
+}
@@ -0,0 +1,417 @@
+package torrent
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/tracker"
+)
+
+// MaxConnections is the number of peer connections of all torrents of a session at once
+var MaxConnections = 200
+
+// MaxConnectionsPerTorrent is the number of peer connections of a torrent at once
+var MaxConnectionsPerTorrent = 50
+
+// MaxHalfOpen is the number of connection attempts to peers at once, of all torrents of a session
+var MaxHalfOpen = 16
+
+// RetryBackoff is the time in seconds before a peer that failed is tried again. It doubles with every failure in a row
+var RetryBackoff time.Duration = 30
+
+// MaxRetryBackoff is the longest time in seconds before a peer that failed is tried again
+var MaxRetryBackoff time.Duration = 1800
+
+// MaxPeerFailures is the number of failures in a row after which a peer is forgotten
+var MaxPeerFailures = 5
+
+// ExternalIP is our address as seen by peers, for the canonical peer priority of BEP 40.
+// If nil, the local address of our first connection to a peer is used
+var ExternalIP net.IP
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// candidate is a peer of a torrent we may connect to
+type candidate struct {
+	peer      tracker.Peer
+	failures  int
+	retryAt   time.Time
+	connected bool
+	// priority is the BEP 40 priority of the connection to the peer
+	priority uint32
+}
+
+// candidateHeap is a heap of candidates, highest priority first or earliest retry first
+type candidateHeap struct {
+	candidates []*candidate
+	byRetry    bool
+}
+
+func (h *candidateHeap) Len() int { return len(h.candidates) }
+
+func (h *candidateHeap) Less(i, j int) bool {
+	if h.byRetry {
+		return h.candidates[i].retryAt.Before(h.candidates[j].retryAt)
+	}
+	return h.candidates[i].priority > h.candidates[j].priority
+}
+
+func (h *candidateHeap) Swap(i, j int) {
+	h.candidates[i], h.candidates[j] = h.candidates[j], h.candidates[i]
+}
+
+func (h *candidateHeap) Push(x interface{}) {
+	h.candidates = append(h.candidates, x.(*candidate))
+}
+
+func (h *candidateHeap) Pop() interface{} {
+	last := len(h.candidates) - 1
+	c := h.candidates[last]
+	h.candidates[last] = nil
+	h.candidates = h.candidates[:last]
+	return c
+}
+
+// connManager holds the connections of the torrents of a session and limits them. Limits of 0 are
+// MaxConnections and MaxConnectionsPerTorrent. halfOpen limits the connection attempts in dialPeer
+type connManager struct {
+	maxConnections           int
+	maxConnectionsPerTorrent int
+	lock                     sync.Mutex
+	connected                int
+	torrents                 map[*piece.PieceTracker]*torrentConns
+	localIP                  uint32
+	halfOpen                 chan struct{}
+}
+
+func newConnManager(config Config) *connManager {
+	return &connManager{
+		maxConnections:           config.MaxConnections,
+		maxConnectionsPerTorrent: config.MaxConnectionsPerTorrent,
+		torrents:                 make(map[*piece.PieceTracker]*torrentConns),
+		halfOpen:                 make(chan struct{}, config.MaxHalfOpen),
+	}
+}
+
+// limits returns the connection limits of all torrents and of a torrent
+func (manager *connManager) limits() (int, int) {
+	total, perTorrent := manager.maxConnections, manager.maxConnectionsPerTorrent
+	if total <= 0 {
+		total = MaxConnections
+	}
+	if perTorrent <= 0 {
+		perTorrent = MaxConnectionsPerTorrent
+	}
+	return total, perTorrent
+}
+
+// torrentConns are the candidate and connected peers of a torrent. The candidates that are not
+// connected are either ready, by priority, or waiting for their backoff to end
+type torrentConns struct {
+	session    *Session
+	manager    *connManager
+	report     *tracker.ClientStatusReport
+	pieces     *piece.PieceTracker
+	Log        Log
+	candidates map[tracker.Peer]*candidate
+	ready      candidateHeap
+	waiting    candidateHeap
+	self       tracker.Peer
+	connected  int
+	conns      map[net.Conn]bool
+	stopped    bool
+	wake       chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       sync.WaitGroup
+}
+
+// startConnections starts connecting to the candidate peers of a torrent of the session, highest
+// BEP 40 priority first, within the connection limits of the session. The connections end with ctx
+func startConnections(ctx context.Context, session *Session, report *tracker.ClientStatusReport, pieces *piece.PieceTracker, Log Log) {
+	manager := session.conns
+	t := &torrentConns{
+		session:    session,
+		manager:    manager,
+		report:     report,
+		pieces:     pieces,
+		Log:        Log,
+		candidates: make(map[tracker.Peer]*candidate),
+		waiting:    candidateHeap{byRetry: true},
+		conns:      make(map[net.Conn]bool),
+		wake:       make(chan struct{}, 1),
+	}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	manager.lock.Lock()
+	manager.torrents[pieces] = t
+	manager.lock.Unlock()
+	t.done.Add(1)
+	go t.run()
+}
+
+// addPeers adds candidate peers to a torrent, as received from a tracker
+func addPeers(pieces *piece.PieceTracker, peers []tracker.Peer) {
+	manager := sessionOf(pieces).conns
+	manager.lock.Lock()
+	t := manager.torrents[pieces]
+	if t != nil {
+		t.prioritize()
+		for _, peer := range peers {
+			if _, ok := t.candidates[peer]; !ok {
+				c := &candidate{peer: peer, priority: peerPriority(t.self, peer)}
+				t.candidates[peer] = c
+				heap.Push(&t.ready, c)
+			}
+		}
+	}
+	manager.lock.Unlock()
+	if t != nil {
+		t.signal()
+	}
+}
+
+// stopConnections stops connecting to peers of a torrent, closes its connections and waits for them to end
+func stopConnections(pieces *piece.PieceTracker) {
+	manager := sessionOf(pieces).conns
+	manager.lock.Lock()
+	t := manager.torrents[pieces]
+	if t == nil {
+		manager.lock.Unlock()
+		return
+	}
+	t.stopped = true
+	t.cancel()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	manager.lock.Unlock()
+
+	t.done.Wait()
+	manager.lock.Lock()
+	delete(manager.torrents, pieces)
+	manager.lock.Unlock()
+	manager.signalAll()
+}
+
+// managed tells if a torrent has a connection manager
+func managed(pieces *piece.PieceTracker) bool {
+	manager := sessionOf(pieces).conns
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return manager.torrents[pieces] != nil
+}
+
+// stopping tells if the connections of a torrent are being stopped
+func stopping(pieces *piece.PieceTracker) bool {
+	manager := sessionOf(pieces).conns
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	t := manager.torrents[pieces]
+	return t != nil && t.stopped
+}
+
+// addConn registers a connection of a torrent so that it is closed when the torrent stops.
+// It returns false if the torrent is stopping
+func addConn(pieces *piece.PieceTracker, conn net.Conn) bool {
+	manager := sessionOf(pieces).conns
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	t := manager.torrents[pieces]
+	if t == nil {
+		return true
+	}
+	if t.stopped {
+		return false
+	}
+	t.conns[conn] = true
+	return true
+}
+
+// removeConn forgets a closed connection
+func removeConn(pieces *piece.PieceTracker, conn net.Conn) {
+	manager := sessionOf(pieces).conns
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if t := manager.torrents[pieces]; t != nil {
+		delete(t.conns, conn)
+	}
+}
+
+// signal wakes the connecting goroutine of the torrent
+func (t *torrentConns) signal() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// signalAll wakes every torrent of the connection manager, as when a connection ends and the limit allows another
+func (manager *connManager) signalAll() {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	for _, t := range manager.torrents {
+		t.signal()
+	}
+}
+
+// run connects to candidates until the torrent is stopped. It looks again every second, for backoffs that ended
+func (t *torrentConns) run() {
+	defer t.done.Done()
+	for {
+		for t.connectNext() {
+		}
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-t.wake:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// prioritize computes the priorities of the candidates again when our address changed.
+// The lock of the manager must be held
+func (t *torrentConns) prioritize() {
+	self := tracker.Peer{IPAdress: t.manager.localIP, Port: t.report.Port}
+	if ip := ExternalIP.To4(); ip != nil {
+		self.IPAdress = binary.BigEndian.Uint32(ip)
+	}
+	if self == t.self {
+		return
+	}
+	t.self = self
+	for _, c := range t.candidates {
+		c.priority = peerPriority(self, c.peer)
+	}
+	heap.Init(&t.ready)
+}
+
+// connectNext starts a connection to the candidate of highest priority, if the limits allow it
+func (t *torrentConns) connectNext() bool {
+	t.manager.lock.Lock()
+	defer t.manager.lock.Unlock()
+	total, perTorrent := t.manager.limits()
+	if t.stopped || t.manager.connected >= total || t.connected >= perTorrent {
+		return false
+	}
+	t.prioritize()
+	now := time.Now()
+	for t.waiting.Len() > 0 && !now.Before(t.waiting.candidates[0].retryAt) {
+		heap.Push(&t.ready, heap.Pop(&t.waiting))
+	}
+	var best *candidate
+	for best == nil && t.ready.Len() > 0 {
+		c := heap.Pop(&t.ready).(*candidate)
+		if t.session.Banned(c.peer) {
+			// the ban is looked at again after a backoff
+			c.retryAt = now.Add(RetryBackoff * time.Second)
+			heap.Push(&t.waiting, c)
+			continue
+		}
+		best = c
+	}
+	if best == nil {
+		return false
+	}
+	best.connected = true
+	t.connected++
+	t.manager.connected++
+	t.done.Add(1)
+	go t.download(best)
+	return true
+}
+
+// download runs a connection to a candidate. A peer that failed waits for its backoff before it is tried again
+func (t *torrentConns) download(c *candidate) {
+	defer t.done.Done()
+	t.Log.Info.Println("Spawning peer thread: peer<", c.peer, ">")
+	err := DownloadFromPeerContext(t.ctx, c.peer, t.report, t.pieces, t.Log)
+
+	t.manager.lock.Lock()
+	c.connected = false
+	t.connected--
+	t.manager.connected--
+	if err != nil {
+		c.failures++
+		c.retryAt = time.Now().Add(backoff(c.failures))
+	} else {
+		c.failures = 0
+		c.retryAt = time.Now().Add(RetryBackoff * time.Second)
+	}
+	if c.failures >= MaxPeerFailures {
+		delete(t.candidates, c.peer)
+	} else {
+		heap.Push(&t.waiting, c)
+	}
+	t.manager.lock.Unlock()
+	t.manager.signalAll()
+}
+
+// backoff returns the time before a peer that failed failures times in a row is tried again
+func backoff(failures int) time.Duration {
+	wait := RetryBackoff * time.Second
+	for i := 1; i < failures && wait < MaxRetryBackoff*time.Second; i++ {
+		wait *= 2
+	}
+	if wait > MaxRetryBackoff*time.Second {
+		wait = MaxRetryBackoff * time.Second
+	}
+	return wait
+}
+
+// acquireHalfOpen waits until a connection attempt is allowed or ctx ends. The returned function ends the attempt
+func (manager *connManager) acquireHalfOpen(ctx context.Context) (func(), error) {
+	select {
+	case manager.halfOpen <- struct{}{}:
+		return func() { <-manager.halfOpen }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// learnLocalIP keeps the local address of a connection to a peer, for peer priorities
+func (manager *connManager) learnLocalIP(conn net.Conn) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || addr.IP.To4() == nil {
+		return
+	}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.localIP == 0 {
+		manager.localIP = binary.BigEndian.Uint32(addr.IP.To4())
+	}
+}
+
+// peerPriority returns the canonical priority of a connection between two peers, as in BEP 40.
+// Both sides compute the same priority, the connections of highest priority are preferred
+func peerPriority(a tracker.Peer, b tracker.Peer) uint32 {
+	buffer := make([]byte, 8)
+	if a.IPAdress == b.IPAdress {
+		first, second := a.Port, b.Port
+		if first > second {
+			first, second = second, first
+		}
+		binary.BigEndian.PutUint16(buffer[0:], first)
+		binary.BigEndian.PutUint16(buffer[2:], second)
+		return crc32.Checksum(buffer[:4], castagnoli)
+	}
+	mask := uint32(0xffff5555)
+	if a.IPAdress>>8 == b.IPAdress>>8 {
+		mask = 0xffffffff
+	} else if a.IPAdress>>16 == b.IPAdress>>16 {
+		mask = 0xffffff55
+	}
+	first, second := a.IPAdress&mask, b.IPAdress&mask
+	if first > second {
+		first, second = second, first
+	}
+	binary.BigEndian.PutUint32(buffer[0:], first)
+	binary.BigEndian.PutUint32(buffer[4:], second)
+	return crc32.Checksum(buffer, castagnoli)
+}
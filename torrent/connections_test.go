@@ -0,0 +1,96 @@
+package torrent
+
+import (
+	"container/heap"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/mse"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPeerPriority checks the examples of BEP 40
+func TestPeerPriority(t *testing.T) {
+	ip := func(a, b, c, d uint32) uint32 { return a<<24 | b<<16 | c<<8 | d }
+	first := tracker.Peer{IPAdress: ip(123, 213, 32, 10), Port: 6881}
+	assert.Equal(t, uint32(0xec2d7224), peerPriority(first, tracker.Peer{IPAdress: ip(98, 76, 54, 32)}))
+	assert.Equal(t, uint32(0xec2d7224), peerPriority(tracker.Peer{IPAdress: ip(98, 76, 54, 32)}, first))
+	assert.Equal(t, uint32(0x99568189), peerPriority(first, tracker.Peer{IPAdress: ip(123, 213, 32, 234)}))
+
+	// the same IP is told apart by the ports
+	second := tracker.Peer{IPAdress: first.IPAdress, Port: 6882}
+	assert.Equal(t, peerPriority(first, second), peerPriority(second, first))
+}
+
+// TestCandidateHeap checks that candidates come out by priority, or by the end of their backoff
+func TestCandidateHeap(t *testing.T) {
+	var ready candidateHeap
+	waiting := candidateHeap{byRetry: true}
+	now := time.Now()
+	for i, priority := range []uint32{5, 9, 1, 7} {
+		heap.Push(&ready, &candidate{priority: priority})
+		heap.Push(&waiting, &candidate{retryAt: now.Add(time.Duration(priority) * time.Second), failures: i})
+	}
+	var priorities []uint32
+	var failures []int
+	for ready.Len() > 0 {
+		priorities = append(priorities, heap.Pop(&ready).(*candidate).priority)
+		failures = append(failures, heap.Pop(&waiting).(*candidate).failures)
+	}
+	assert.Equal(t, []uint32{9, 7, 5, 1}, priorities)
+	assert.Equal(t, []int{2, 0, 3, 1}, failures)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, RetryBackoff*time.Second, backoff(1))
+	assert.Equal(t, 2*RetryBackoff*time.Second, backoff(2))
+	assert.Equal(t, MaxRetryBackoff*time.Second, backoff(100))
+}
+
+// TestConnectionLimits checks that no more than MaxConnectionsPerTorrent peers are connected,
+// and that stopping the torrent closes its connections
+func TestConnectionLimits(t *testing.T) {
+	accepted := make(chan net.Conn, 3)
+	var peers []tracker.Peer
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer listener.Close()
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				accepted <- conn
+			}
+		}()
+		peers = append(peers, tracker.Peer{IPAdress: 0x7f000001, Port: uint16(listener.Addr().(*net.TCPAddr).Port)})
+	}
+
+	report, pieces, _ := getReaderTorrent()
+	config := DefaultConfig()
+	config.UTP, config.EncryptionPolicy = false, mse.Disabled
+	config.MaxConnectionsPerTorrent = 2
+	session := testSession(t, config, pieces)
+	startConnections(context.Background(), session, report, pieces, getLog())
+	addPeers(pieces, peers)
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-accepted:
+			defer conn.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatal("Peer not connected")
+		}
+	}
+	select {
+	case <-accepted:
+		t.Fatal("Connected to more peers than allowed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	stopConnections(pieces)
+	assert.False(t, managed(pieces))
+	session.conns.lock.Lock()
+	assert.Equal(t, 0, session.conns.connected)
+	session.conns.lock.Unlock()
+}
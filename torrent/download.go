@@ -2,24 +2,22 @@ package torrent
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/binary"
-	"encoding/gob"
+	"fmt"
 	"log"
 	"net"
-	"net/url"
-	"os"
-	"path/filepath"
-	"sync"
 	"time"
 
 	"github.com/sethgrid/multibar"
 
-	"github.com/concurrency-8/args"
+	"github.com/concurrency-8/mse"
 	"github.com/concurrency-8/parser"
 	"github.com/concurrency-8/piece"
 	"github.com/concurrency-8/queue"
+	"github.com/concurrency-8/storage"
 	"github.com/concurrency-8/tracker"
+	"github.com/concurrency-8/utp"
 )
 
 type handler func(tracker.Peer, []byte, net.Conn, *piece.PieceTracker, *queue.Queue, *tracker.ClientStatusReport, Log) error
@@ -33,13 +31,24 @@ var MaxTryForTCP = 2
 // TCPTimeout is the maximum time for which one must wait for connection to a peer
 var TCPTimeout time.Duration = 60
 
-// ReadTimeout is the maximum time for which one must wait for the nect message from the peer. If no message arrives till this point, handshake again
-var ReadTimeout time.Duration = 60
+// UTP enables outgoing uTP connections to peers in DefaultConfig. TCP is used if the peer does not answer
+// over uTP within UTPTimeout, so it is off by default: most peers only listen on TCP
+var UTP = false
 
-// MaxTimeoutErrorCount is the maximum number of times we try to read from a conn before restarting it and get a timeout error(ReadTimeout)
-var MaxTimeoutErrorCount = 3
+// UTPTimeout is the maximum time for which one must wait for a uTP connection to a peer
+var UTPTimeout time.Duration = 5
 
-var wg sync.WaitGroup
+// StorageKind is the storage used for new torrents
+var StorageKind = storage.Files
+
+// AllocationMode is how the files of new torrents are allocated on disk
+var AllocationMode = storage.None
+
+// CacheSize is the size in bytes of the write-back cache of every torrent on disk. 0 disables the cache
+var CacheSize int64 = 32 << 20
+
+// EncryptionPolicy tells if connections to peers use Message Stream Encryption, in DefaultConfig
+var EncryptionPolicy = mse.Prefer
 
 // Log is the logger for current torrent
 type Log struct {
@@ -47,133 +56,173 @@ type Log struct {
 	Error *log.Logger
 }
 
-// DownloadFromFile downloads torrent from path using port
-func DownloadFromFile(path string, port int, bar *multibar.ProgressFunc) {
-
-	// Set up logs
-	logFolder := filepath.Join("Logs", path)
-	os.MkdirAll(logFolder, os.ModePerm)
-	logFile, _ := os.Create(filepath.Join(logFolder, "Download.log"))
-
-	Log := Log{}
-	Log.Info = log.New(logFile, "INFO ", log.Ldate|log.Ltime|log.Lshortfile)
-	Log.Error = log.New(logFile, "ERROR ", log.Ldate|log.Ltime|log.Lshortfile)
+// DownloadFromFile downloads torrent from path using port, in the default session.
+// It returns why the download failed, see the errors of Session
+func DownloadFromFile(path string, port int, bar *multibar.ProgressFunc) error {
+	return DownloadFromFileContext(context.Background(), path, port, bar)
+}
 
-	torrentFile, err := parser.ParseFromFile(path)
+// DownloadFromFileContext is DownloadFromFile that stops when ctx ends. The announce is abandoned,
+// the peer connections are closed and the storage is flushed before the error of ctx is returned
+func DownloadFromFileContext(ctx context.Context, path string, port int, bar *multibar.ProgressFunc) error {
+	t, err := defaultSession().addTorrent(ctx, path, port)
 	if err != nil {
-		Log.Error.Println("Unable to open torrentfile", err)
-		panic(err)
-	}
-	Log.Info.Println("TorrentFile parsed")
-
-	// Generate client status report
-	clientReport := tracker.GetClientStatusReport(torrentFile, uint16(port))
-
-	// Getting peer list from one announce url only for now.
-	var announceResp *tracker.AnnounceResponse
-	for _, announceURL := range torrentFile.Announce {
-		u, err := url.Parse(announceURL)
-		if err != nil {
-			panic(err)
-		}
-		Log.Info.Println("Contacting tracker[", announceURL, "] for peer list...")
-		count := 0
-		for count < MaxTryTracker {
-			count++
-			announceResp, err = tracker.GetPeers(u, clientReport)
-			if err == nil {
-				break
-			}
-			Log.Info.Println("Failed(", err, "). Trying again...")
-		}
-		if err == nil {
-			break
-		}
+		return err
 	}
-
-	if announceResp == nil {
-		panic("Unable to receive peers! Problem with the torrent or internet")
-	}
-
-	pieceTracker := piece.NewPieceTracker(torrentFile)
-	if args.ARGS.Resume {
-		readGob(torrentFile.Name+"/resume.gob", &pieceTracker.Received, Log)
-		readGob(torrentFile.Name+"/resume.gob", &pieceTracker.Requested, Log)
-	}
-
-	for i := range pieceTracker.Received {
-		temp := true
-		for j := range pieceTracker.Received[i] {
-			temp = temp && pieceTracker.Received[i][j]
-		}
-
-		if !temp {
-			for j := range pieceTracker.Received[i] {
-				pieceTracker.Received[i][j] = false
-			}
+	for done := false; !done; {
+		select {
+		case <-t.Done():
+			done = true
+		case <-time.After(time.Second):
 		}
+		(*bar)(t.Progress())
 	}
-	// DownloadFromPeer(announceResp.Peers[0], clientReport, pieceTracker)
-	wg.Add(len(announceResp.Peers))
-	for _, peer := range announceResp.Peers {
-		Log.Info.Println("Spawning peer thread: peer<", peer, ">")
-		go func(peer tracker.Peer, clientReport *tracker.ClientStatusReport, pieceTracker *piece.PieceTracker) {
-			DownloadFromPeer(peer, clientReport, pieceTracker, Log)
-			defer wg.Done()
-		}(peer, clientReport, pieceTracker)
-	}
-
-	// DownloadFromPeer(announceResp.Peers[0], clientReport, pieceTracker)
-	for !pieceTracker.IsDone() {
-		over := pieceTracker.PrintPercentageDone()
-		(*bar)(over)
-		time.Sleep(1 * time.Second)
-	}
-
-	wg.Wait()
-	pieceTracker.PrintPercentageDone()
-
-	// Close all files
-	for _, file := range clientReport.TorrentFile.Files {
-		file.FilePointer.Close()
-	}
-
-	// Closing log files
-	logFile.Close()
-
-	Log.Info.Println("All peer threads finished!")
+	return t.Err()
 }
 
 // DownloadFromPeer is a function that handshakes with a peer specified by peer object.
 // Concurrently call this function to establish parallel connections to many peers.
+// It reconnects when the connection drops, unless the torrent has a connection manager.
 func DownloadFromPeer(peer tracker.Peer, report *tracker.ClientStatusReport, pieces *piece.PieceTracker, Log Log) error {
+	return DownloadFromPeerContext(context.Background(), peer, report, pieces, Log)
+}
+
+// DownloadFromPeerContext is DownloadFromPeer that closes the connection and returns the error of ctx when ctx ends
+func DownloadFromPeerContext(ctx context.Context, peer tracker.Peer, report *tracker.ClientStatusReport, pieces *piece.PieceTracker, Log Log) error {
 	//safely handle reading using onWholeMessage
 
 	queue := queue.NewQueue(report.TorrentFile)
+	session := sessionOf(pieces)
+	joinQueues(pieces, queue)
+	defer leaveQueues(pieces, queue)
 
 	exitStatus := 1
 	var err error
-	for exitStatus == 1 && err == nil && !pieces.IsDone() {
+	for exitStatus == 1 && err == nil && !pieces.IsDone() && !stopping(pieces) {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if session.Banned(peer) {
+			Log.Info.Println("peer: <", peer, ">: Banned")
+			err = errBanned
+			break
+		}
 		queue.Choked = true
-		conn, err := sendHandshake(peer, report, Log)
+		queue.Snubbed = false
+		queue.Rejected = nil
+		var conn net.Conn
+		conn, err = sendHandshake(ctx, session, peer, report, Log)
 		if err != nil {
 			break
 		}
+		if !addConn(pieces, conn) {
+			conn.Close()
+			break
+		}
+		emit(pieces, Event{Kind: PeerConnected, Peer: peer})
+		queue.LastMessage = time.Now()
+		stopWatching := closeOnDone(ctx, conn)
 		exitStatus, err = onWholeMessage(peer, conn, msgHandler, pieces, queue, report, Log)
+		stopWatching()
+		conn.Close()
+		removeConn(pieces, conn)
+		leaveSwarm(pieces, conn)
+		// requests on a closed connection will never be answered
+		releasePending(pieces, queue)
+		emit(pieces, Event{Kind: PeerDisconnected, Peer: peer, Err: err})
 		if err != nil {
 			break
 		}
+		if managed(pieces) {
+			// the connection manager reconnects after a backoff
+			break
+		}
 	}
 
+	releaseSuspects(pieces, peer)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	Log.Info.Println("peer: <", peer, ">: ends!")
 	return err
 }
 
-func sendHandshake(peer tracker.Peer, report *tracker.ClientStatusReport, Log Log) (conn net.Conn, err error) {
-	buffer, err := BuildHandshake(*report)
+// closeOnDone closes conn when ctx ends, which unblocks its reads and writes. The returned function stops watching ctx
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+// sendHandshake connects to the peer with the settings of the session and sends our handshake
+func sendHandshake(ctx context.Context, session *Session, peer tracker.Peer, report *tracker.ClientStatusReport, Log Log) (conn net.Conn, err error) {
+	config := &session.config
+	buffer, err := buildHandshake(*report, config.FastExtension)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err = dialPeer(ctx, session, peer, Log)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.EncryptionPolicy != mse.Disabled {
+		Log.Info.Println("peer: <", peer, ">: Encryption handshake")
+		conn.SetDeadline(time.Now().Add(TCPTimeout * time.Second))
+		stopWatching := closeOnDone(ctx, conn)
+		encrypted, err := mse.Initiate(conn, []byte(report.TorrentFile.InfoHash), config.EncryptionPolicy, buffer.Bytes())
+		stopWatching()
+		if ctx.Err() != nil {
+			conn.Close()
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+			Log.Info.Println("peer: <", peer, ">: Encrypted connection, crypto method", encrypted.Selected)
+			return newPeerConn(encrypted, session, report), nil
+		}
+		conn.Close()
+		if config.EncryptionPolicy == mse.Require {
+			Log.Error.Println("peer: <", peer, ">: Encryption handshake failed:", err)
+			return nil, err
+		}
+		Log.Info.Println("peer: <", peer, ">: Encryption handshake failed (", err, "). Falling back to plaintext")
+		conn, err = dialPeer(ctx, session, peer, Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	Log.Info.Println("peer: <", peer, ">: Handshaking")
+
+	//write the handshake content into the connection.
+	_, err = conn.Write(buffer.Bytes())
 	if err != nil {
 		return nil, err
 	}
+
+	return newPeerConn(conn, session, report), nil
+}
+
+// dialPeer sets up a connection to the peer within the half-open limit of the session.
+// uTP is tried first if the session enables it, then TCP
+func dialPeer(ctx context.Context, session *Session, peer tracker.Peer, Log Log) (conn net.Conn, err error) {
+	release, err := session.conns.acquireHalfOpen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer func() {
+		if err == nil {
+			session.conns.learnLocalIP(conn)
+		}
+	}()
 	peerip := make([]byte, 4)
 	binary.BigEndian.PutUint32(peerip, peer.IPAdress)
 	service := net.TCPAddr{
@@ -181,13 +230,26 @@ func sendHandshake(peer tracker.Peer, report *tracker.ClientStatusReport, Log Lo
 		Port: int(peer.Port),
 		Zone: "",
 	}
+	if session.config.UTP {
+		Log.Info.Println("peer: <", peer, ">: Dialing uTP connection")
+		utpCtx, cancel := context.WithTimeout(ctx, UTPTimeout*time.Second)
+		conn, err = utp.DialContext(utpCtx, service.String())
+		cancel()
+		if err == nil {
+			Log.Info.Println("peer: <", peer, ">: Successfully connected to Peer over uTP")
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		Log.Info.Println("peer: <", peer, ">: Unable to set up uTP connection (", err, "). Falling back to TCP")
+	}
 	Log.Info.Println("peer: <", peer, ">: Dialing TCP connection")
 	d := net.Dialer{Timeout: TCPTimeout * time.Second}
-	err = nil
 	count := 0
-	for count < MaxTryForTCP {
+	for count < MaxTryForTCP && ctx.Err() == nil {
 		count++
-		conn, err = d.Dial("tcp", service.String())
+		conn, err = d.DialContext(ctx, "tcp", service.String())
 		if err != nil {
 			Log.Info.Println("peer: <", peer, ">: Unable to set up TCP connection: ", count)
 		} else {
@@ -200,14 +262,6 @@ func sendHandshake(peer tracker.Peer, report *tracker.ClientStatusReport, Log Lo
 		Log.Error.Println("peer: <", peer, ">: Could not connect to peer!")
 		return nil, err
 	}
-	Log.Info.Println("peer: <", peer, ">: Handshaking")
-
-	//write the handshake content into the connection.
-	_, err = conn.Write(buffer.Bytes())
-	if err != nil {
-		return nil, err
-	}
-
 	return conn, nil
 }
 
@@ -216,6 +270,21 @@ func msgHandler(peer tracker.Peer, msg []byte, conn net.Conn, pieces *piece.Piec
 
 	if (len(msg) == int(uint8(msg[0]))+49) && (bytes.Equal(msg[1:20], []byte("BitTorrent protocol"))) {
 		Log.Info.Println("peer: <", peer, ">: Handshake successful")
+		queue.Fast = sessionOf(pieces).config.FastExtension && supportsFast(msg)
+		if pieces != nil {
+			joinSwarm(pieces, peer, conn)
+		}
+		if err := sendBitfield(peer, conn, pieces, queue.Fast, Log); err != nil {
+			Log.Info.Println("peer: <", peer, ">: Error", err.Error())
+			return err
+		}
+		if err := sendMissedHaves(peer, conn, pieces, Log); err != nil {
+			Log.Info.Println("peer: <", peer, ">: Error", err.Error())
+			return err
+		}
+		if queue.Fast {
+			Log.Info.Println("peer: <", peer, ">: Peer supports Fast Extension")
+		}
 		message, err := BuildInterested()
 		if err != nil {
 			Log.Info.Println("peer: <", peer, ">: Error", err.Error())
@@ -224,12 +293,25 @@ func msgHandler(peer tracker.Peer, msg []byte, conn net.Conn, pieces *piece.Piec
 		conn.Write(message.Bytes())
 		// Log.Info.Println("peer: <", peer, ">: Request(", len(message.Bytes()), "): ", message.Bytes())
 	} else {
+		if err := checkMsg(msg, pieces); err != nil {
+			Log.Error.Println("peer: <", peer, ">:", err)
+			return err
+		}
 
-		_, id, payload := ParseMsg(bytes.NewBuffer(msg))
+		size, id, payload := ParseMsg(bytes.NewBuffer(msg))
 
+		if size == 0 {
+			Log.Info.Println("peer: <", peer, ">: Keep-alive")
+			return nil
+		}
 		if id == 0 {
 			Log.Info.Println("peer: <", peer, ">: Choke")
-			ChokeHandler(peer, conn, pieces, report, Log)
+			queue.Choked = true
+			if !queue.Fast {
+				// without the Fast Extension a choke drops all our requests
+				releasePending(pieces, queue)
+			}
+			ChokeHandler(peer, conn, pieces, Log)
 		}
 		if id == 1 {
 			Log.Info.Println("peer: <", peer, ">: Unchoke")
@@ -251,6 +333,39 @@ func msgHandler(peer tracker.Peer, msg []byte, conn net.Conn, pieces *piece.Piec
 				Bytes: payload["block"].(*bytes.Buffer).Bytes(),
 			}, Log)
 		}
+		if id == 6 {
+			Log.Info.Println("peer: <", peer, ">: Request")
+			RequestHandler(peer, conn, queue, requestedBlock(payload), Log)
+		}
+		if id == 8 {
+			// requests are never queued, there is nothing to cancel
+			Log.Info.Println("peer: <", peer, ">: Cancel")
+		}
+		if id >= 13 && id <= 17 && !queue.Fast {
+			err := fmt.Errorf("%w: Fast Extension message %d without the Fast Extension", ErrBadMessage, id)
+			Log.Error.Println("peer: <", peer, ">:", err)
+			return err
+		}
+		if id == 13 {
+			Log.Info.Println("peer: <", peer, ">: Suggest Piece")
+			SuggestHandler(peer, conn, pieces, queue, payload, Log)
+		}
+		if id == 14 {
+			Log.Info.Println("peer: <", peer, ">: Have All")
+			HaveAllHandler(peer, conn, pieces, queue, Log)
+		}
+		if id == 15 {
+			Log.Info.Println("peer: <", peer, ">: Have None")
+			HaveNoneHandler(peer, Log)
+		}
+		if id == 16 {
+			Log.Info.Println("peer: <", peer, ">: Reject Request")
+			RejectHandler(peer, conn, pieces, queue, requestedBlock(payload), Log)
+		}
+		if id == 17 {
+			Log.Info.Println("peer: <", peer, ">: Allowed Fast")
+			AllowedFastHandler(peer, conn, pieces, queue, payload, Log)
+		}
 	}
 
 	return nil
@@ -263,24 +378,28 @@ func onWholeMessage(peer tracker.Peer, conn net.Conn, msgHandler handler, pieces
 	handshake := true
 	resp := make([]byte, 1000)
 	msgLen := -1
-	count := 0
 	for pieces != nil && !pieces.IsDone() {
-		conn.SetReadDeadline(time.Now().Add(ReadTimeout * time.Second)) // Setting Read deadline from a connection
+		if sessionOf(pieces).Banned(peer) {
+			conn.Close()
+			return 1, errBanned
+		}
+		if err = checkActivity(peer, pieces, queue, Log); err != nil {
+			Log.Info.Println("peer: <", peer, ">: Dropping peer:", err)
+			conn.Close()
+			return 1, err
+		}
+		conn.SetReadDeadline(time.Now().Add(IdleCheckInterval * time.Second)) // Setting Read deadline from a connection
 		respLen, err := conn.Read(resp)
 		//Please look for a better connection handling in the future.
 		//Maybe use defer?
 
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !handshake {
-				count++
-				if count < MaxTimeoutErrorCount {
-					Log.Info.Println("Timeout error - Try again")
-					continue
-				} else {
-					Log.Info.Println("peer: <", peer, ">: Many timeout errors - Peer not responding. Should try to reconnect")
-					conn.Close()
-					return 1, err
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if !handshake && len(queue.Pending) == 0 && queue.Length() > 0 {
+					// requesting may have stopped because all piece buffers were taken
+					RequestPiece(peer, conn, pieces, queue, Log)
 				}
+				continue
 			} else {
 				Log.Error.Println("peer: <", peer, ">: Error while reading from connection: ", err)
 				Log.Info.Println("peer: <", peer, ">: Restarting connection")
@@ -289,13 +408,14 @@ func onWholeMessage(peer tracker.Peer, conn net.Conn, msgHandler handler, pieces
 			}
 		}
 
+		queue.LastMessage = time.Now()
 		binary.Write(buffer, binary.BigEndian, resp[:respLen])
 
 		if handshake {
 			Log.Info.Println("peer: <", peer, ">: First message from peer after connection starts - Must be handshake")
 			length := uint8((buffer.Bytes())[0])
 			msgLen = int(length) + 49
-		} else if msgLen == -1 {
+		} else if msgLen == -1 && len(buffer.Bytes()) >= 4 {
 			length := binary.BigEndian.Uint32(buffer.Bytes()[0:4])
 			// length := uint32((buffer.Bytes())[0:4])
 			msgLen = int(length) + 4
@@ -308,11 +428,15 @@ func onWholeMessage(peer tracker.Peer, conn net.Conn, msgHandler handler, pieces
 			messageBytes := make([]byte, msgLen)
 			binary.Read(buffer, binary.BigEndian, messageBytes)
 			// Log.Info.Println("peer: <", peer, ">: msgLen:", msgLen)
-			msgHandler(peer, messageBytes, conn, pieces, queue, report, Log)
+			if err = msgHandler(peer, messageBytes, conn, pieces, queue, report, Log); err != nil {
+				Log.Info.Println("peer: <", peer, ">: Dropping peer:", err)
+				conn.Close()
+				return 1, err
+			}
 			Log.Info.Println("peer: <", peer, ">: Message handled - setting msgLen = -1")
 			msgLen = -1
 			handshake = false
-			if len(buffer.Bytes()) > 4 {
+			if len(buffer.Bytes()) >= 4 {
 				length := binary.BigEndian.Uint32(buffer.Bytes()[0:4])
 				msgLen = int(length) + 4
 				Log.Info.Println("peer: <", peer, ">: New message was in previous one - msgLen =", msgLen)
@@ -323,26 +447,23 @@ func onWholeMessage(peer tracker.Peer, conn net.Conn, msgHandler handler, pieces
 	return 0, nil
 }
 
-// ChokeHandler handles choking protocol
-func ChokeHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, report *tracker.ClientStatusReport, Log Log) {
+// ChokeHandler handles choking protocol. The connection is kept until the peer unchokes us,
+// unless all pieces are done
+func ChokeHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, Log Log) {
 	Log.Info.Println("peer:<", peer, ">: Choke")
 	if pieces != nil && pieces.IsDone() {
 		Log.Info.Println("All pieces done. Closing connection.")
 		conn.Close()
-	} else if report != nil {
-		Log.Info.Println("peer: <", peer, ">: Handshaking again")
-		// time.Sleep(2 * time.Second) // Sleep for 2 seconds and try handshaking again
-		handshake, err := BuildHandshake(*report)
-		if err != nil {
-			panic("Problem with the torrentFile")
-		} else {
-			conn.Write(handshake.Bytes())
-		}
 	}
 }
 
 // UnchokeHandler handles unchoking protocol
 func UnchokeHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, queue *queue.Queue, Log Log) {
+	if queue.Choked {
+		// data is expected from now on, and rejected blocks may be requested again
+		queue.LastPiece = time.Now()
+		queue.Rejected = nil
+	}
 	if queue.Choked && queue.Length() != 0 {
 		Log.Info.Println("peer:<", peer, "> Unchoke: queue was choked, but queue was non-empty")
 		queue.Choked = false
@@ -367,6 +488,7 @@ func UnchokeHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker
 func HaveHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, queue *queue.Queue, payload Payload, Log Log) (pieceIndex uint32, err error) {
 	binary.Read(payload["payload"].(*bytes.Buffer), binary.BigEndian, &pieceIndex)
 	queueempty := (queue.Length() == 0)
+	queue.Have[pieceIndex] = true
 	err = queue.Enqueue(pieceIndex)
 	if err != nil {
 		return
@@ -385,6 +507,7 @@ func BitFieldHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracke
 	for i, bytevalue := range msg.(*bytes.Buffer).Bytes() {
 		for j := 7; j >= 0; j-- {
 			if 1 == bytevalue&1 {
+				queue.Have[uint32(i*8+j)] = true
 				err = queue.Enqueue(uint32(i*8 + j))
 			}
 			bytevalue = bytevalue >> 1
@@ -400,73 +523,69 @@ func BitFieldHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracke
 
 // PieceHandler - TODO Write comment
 func PieceHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, queue *queue.Queue, report *tracker.ClientStatusReport, pieceResp parser.PieceBlock, Log Log) {
-	pieces.AddReceived(pieceResp)
-
-	Log.Info.Println("peer: <", peer, ">: Received piece[", pieceResp.Index, "] [", pieceResp.Begin/parser.BLOCK_LEN, "]")
-	report.Data[pieceResp.Index].Blocks[pieceResp.Begin/parser.BLOCK_LEN] = pieceResp
-
-	toSHA1 := func(data []byte) []byte {
-		hash := sha1.New()
-		hash.Write(data)
-		return hash.Sum(nil)
+	if !removePending(queue, pieceResp) {
+		// only requested blocks take a buffer
+		Log.Info.Println("peer: <", peer, ">: Dropping unrequested block piece[", pieceResp.Index, "] [", pieceResp.Begin/parser.BLOCK_LEN, "]")
+		return
 	}
-	var piece []byte
-	if pieces.PieceIsDone(pieceResp.Index) {
-		for _, i := range report.Data[pieceResp.Index].Blocks {
-			if len(i.Bytes) != 0 {
-				piece = append(piece, i.Bytes...)
-			}
-		}
-		// numZeros := int(report.TorrentFile.PieceLength) - len(piece)
-		// for i := 0; i < numZeros; i++ {
-		// 	piece = append(piece, byte(0))
-		// }
-		same := true
-		expected := report.TorrentFile.Piece[pieceResp.Index*20 : (pieceResp.Index+1)*20]
-		actual := toSHA1(piece)
-		for i := range expected {
-			same = same && expected[i] == actual[i]
-		}
-		if !same {
-			Log.Error.Println("peer: <", peer, ">: SHA do not match for piece:", pieceResp.Index)
-			Log.Error.Println("peer: <", peer, ">: Expected:\t", report.TorrentFile.Piece[pieceResp.Index*20:(pieceResp.Index+1)*20])
-			Log.Error.Println("peer: <", peer, ">: Actual:\t", toSHA1(piece))
-			report.Data[pieceResp.Index].Blocks[pieceResp.Begin/parser.BLOCK_LEN] = parser.PieceBlock{}
-
-			pieces.Reset(pieceResp.Index)
-			queue.Enqueue(pieceResp.Index)
-			Log.Info.Println("peer: <", peer, ">: Reset queue and pieceTracker for", pieceResp.Index)
-			RequestPiece(peer, conn, pieces, queue, Log)
-			return
-		}
-		Log.Info.Println("peer: <", peer, ">: Piece[", pieceResp.Index, "] downloaded SUCCESSFULLY!")
-	}
-
-	// Log.Info.Println("Bytes Received : ", pieceResp.Bytes)
-
-	offsetInFile := uint64(pieceResp.Index)*uint64(report.TorrentFile.PieceLength) + uint64(pieceResp.Begin)
-	file := report.TorrentFile.Files[0].FilePointer
-	for key, value := range report.TorrentFile.Files {
-		if offsetInFile > value.Length {
-			offsetInFile -= value.Length
-			file = report.TorrentFile.Files[key+1].FilePointer
-		} else {
-			break
-		}
+	// The block is checked, buffered and counted at once: in endgame two peers may send it,
+	// only one of them adds it, and only the one completing the piece has it hashed
+	index := pieceResp.Index
+	pieces.Lock.Lock()
+	if pieces.BlockReceived(index, pieceResp.Begin/parser.BLOCK_LEN) {
+		pieces.Lock.Unlock()
+		// the piece may be verified and its buffer freed already
+		Log.Info.Println("peer: <", peer, ">: Duplicate block piece[", index, "] [", pieceResp.Begin/parser.BLOCK_LEN, "]")
+		RequestPiece(peer, conn, pieces, queue, Log)
+		return
+	}
+	if !pieces.Buffers.Add(pieceResp) {
+		// the block is requested again once a buffer is free
+		pieces.RemoveRequested(pieceResp)
+		pieces.Lock.Unlock()
+		Log.Info.Println("peer: <", peer, ">: No buffer for piece[", index, "]")
+		queue.Enqueue(index)
+		RequestPiece(peer, conn, pieces, queue, Log)
+		return
+	}
+	pieces.AddReceived(pieceResp)
+	recordSender(pieces, pieceResp, peer)
+	completed := pieces.PieceReceived(index)
+	var data []byte
+	var senders []uint32
+	if completed {
+		// the buffer is not changed until the piece is verified or reset
+		data = pieces.Buffers.Piece(index)
+		senders = takeSenders(pieces, index)
 	}
-	Log.Info.Println("peer: <", peer, ">: Writing block to file ", file.Name())
-	file.WriteAt(pieceResp.Bytes, int64(offsetInFile))
-	if args.ARGS.ResumeCapability {
-		writeGob(report.TorrentFile.Name+"/resume.gob", pieces.Received, Log)
+	pieces.Lock.Unlock()
+	queue.LastPiece = time.Now()
+	if queue.Snubbed {
+		Log.Info.Println("peer: <", peer, ">: No longer snubbed")
+		queue.Snubbed = false
 	}
 
-	// file.Sync()
-	pieces.PrintPercentageDone()
+	Log.Info.Println("peer: <", peer, ">: Received piece[", index, "] [", pieceResp.Begin/parser.BLOCK_LEN, "]")
+
+	if completed {
+		expected := report.TorrentFile.Piece[index*20 : (index+1)*20]
+		submitHash(pieces, data, expected, func(ok bool) {
+			if ok {
+				hashPassed(pieces, index, data, senders, Log)
+				// the disk must not hold up the hash workers
+				submitWrite(pieces, func() {
+					pieceVerified(peer, pieces, report, index, data, Log)
+				})
+			} else {
+				Log.Error.Println("peer: <", peer, ">: SHA do not match for piece:", index)
+				hashFailed(pieces, index, data, senders, Log)
+				pieceFailed(peer, pieces, index, Log)
+				emit(pieces, Event{Kind: PieceFailed, Peer: peer, Piece: index, Err: ErrHashMismatch})
+			}
+		})
+	}
 
 	if pieces.IsDone() {
-		for _, file := range report.TorrentFile.Files {
-			defer file.FilePointer.Close()
-		}
 		Log.Info.Println("peer: <", peer, ">: Done")
 		conn.Close()
 	} else {
@@ -475,29 +594,98 @@ func PieceHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker,
 	}
 }
 
+// pieceVerified writes a verified piece to storage and announces it. It runs on the writer of the torrent
+func pieceVerified(peer tracker.Peer, pieces *piece.PieceTracker, report *tracker.ClientStatusReport, index uint32, data []byte, Log Log) {
+	Log.Info.Println("peer: <", peer, ">: Piece[", index, "] downloaded SUCCESSFULLY!")
+
+	// Only verified pieces reach the storage, their buffer is freed afterwards
+	Log.Info.Println("peer: <", peer, ">: Writing piece to storage")
+	if _, err := report.Storage.WriteAt(data, index, 0); err != nil {
+		Log.Error.Println("peer: <", peer, ">: Unable to write piece:", err)
+		if storage.IsDiskFull(err) {
+			Log.Error.Println("peer: <", peer, ">: Disk is full - pausing the torrent")
+			pause(pieces, err)
+		}
+		pieceFailed(peer, pieces, index, Log)
+		emit(pieces, Event{Kind: PieceFailed, Peer: peer, Piece: index, Err: err})
+		return
+	}
+	pieces.Buffers.Release(index)
+	if err := report.Storage.MarkComplete(index); err != nil {
+		Log.Error.Println("peer: <", peer, ">: Unable to complete piece:", err)
+	}
+	pieces.MarkVerified(index)
+	broadcastHave(pieces, index, Log)
+	moveCompleted(report, pieces, pieceFiles(report.TorrentFile, index), Log)
+	emit(pieces, Event{Kind: PieceVerified, Peer: peer, Piece: index})
+	emitCompletedFiles(report, pieces, index)
+}
+
+// pieceFailed drops a piece that could not be verified or stored. It is requested again from the
+// connected peers having it, the peer that sent it may have left or been banned meanwhile
+func pieceFailed(peer tracker.Peer, pieces *piece.PieceTracker, index uint32, Log Log) {
+	pieces.Buffers.Release(index)
+	pieces.Reset(index)
+	requeue(pieces, index)
+	Log.Info.Println("peer: <", peer, ">: Reset queue and pieceTracker for", index)
+}
+
 // RequestPiece requests a piece
 func RequestPiece(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, queue *queue.Queue, Log Log) (err error) {
-	if queue.Choked {
+	for _, index := range takeRetries(pieces, queue) {
+		if queue.Has(index) {
+			queue.Enqueue(index)
+		}
+	}
+	if queue.Choked && !queue.Fast {
 		Log.Error.Println("peer: <", peer, ">: Queue is choked")
 		return
 	}
+	if queue.Snubbed && len(queue.Pending) > 0 {
+		Log.Info.Println("peer: <", peer, ">: Snubbed - waiting for the outstanding request")
+		return
+	}
+	if reason := pauseReason(pieces); reason != nil {
+		Log.Info.Println("peer: <", peer, ">: Torrent paused -", reason)
+		return
+	}
 
+	// While choked only allowed fast pieces may be requested. A new piece is only started if
+	// there is a free buffer for it. Pieces of skipped files are never requested, and a suspect
+	// piece only from the peer downloading it again. Rejected blocks wait for the next unchoke
+	requestable := func(block parser.PieceBlock) bool {
+		return (!queue.Choked || queue.AllowedFast[block.Index]) && pieces.Buffers.Available(block.Index) &&
+			mayRequest(pieces, block.Index, peer) && !rejected(queue, block)
+	}
+	dequeue := queue.DequeueWhere
+	if sessionOf(pieces).config.Sequential {
+		dequeue = queue.DequeueLowest
+	}
 	for queue.Length() > 0 {
-		pieceBlock, err := queue.Peek()
-
-		if err != nil {
-			break
+		pieces.Lock.Lock()
+		var pieceBlock parser.PieceBlock
+		err := fmt.Errorf("Nothing to request")
+		// Blocks of higher priority pieces first
+		for priority := piece.High; priority > piece.Skip && err != nil; priority-- {
+			pieceBlock, err = dequeue(func(block parser.PieceBlock) bool {
+				return pieces.PiecePriority(block.Index) == priority && requestable(block)
+			})
 		}
-
-		err = queue.Dequeue()
-
 		if err != nil {
-			break
+			pieces.Lock.Unlock()
+			Log.Info.Println("peer: <", peer, ">: Nothing to request - choked, piece buffers full or pieces not wanted")
+			return nil
 		}
 
-		pieces.Lock.Lock()
 		if pieces.Needed(pieceBlock) {
+			if !pieces.Buffers.Reserve(pieceBlock.Index) {
+				// the last buffer was taken meanwhile
+				pieces.Lock.Unlock()
+				queue.Enqueue(pieceBlock.Index)
+				return nil
+			}
 			pieces.AddRequested(pieceBlock)
+			claimSuspect(pieces, pieceBlock.Index, peer)
 			pieces.Lock.Unlock()
 			Log.Info.Println("peer: <", peer, ">: Requesting piece[", pieceBlock.Index, "][", pieceBlock.Begin/parser.BLOCK_LEN, "]")
 			message, err := BuildRequest(pieceBlock)
@@ -513,6 +701,10 @@ func RequestPiece(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker,
 				queue.Enqueue(pieceBlock.Index)
 				break
 			}
+			if len(queue.Pending) == 0 {
+				queue.LastPiece = time.Now()
+			}
+			queue.Pending = append(queue.Pending, pieceBlock)
 			break
 		} else {
 			pieces.Lock.Unlock()
@@ -520,23 +712,3 @@ func RequestPiece(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker,
 	}
 	return
 }
-
-func writeGob(filePath string, object interface{}, Log Log) error {
-	file, err := os.Create(filePath)
-	if err == nil {
-		encoder := gob.NewEncoder(file)
-		encoder.Encode(object)
-	}
-	file.Close()
-	return err
-}
-
-func readGob(filePath string, object interface{}, Log Log) error {
-	file, err := os.Open(filePath)
-	if err == nil {
-		decoder := gob.NewDecoder(file)
-		err = decoder.Decode(object)
-	}
-	file.Close()
-	return err
-}
@@ -2,18 +2,24 @@ package torrent
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
 	"os"
 	"sync"
+	"syscall"
 	"testing"
 
+	"github.com/concurrency-8/args"
 	"github.com/concurrency-8/parser"
 	"github.com/concurrency-8/piece"
 	"github.com/concurrency-8/queue"
+	"github.com/concurrency-8/storage"
 	"github.com/concurrency-8/tracker"
 	"github.com/stretchr/testify/assert"
 )
@@ -101,16 +107,41 @@ func TestDownload(t *testing.T) {
 }
 */
 
-// TestChokeHandler tests handling choking protocol - TODO : Adapt to the new function
-// The new function tries to handshake again, just in case the peer decides to unchoke
-// func TestChokeHandler(t *testing.T) {
-// 	client, _ := net.Pipe()
+// TestChokeHandler checks that a choke keeps the connection without sending anything
+func TestChokeHandler(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	queue := queue.NewQueue(parser.TorrentFile{})
+	queue.Choked = false
+	choke, _ := BuildChoke()
+	assert.Nil(t, msgHandler(tracker.Peer{}, choke.Bytes(), server, nil, queue, getRandomClientReport(), getLog()))
+	assert.True(t, queue.Choked)
 
-// 	ChokeHandler(tracker.Peer{}, client, nil, nil)
+	server.Close()
+	_, err := client.Read(make([]byte, 68))
+	assert.Equal(t, io.EOF, err, "Handshake sent again on choke")
+}
 
-// 	_, err := client.Read(make([]byte, 4))
-// 	assert.Equal(t, err, fmt.Errorf("io: read/write on closed pipe"), "ChokeHandler failed")
-// }
+// TestTruncatedMessages checks that messages too short for their id drop the peer instead of panicking
+func TestTruncatedMessages(t *testing.T) {
+	report, pieces, _ := getReaderTorrent()
+	queue := queue.NewQueue(report.TorrentFile)
+	queue.Fast = true
+	for _, message := range [][]byte{
+		{0, 0, 0, 1, 4},                         // have without index
+		{0, 0, 0, 1, 13},                        // suggest without index
+		{0, 0, 0, 1, 17},                        // allowed fast without index
+		{0, 0, 0, 3, 16, 0, 0},                  // reject without begin and length
+		{0, 0, 0, 5, 7, 0, 0, 0, 0},             // piece without begin
+		{0, 0, 0, 7, 6, 0, 0, 0, 0, 0, 0},       // request without length
+		{0, 0, 0, 9, 7, 0, 0, 0, 9, 0, 0, 0, 0}, // piece out of range
+		{0, 0, 0, 9, 4},                         // shorter than its length
+	} {
+		ParseMsg(bytes.NewBuffer(message))
+		err := msgHandler(tracker.Peer{}, message, nil, pieces, queue, report, getLog())
+		assert.True(t, errors.Is(err, ErrBadMessage), "Message %v not refused", message)
+	}
+}
 
 // TestUnchokeHandler tests handling of unchoking protocol
 func TestUnChokeHandler(t *testing.T) {
@@ -126,7 +157,7 @@ func TestRequestPiece(t *testing.T) {
 	pieces := piece.NewPieceTracker(file)
 	queue := queue.NewQueue(file)
 	queue.Choked = false
-	pieceBlock := parser.RandomPieceBlock(file)
+	pieceBlock, _ := parser.RandomPieceBlock(file)
 	queue.Enqueue(pieceBlock.Index)
 	length := queue.Length()
 	client, server := net.Pipe()
@@ -158,7 +189,7 @@ func TestHaveHandler(t *testing.T) {
 	pieces := piece.NewPieceTracker(file)
 	queue := queue.NewQueue(file)
 	queue.Choked = false
-	pieceBlock := parser.RandomPieceBlock(file)
+	pieceBlock, _ := parser.RandomPieceBlock(file)
 	client, server := net.Pipe()
 	actualsamplemsg, err := BuildHave(pieceBlock.Index)
 	assert.Nil(t, err, "error writing to Buffer in BuildHave")
@@ -189,7 +220,7 @@ func TestHaveHandler(t *testing.T) {
 	pieceIndex, err = HaveHandler(tracker.Peer{}, client, pieces, queue, payload, getLog())
 	assert.Nil(t, err, "Error in HaveHandler")
 	assert.Equal(t, pieceBlock.Index, pieceIndex, "Piece Index doesn't match.")
-	assert.True(t, pieces.Requested[pieceBlock.Index][0], "Requested not set.")
+	assert.True(t, pieces.BlockRequested(pieceBlock.Index, 0), "Requested not set.")
 }
 
 func TestBitFieldHandler(t *testing.T) {
@@ -255,3 +286,232 @@ func TestBitFieldHandler(t *testing.T) {
 	}
 
 }
+
+// TestRequestPieceBufferCap checks that no new piece is started while all piece buffers are taken
+func TestRequestPieceBufferCap(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	pieces := piece.NewPieceTracker(file)
+	pieces.Buffers.Max = 1
+	queue := queue.NewQueue(file)
+	queue.Choked = false
+	queue.Enqueue(0)
+	queue.Enqueue(1)
+	blocks, _ := parser.BlocksPerPiece(file, 0)
+
+	client, server := net.Pipe()
+	go func() {
+		for i := uint32(0); i < blocks+1; i++ {
+			RequestPiece(tracker.Peer{}, server, pieces, queue, getLog())
+		}
+		pieces.Buffers.Release(0)
+		RequestPiece(tracker.Peer{}, server, pieces, queue, getLog())
+		server.Close()
+	}()
+
+	for i := uint32(0); i < blocks; i++ {
+		resp := make([]byte, 17)
+		_, err := client.Read(resp)
+		assert.Nil(t, err)
+		_, _, payload := ParseMsg(bytes.NewBuffer(resp))
+		assert.Equal(t, uint32(0), payload["index"].(uint32))
+	}
+	// Piece 1 is only requested once the buffer of piece 0 is released
+	resp := make([]byte, 17)
+	_, err := client.Read(resp)
+	assert.Nil(t, err)
+	_, _, payload := ParseMsg(bytes.NewBuffer(resp))
+	assert.Equal(t, uint32(1), payload["index"].(uint32))
+}
+
+// TestRequestPiecePriority checks that high priority pieces are requested first and skipped ones never
+func TestRequestPiecePriority(t *testing.T) {
+	file := parser.TorrentFile{PieceLength: parser.BLOCK_LEN, Length: uint64(3 * parser.BLOCK_LEN), Piece: make([]byte, 3*20)}
+	length := uint64(parser.BLOCK_LEN)
+	file.Files = []*parser.File{{Length: length}, {Length: length}, {Length: length}}
+	pieces := piece.NewPieceTracker(file)
+	assert.Nil(t, pieces.SetFilePriority(0, piece.Skip))
+	assert.Nil(t, pieces.SetFilePriority(2, piece.High))
+	queue := queue.NewQueue(file)
+	queue.Choked = false
+	for i := uint32(0); i < 3; i++ {
+		queue.Enqueue(i)
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		for i := 0; i < 3; i++ {
+			RequestPiece(tracker.Peer{}, server, pieces, queue, getLog())
+		}
+		server.Close()
+	}()
+
+	for _, index := range []uint32{2, 1} {
+		resp := make([]byte, 17)
+		_, err := client.Read(resp)
+		assert.Nil(t, err)
+		_, _, payload := ParseMsg(bytes.NewBuffer(resp))
+		assert.Equal(t, index, payload["index"].(uint32))
+	}
+	// The skipped piece stays in the queue
+	_, err := client.Read(make([]byte, 17))
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, queue.Length())
+}
+
+// TestPieceHandler checks that a piece is written to storage once verified and its buffer freed
+func TestPieceHandler(t *testing.T) {
+	resume := args.ARGS.ResumeCapability
+	args.ARGS.ResumeCapability = false
+	defer func() { args.ARGS.ResumeCapability = resume }()
+
+	data := getRandomByteArr(uint(2*parser.BLOCK_LEN + 100))
+	file := parser.TorrentFile{PieceLength: 2 * parser.BLOCK_LEN, Length: uint64(len(data))}
+	for begin := 0; begin < len(data); begin += int(file.PieceLength) {
+		end := begin + int(file.PieceLength)
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		file.Piece = append(file.Piece, hash[:]...)
+	}
+	report := &tracker.ClientStatusReport{TorrentFile: file, Storage: storage.NewMemory(file)}
+	pieces := piece.NewPieceTracker(file)
+	queue := queue.NewQueue(file)
+	client, server := net.Pipe()
+	defer client.Close()
+
+	receive := func(block parser.PieceBlock) {
+		queue.Pending = append(queue.Pending, block)
+		PieceHandler(tracker.Peer{}, server, pieces, queue, report, block, getLog())
+	}
+
+	// A block that was not requested is dropped
+	PieceHandler(tracker.Peer{}, server, pieces, queue, report, parser.PieceBlock{Index: 0, Begin: 0, Bytes: data[:parser.BLOCK_LEN]}, getLog())
+	assert.Equal(t, 0, pieces.Buffers.Len(), "Unrequested block buffered")
+
+	receive(parser.PieceBlock{Index: 0, Begin: 0, Bytes: data[:parser.BLOCK_LEN]})
+	assert.Equal(t, 1, pieces.Buffers.Len(), "Block not buffered")
+	receive(parser.PieceBlock{Index: 0, Begin: parser.BLOCK_LEN, Bytes: data[parser.BLOCK_LEN : 2*parser.BLOCK_LEN]})
+	waitHashed(pieces)
+	assert.Equal(t, 0, pieces.Buffers.Len(), "Buffer not released")
+	assert.True(t, pieces.PieceIsDone(0))
+
+	written := make([]byte, 2*parser.BLOCK_LEN)
+	_, err := report.Storage.ReadAt(written, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:2*parser.BLOCK_LEN], written)
+
+	// A piece failing its hash check is not written
+	corrupt := append([]byte(nil), data[2*parser.BLOCK_LEN:]...)
+	corrupt[0]++
+	receive(parser.PieceBlock{Index: 1, Begin: 0, Bytes: corrupt})
+	waitHashed(pieces)
+	assert.False(t, pieces.PieceIsDone(1))
+	assert.Equal(t, 0, pieces.Buffers.Len())
+	written = make([]byte, 100)
+	report.Storage.ReadAt(written, 1, 0)
+	assert.Equal(t, make([]byte, 100), written)
+}
+
+// countingStorage counts the writes of pieces
+type countingStorage struct {
+	storage.Storage
+	lock   sync.Mutex
+	writes int
+}
+
+func (s *countingStorage) WriteAt(p []byte, piece uint32, begin uint32) (int, error) {
+	s.lock.Lock()
+	s.writes++
+	s.lock.Unlock()
+	return s.Storage.WriteAt(p, piece, begin)
+}
+
+// TestPieceHandlerEndgame checks that a block sent by two peers at once is counted once and its piece hashed and written once
+func TestPieceHandlerEndgame(t *testing.T) {
+	data := getRandomByteArr(uint(parser.BLOCK_LEN))
+	hash := sha1.Sum(data)
+	file := parser.TorrentFile{PieceLength: parser.BLOCK_LEN, Length: uint64(len(data)), Piece: hash[:]}
+	for i := 0; i < 20; i++ {
+		backend := &countingStorage{Storage: storage.NewMemory(file)}
+		report := &tracker.ClientStatusReport{TorrentFile: file, Storage: backend}
+		pieces := piece.NewPieceTracker(file)
+		block := parser.PieceBlock{Index: 0, Begin: 0, Bytes: data}
+		var wait sync.WaitGroup
+		for peer := 0; peer < 2; peer++ {
+			queue := queue.NewQueue(file)
+			queue.Pending = []parser.PieceBlock{block}
+			client, server := net.Pipe()
+			defer client.Close()
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				PieceHandler(tracker.Peer{}, server, pieces, queue, report, block, getLog())
+			}()
+		}
+		wait.Wait()
+		waitHashed(pieces)
+		assert.Equal(t, 1, backend.writes)
+		assert.Equal(t, uint64(len(data)), pieces.BytesDone())
+		assert.Equal(t, 1, pieces.PiecesDone())
+		assert.True(t, pieces.IsDone())
+	}
+}
+
+// fullStorage fails every write as a full disk does
+type fullStorage struct {
+	storage.Storage
+}
+
+func (fullStorage) WriteAt(p []byte, piece uint32, begin uint32) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+}
+
+// TestPieceHandlerDiskFull checks that a piece that can not be written is downloaded again and the torrent paused
+func TestPieceHandlerDiskFull(t *testing.T) {
+	data := getRandomByteArr(uint(parser.BLOCK_LEN))
+	hash := sha1.Sum(data)
+	file := parser.TorrentFile{PieceLength: parser.BLOCK_LEN, Length: uint64(len(data)), Piece: hash[:]}
+	report := &tracker.ClientStatusReport{TorrentFile: file, Storage: fullStorage{storage.NewMemory(file)}}
+	pieces := piece.NewPieceTracker(file)
+	queue := queue.NewQueue(file)
+	queue.Choked = false
+	queue.Have[0] = true
+	joinQueues(pieces, queue)
+	defer forgetRetries(pieces)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer unpause(pieces)
+
+	block := parser.PieceBlock{Index: 0, Begin: 0, Bytes: data}
+	queue.Pending = []parser.PieceBlock{block}
+	PieceHandler(tracker.Peer{}, server, pieces, queue, report, block, getLog())
+	waitHashed(pieces)
+	assert.True(t, storage.IsDiskFull(pauseReason(pieces)))
+	assert.False(t, pieces.PieceIsDone(0))
+	assert.Equal(t, 0, pieces.Buffers.Len())
+
+	// The piece is put back in the queue, but nothing is requested while paused
+	assert.Nil(t, RequestPiece(tracker.Peer{}, server, pieces, queue, getLog()))
+	assert.Equal(t, 1, queue.Length())
+}
+
+// TestPieceHandlerNoBuffer checks that a block arriving while all piece buffers are taken is requested again
+func TestPieceHandlerNoBuffer(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	report := &tracker.ClientStatusReport{TorrentFile: file}
+	pieces := piece.NewPieceTracker(file)
+	pieces.Buffers.Max = 1
+	pieces.Buffers.Reserve(1)
+	queue := queue.NewQueue(file)
+	client, server := net.Pipe()
+	defer client.Close()
+
+	block := parser.PieceBlock{Index: 0, Begin: 0, Bytes: make([]byte, parser.BLOCK_LEN)}
+	pieces.AddRequested(block)
+	queue.Pending = []parser.PieceBlock{block}
+	PieceHandler(tracker.Peer{}, server, pieces, queue, report, block, getLog())
+	assert.False(t, pieces.BlockReceived(0, 0))
+	assert.True(t, pieces.Needed(block))
+	assert.NotEqual(t, 0, queue.Length())
+}
@@ -0,0 +1,266 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/tracker"
+)
+
+// EventKind tells what happened to a torrent
+type EventKind int
+
+const (
+	// MetadataReceived is sent once the torrent file is parsed and the storage is open
+	MetadataReceived EventKind = iota
+	// Announced is the result of an announce to Tracker: the number of Peers given, or Err
+	Announced
+	// PeerConnected is sent once the handshake with Peer is sent
+	PeerConnected
+	// PeerDisconnected is sent when the connection to Peer ends, Err tells why
+	PeerDisconnected
+	// PieceVerified is sent once Piece matches its hash and is written to storage
+	PieceVerified
+	// PieceFailed is sent when Piece does not match its hash (ErrHashMismatch) or can not be written
+	PieceFailed
+	// FileCompleted is sent once every piece of File is verified
+	FileCompleted
+	// TorrentCompleted is sent when the torrent ends once every wanted piece is verified and written
+	TorrentCompleted
+	// TorrentError is sent when the torrent ends with Err
+	TorrentError
+	// TorrentPaused is sent when the torrent stops requesting pieces, Err tells why
+	TorrentPaused
+	// TorrentResumed is sent when a paused torrent requests pieces again
+	TorrentResumed
+)
+
+var eventNames = []string{"metadata received", "announced", "peer connected", "peer disconnected", "piece verified",
+	"piece failed", "file completed", "torrent completed", "torrent error", "torrent paused", "torrent resumed"}
+
+func (kind EventKind) String() string {
+	if kind < 0 || int(kind) >= len(eventNames) {
+		return fmt.Sprintf("EventKind(%d)", int(kind))
+	}
+	return eventNames[kind]
+}
+
+// ErrHashMismatch is the error of a PieceFailed event for a piece that does not match its hash
+var ErrHashMismatch = fmt.Errorf("Piece does not match its hash")
+
+// Event is something that happened to a torrent. Only the fields described by its Kind are set
+type Event struct {
+	Kind    EventKind
+	Torrent *Torrent
+	Tracker string
+	Peers   int
+	Peer    tracker.Peer
+	Piece   uint32
+	File    int
+	Err     error
+}
+
+// Callback receives events. Every callback is called on a goroutine of its own with the events in the
+// order they happened, a slow callback holds up neither the torrent nor the other callbacks
+type Callback func(Event)
+
+// subscribers are the callbacks of a torrent or a session, in the order they subscribed
+type subscribers struct {
+	lock      sync.Mutex
+	next      int
+	callbacks []*subscriber
+	closed    bool
+}
+
+// subscriber queues the events of a callback and delivers them on its goroutine
+type subscriber struct {
+	id       int
+	callback Callback
+	lock     sync.Mutex
+	changed  *sync.Cond
+	queue    []Event
+	busy     bool
+	stopped  bool
+}
+
+func newSubscriber(id int, callback Callback) *subscriber {
+	sub := &subscriber{id: id, callback: callback}
+	sub.changed = sync.NewCond(&sub.lock)
+	go sub.deliver()
+	return sub
+}
+
+// send queues an event for the callback
+func (sub *subscriber) send(event Event) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if !sub.stopped {
+		sub.queue = append(sub.queue, event)
+		sub.changed.Broadcast()
+	}
+}
+
+// stop ends the goroutine of the callback once the queued events are delivered
+func (sub *subscriber) stop() {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	sub.stopped = true
+	sub.changed.Broadcast()
+}
+
+// deliver calls the callback with the queued events until it is stopped
+func (sub *subscriber) deliver() {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for {
+		for len(sub.queue) == 0 && !sub.stopped {
+			sub.changed.Wait()
+		}
+		if len(sub.queue) == 0 {
+			return
+		}
+		event := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.busy = true
+		sub.lock.Unlock()
+		sub.callback(event)
+		sub.lock.Lock()
+		sub.busy = false
+		sub.changed.Broadcast()
+	}
+}
+
+// add subscribes callback, which first receives the initial events. The returned function unsubscribes it,
+// the events sent before are still delivered
+func (s *subscribers) add(callback Callback, initial ...Event) func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sub := newSubscriber(s.next, callback)
+	s.next++
+	for _, event := range initial {
+		sub.send(event)
+	}
+	if s.closed {
+		sub.stop()
+		return func() {}
+	}
+	s.callbacks = append(s.callbacks, sub)
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i, other := range s.callbacks {
+			if other == sub {
+				s.callbacks = append(s.callbacks[:i:i], s.callbacks[i+1:]...)
+				sub.stop()
+				return
+			}
+		}
+	}
+}
+
+// call sends event to every callback
+func (s *subscribers) call(event Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, sub := range s.callbacks {
+		sub.send(event)
+	}
+}
+
+// close stops the callbacks once their events are delivered. Callbacks subscribing later only receive their initial events
+func (s *subscribers) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, sub := range s.callbacks {
+		sub.stop()
+	}
+	s.callbacks = nil
+	s.closed = true
+}
+
+// eventSet holds the running torrents of a session by piece tracker, for the events of their peers and pieces
+type eventSet struct {
+	lock     sync.Mutex
+	torrents map[*piece.PieceTracker]*Torrent
+}
+
+func newEventSet() *eventSet {
+	return &eventSet{torrents: make(map[*piece.PieceTracker]*Torrent)}
+}
+
+// registerEvents makes a torrent part of its session and sends the events of its peers and pieces to its subscribers
+func registerEvents(t *Torrent) {
+	attach(t.session, t.pieces)
+	events := t.session.events
+	events.lock.Lock()
+	defer events.lock.Unlock()
+	events.torrents[t.pieces] = t
+}
+
+// forgetEvents stops sending the events of a torrent that ended, and forgets its session
+func forgetEvents(pieces *piece.PieceTracker) {
+	events := sessionOf(pieces).events
+	events.lock.Lock()
+	delete(events.torrents, pieces)
+	events.lock.Unlock()
+	detach(pieces)
+}
+
+// emit sends an event of the torrent of pieces to its subscribers and those of its session.
+// Torrents outside of a session have no subscribers
+func emit(pieces *piece.PieceTracker, event Event) {
+	events := sessionOf(pieces).events
+	events.lock.Lock()
+	t := events.torrents[pieces]
+	events.lock.Unlock()
+	if t != nil {
+		t.emit(event)
+	}
+}
+
+func (t *Torrent) emit(event Event) {
+	event.Torrent = t
+	t.subscribers.call(event)
+	t.session.subscribers.call(event)
+}
+
+// emitCompletedFiles sends FileCompleted for the files of a verified piece that are now complete
+func emitCompletedFiles(report *tracker.ClientStatusReport, pieces *piece.PieceTracker, index uint32) {
+	events := sessionOf(pieces).events
+	events.lock.Lock()
+	t := events.torrents[pieces]
+	events.lock.Unlock()
+	if t == nil {
+		return
+	}
+	for _, file := range pieceFiles(report.TorrentFile, index) {
+		if !fileVerified(report.TorrentFile, pieces, file) {
+			continue
+		}
+		// two pieces of a file may be verified at once, the file is completed once
+		t.lock.Lock()
+		done := t.filesDone[file]
+		t.filesDone[file] = true
+		t.lock.Unlock()
+		if !done {
+			t.emit(Event{Kind: FileCompleted, File: file})
+		}
+	}
+}
+
+// Subscribe calls callback with the events of the torrent. MetadataReceived is sent before the torrent
+// is returned, so callback is first called with it. The returned function unsubscribes it
+func (t *Torrent) Subscribe(callback Callback) func() {
+	return t.subscribers.add(callback, Event{Kind: MetadataReceived, Torrent: t})
+}
+
+// Subscribe calls callback with the events of every torrent of the session, MetadataReceived
+// included: it is first called with it for the torrents added before. The returned function unsubscribes it
+func (session *Session) Subscribe(callback Callback) func() {
+	var added []Event
+	for _, t := range session.Torrents() {
+		added = append(added, Event{Kind: MetadataReceived, Torrent: t})
+	}
+	return session.subscribers.add(callback, added...)
+}
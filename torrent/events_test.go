@@ -0,0 +1,180 @@
+package torrent
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventKind(t *testing.T) {
+	assert.Equal(t, "metadata received", MetadataReceived.String())
+	assert.Equal(t, "torrent resumed", TorrentResumed.String())
+	assert.Equal(t, "EventKind(42)", EventKind(42).String())
+}
+
+// flush waits until the events sent to the callbacks are delivered
+func (s *subscribers) flush() {
+	s.lock.Lock()
+	callbacks := s.callbacks
+	s.lock.Unlock()
+	for _, sub := range callbacks {
+		sub.lock.Lock()
+		for len(sub.queue) > 0 || sub.busy {
+			sub.changed.Wait()
+		}
+		sub.lock.Unlock()
+	}
+}
+
+// kinds returns the kinds of the events received on events until none comes for a while
+func kinds(events chan Event) (result []EventKind) {
+	for {
+		select {
+		case event := <-events:
+			result = append(result, event.Kind)
+		case <-time.After(100 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestSubscribers(t *testing.T) {
+	var s subscribers
+	first, second := make(chan Event, 8), make(chan Event, 8)
+	unsubscribe := s.add(func(event Event) { first <- event }, Event{Kind: MetadataReceived})
+	s.add(func(event Event) { second <- event })
+	s.call(Event{Kind: Announced})
+	unsubscribe()
+	s.call(Event{Kind: PieceVerified})
+	s.close()
+	s.call(Event{Kind: TorrentCompleted})
+	assert.Equal(t, []EventKind{MetadataReceived, Announced}, kinds(first))
+	assert.Equal(t, []EventKind{Announced, PieceVerified}, kinds(second))
+
+	// a closed set only sends the initial events
+	s.add(func(event Event) { first <- event }, Event{Kind: MetadataReceived})
+	assert.Equal(t, []EventKind{MetadataReceived}, kinds(first))
+}
+
+// TestSlowSubscriber checks that a callback that does not return holds up neither the events nor the other callbacks
+func TestSlowSubscriber(t *testing.T) {
+	var s subscribers
+	blocked := make(chan struct{})
+	defer close(blocked)
+	received := make(chan Event, 8)
+	s.add(func(Event) { <-blocked })
+	s.add(func(event Event) { received <- event })
+	s.call(Event{Kind: Announced})
+	s.call(Event{Kind: PieceVerified})
+	assert.Equal(t, []EventKind{Announced, PieceVerified}, kinds(received))
+}
+
+// TestFileCompleted checks that a file is completed once, by the last of its pieces
+func TestFileCompleted(t *testing.T) {
+	report, pieces, _ := getReaderTorrent()
+	torrent := &Torrent{session: newSession(DefaultConfig(), newTorrentSet()), report: report, pieces: pieces, filesDone: make(map[int]bool)}
+	registerEvents(torrent)
+	defer forgetEvents(pieces)
+	var files []int
+	torrent.Subscribe(func(event Event) {
+		if event.Kind == FileCompleted {
+			files = append(files, event.File)
+		}
+	})
+
+	// the first file has pieces 0 to 2, the second pieces 2 and 3
+	for _, index := range []uint32{0, 1, 3, 2} {
+		pieces.MarkVerified(index)
+		emitCompletedFiles(report, pieces, index)
+	}
+	emitCompletedFiles(report, pieces, 2)
+	torrent.subscribers.flush()
+	assert.Equal(t, []int{0, 1}, files)
+}
+
+// TestTorrentCompleted checks that a torrent is completed once its pieces are verified, received ones are not enough
+func TestTorrentCompleted(t *testing.T) {
+	report, pieces, _ := getReaderTorrent()
+	torrent := &Torrent{session: newSession(DefaultConfig(), newTorrentSet()), report: report, pieces: pieces, filesDone: make(map[int]bool)}
+	// the subscribers of the torrent stop when it finishes, those of its session do not
+	var completed int
+	torrent.session.Subscribe(func(event Event) {
+		if event.Kind == TorrentCompleted {
+			completed++
+		}
+	})
+
+	for index := uint32(0); index < 4; index++ {
+		pieces.AddReceived(parser.PieceBlock{Index: index, Begin: 0, Length: 16})
+	}
+	for _, index := range []uint32{0, 1, 2} {
+		pieces.MarkVerified(index)
+	}
+	torrent.finish(nil)
+	torrent.session.subscribers.flush()
+	assert.Equal(t, 0, completed)
+
+	pieces.MarkVerified(3)
+	torrent.finish(nil)
+	torrent.session.subscribers.flush()
+	assert.Equal(t, 1, completed)
+}
+
+func TestSessionEvents(t *testing.T) {
+	session, path, dir := getSession(t)
+	defer os.RemoveAll(dir)
+	received := make(chan Event, 16)
+	session.Subscribe(func(event Event) { received <- event })
+	next := func() Event {
+		select {
+		case event := <-received:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("No event")
+		}
+		return Event{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	torrent, err := session.AddTorrentContext(ctx, path)
+	assert.Nil(t, err)
+	event := next()
+	assert.Equal(t, MetadataReceived, event.Kind)
+	assert.Equal(t, torrent, event.Torrent)
+	// the torrent is returned once its metadata is received, its subscribers are sent it again
+	replayed := make(chan Event, 16)
+	unsubscribe := torrent.Subscribe(func(event Event) { replayed <- event })
+	unsubscribe()
+	first := <-replayed
+	assert.Equal(t, MetadataReceived, first.Kind)
+	assert.Equal(t, torrent, first.Torrent)
+	event = next()
+	assert.Equal(t, Announced, event.Kind)
+	assert.Nil(t, event.Err)
+	assert.Equal(t, 0, event.Peers)
+
+	session.Pause(torrent)
+	session.Pause(torrent)
+	assert.Equal(t, TorrentPaused, next().Kind)
+	session.Resume(torrent)
+	assert.Equal(t, TorrentResumed, next().Kind)
+
+	// subscribers of the session are sent MetadataReceived of the torrents added before
+	late := make(chan Event, 16)
+	unsubscribe = session.Subscribe(func(event Event) { late <- event })
+	unsubscribe()
+	first = <-late
+	assert.Equal(t, MetadataReceived, first.Kind)
+	assert.Equal(t, torrent, first.Torrent)
+
+	cancel()
+	event = next()
+	assert.Equal(t, TorrentError, event.Kind)
+	assert.Equal(t, context.Canceled, event.Err)
+	<-torrent.Done()
+	assert.Empty(t, received)
+}
@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/queue"
+	"github.com/concurrency-8/tracker"
+)
+
+// FastExtension enables the Fast Extension (BEP 6) in our handshake, in DefaultConfig
+var FastExtension = true
+
+// supportsFast tells if the reserved bytes of a handshake advertise the Fast Extension
+func supportsFast(handshake []byte) bool {
+	return len(handshake) >= 28 && handshake[27]&0x04 != 0
+}
+
+// requestedBlock reads the block of a parsed request, cancel or reject message
+func requestedBlock(payload Payload) (block parser.PieceBlock) {
+	block.Index = payload["index"].(uint32)
+	block.Begin = payload["begin"].(uint32)
+	binary.Read(payload["length"].(*bytes.Buffer), binary.BigEndian, &block.Length)
+	return
+}
+
+// rejected tells if the peer rejected our request for the block since it last unchoked us
+func rejected(queue *queue.Queue, block parser.PieceBlock) bool {
+	for _, request := range queue.Rejected {
+		if request.Index == block.Index && request.Begin == block.Begin {
+			return true
+		}
+	}
+	return false
+}
+
+// HaveAllHandler handles have all protocol - the peer has every piece
+func HaveAllHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, queue *queue.Queue, Log Log) (err error) {
+	queueempty := (queue.Length() == 0)
+	queue.HaveAll = true
+	numPieces := uint32(len(pieces.Torrent.Piece) / 20)
+	for i := uint32(0); i < numPieces; i++ {
+		if err = queue.Enqueue(i); err != nil {
+			return
+		}
+	}
+	if queueempty {
+		Log.Info.Println("peer: <", peer, ">: HaveAllHandler: Queue was empty. Requesting pieces")
+		err = RequestPiece(peer, conn, pieces, queue, Log)
+	}
+	return
+}
+
+// HaveNoneHandler handles have none protocol - the peer has no pieces
+func HaveNoneHandler(peer tracker.Peer, Log Log) {
+	Log.Info.Println("peer: <", peer, ">: Peer has no pieces")
+}
+
+// SuggestHandler handles suggest piece protocol by moving the piece to the front of the queue
+func SuggestHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, queue *queue.Queue, payload Payload, Log Log) (pieceIndex uint32, err error) {
+	binary.Read(payload["payload"].(*bytes.Buffer), binary.BigEndian, &pieceIndex)
+	queueempty := (queue.Length() == 0)
+	if err = queue.EnqueueFront(pieceIndex); err != nil {
+		return
+	}
+	if queueempty {
+		err = RequestPiece(peer, conn, pieces, queue, Log)
+	}
+	return
+}
+
+// RejectHandler handles reject request protocol. The block is marked as not requested
+// so that it can be requested again from another peer, or from this one once it unchokes us
+func RejectHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, queue *queue.Queue, block parser.PieceBlock, Log Log) (err error) {
+	Log.Info.Println("peer: <", peer, ">: Request for piece[", block.Index, "][", block.Begin/parser.BLOCK_LEN, "] rejected")
+	removePending(queue, block)
+	pieces.Lock.Lock()
+	if !pieces.BlockReceived(block.Index, block.Begin/parser.BLOCK_LEN) {
+		pieces.RemoveRequested(block)
+	}
+	pieces.Lock.Unlock()
+	if !rejected(queue, block) {
+		queue.Rejected = append(queue.Rejected, block)
+	}
+	if err = queue.Enqueue(block.Index); err != nil {
+		return
+	}
+	return RequestPiece(peer, conn, pieces, queue, Log)
+}
+
+// AllowedFastHandler handles allowed fast protocol. We may request the piece even while choked
+func AllowedFastHandler(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, queue *queue.Queue, payload Payload, Log Log) (pieceIndex uint32, err error) {
+	binary.Read(payload["payload"].(*bytes.Buffer), binary.BigEndian, &pieceIndex)
+	queue.AllowedFast[pieceIndex] = true
+	if queue.Choked {
+		err = RequestPiece(peer, conn, pieces, queue, Log)
+	}
+	return
+}
+
+// RequestHandler handles a request from the peer. We do not upload and choke every peer,
+// so with the Fast Extension the request is rejected and otherwise it is dropped
+func RequestHandler(peer tracker.Peer, conn net.Conn, queue *queue.Queue, block parser.PieceBlock, Log Log) (err error) {
+	if queue.Fast {
+		Log.Info.Println("peer: <", peer, ">: Rejecting request for piece[", block.Index, "] - peer is choked")
+		var message *bytes.Buffer
+		if message, err = BuildReject(block); err != nil {
+			return
+		}
+		_, err = conn.Write(message.Bytes())
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/queue"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupportsFast(t *testing.T) {
+	handshake, err := BuildHandshake(*getRandomClientReport())
+	assert.Nil(t, err)
+	assert.Equal(t, FastExtension, supportsFast(handshake.Bytes()))
+
+	handshake.Bytes()[27] = 0
+	assert.False(t, supportsFast(handshake.Bytes()))
+}
+
+func TestRejectHandler(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	pieces := piece.NewPieceTracker(file)
+	queue := queue.NewQueue(file)
+	queue.Choked = false
+	queue.Fast = true
+	block, _ := parser.RandomPieceBlock(file)
+	pieces.AddRequested(block)
+
+	client, server := net.Pipe()
+	go func() {
+		RejectHandler(tracker.Peer{}, server, pieces, queue, block, getLog())
+		server.Close()
+	}()
+
+	// The piece is requested again, but not the rejected block until the peer unchokes us
+	resp := make([]byte, 17)
+	respLen, err := client.Read(resp)
+	assert.Nil(t, err)
+	_, id, payload := ParseMsg(bytes.NewBuffer(resp[:respLen]))
+	assert.Equal(t, uint8(6), id)
+	assert.Equal(t, block.Index, payload["index"].(uint32))
+	assert.NotEqual(t, block.Begin, payload["begin"].(uint32))
+	assert.True(t, rejected(queue, block))
+	pieces.Lock.Lock()
+	assert.False(t, pieces.BlockRequested(block.Index, block.Begin/parser.BLOCK_LEN))
+	pieces.Lock.Unlock()
+}
+
+// TestRejectHandlerChoked checks that an allowed fast block rejected while choked is not
+// requested again and again
+func TestRejectHandlerChoked(t *testing.T) {
+	report, pieces, _ := getReaderTorrent()
+	queue := queue.NewQueue(report.TorrentFile)
+	queue.Fast = true
+	queue.AllowedFast[0] = true
+	block := parser.PieceBlock{Index: 0, Begin: 0, Length: 16}
+	queue.Pending = []parser.PieceBlock{block}
+	pieces.AddRequested(block)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error)
+	go func() {
+		done <- RejectHandler(tracker.Peer{}, server, pieces, queue, block, getLog())
+	}()
+	// nothing is written to the peer, which would block the pipe
+	assert.Nil(t, <-done)
+	assert.Empty(t, queue.Pending)
+	assert.True(t, rejected(queue, block))
+
+	// unchoking lets us request it again
+	go UnchokeHandler(tracker.Peer{}, server, pieces, queue, getLog())
+	resp := make([]byte, 17)
+	respLen, err := client.Read(resp)
+	assert.Nil(t, err)
+	_, id, payload := ParseMsg(bytes.NewBuffer(resp[:respLen]))
+	assert.Equal(t, uint8(6), id)
+	assert.Equal(t, uint32(0), payload["index"].(uint32))
+	assert.Equal(t, uint32(0), payload["begin"].(uint32))
+}
+
+// TestRequestHandler checks that requests of a peer are rejected with the Fast Extension, we never unchoke it
+func TestRequestHandler(t *testing.T) {
+	queue := queue.NewQueue(parser.TorrentFile{})
+	block := GetRandomPiece()
+	assert.Nil(t, RequestHandler(tracker.Peer{}, nil, queue, block, getLog()))
+
+	queue.Fast = true
+	client, server := net.Pipe()
+	go func() {
+		RequestHandler(tracker.Peer{}, server, queue, block, getLog())
+		server.Close()
+	}()
+	resp := make([]byte, 17)
+	respLen, err := client.Read(resp)
+	assert.Nil(t, err)
+	_, id, payload := ParseMsg(bytes.NewBuffer(resp[:respLen]))
+	assert.Equal(t, uint8(16), id, "Reject not sent")
+	assert.Equal(t, block.Index, payload["index"].(uint32))
+}
+
+// TestFastNotNegotiated checks that a peer sending Fast Extension messages without negotiating it is dropped
+func TestFastNotNegotiated(t *testing.T) {
+	queue := queue.NewQueue(parser.TorrentFile{})
+	haveAll, _ := BuildHaveAll()
+	err := msgHandler(tracker.Peer{}, haveAll.Bytes(), nil, nil, queue, nil, getLog())
+	assert.True(t, errors.Is(err, ErrBadMessage))
+	assert.False(t, queue.HaveAll)
+}
@@ -0,0 +1,268 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/queue"
+)
+
+// HashWorkers is the number of goroutines verifying the downloaded pieces of a session
+var HashWorkers = runtime.NumCPU()
+
+// HashQueueLength is the number of pieces waiting for a hash worker before peers wait too
+var HashQueueLength = 64
+
+// HashStats are metrics of the hash workers
+type HashStats struct {
+	// Queued is the number of pieces waiting for or being hashed
+	Queued int
+	Hashed int64
+	Failed int64
+	// HashTime is the total time spent hashing, WaitTime the total time pieces waited in the queue
+	HashTime time.Duration
+	WaitTime time.Duration
+}
+
+// hashJob is a downloaded piece waiting for its SHA-1 check. done is called with the result on the hash worker
+type hashJob struct {
+	pieces   *piece.PieceTracker
+	data     []byte
+	expected []byte
+	queued   time.Time
+	done     func(ok bool)
+}
+
+// hashPool holds the queue of the hash workers of a session and the pieces being hashed per torrent
+type hashPool struct {
+	workers int
+	start   sync.Once
+	jobs    chan hashJob
+	lock    sync.Mutex
+	changed *sync.Cond
+	pending map[*piece.PieceTracker]int
+	stats   HashStats
+}
+
+func newHashPool(workers int) *hashPool {
+	pool := &hashPool{workers: workers, pending: make(map[*piece.PieceTracker]int)}
+	pool.changed = sync.NewCond(&pool.lock)
+	return pool
+}
+
+// startWorkers starts the hash workers the first time a piece is hashed
+func (pool *hashPool) startWorkers() {
+	pool.start.Do(func() {
+		pool.jobs = make(chan hashJob, HashQueueLength)
+		workers := pool.workers
+		if workers < 1 {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			go pool.work()
+		}
+	})
+}
+
+// stop ends the hash workers once no piece is submitted anymore
+func (pool *hashPool) stop() {
+	pool.start.Do(func() {})
+	if pool.jobs != nil {
+		close(pool.jobs)
+	}
+}
+
+func (pool *hashPool) work() {
+	for job := range pool.jobs {
+		start := time.Now()
+		hash := sha1.Sum(job.data)
+		ok := bytes.Equal(hash[:], job.expected)
+
+		pool.lock.Lock()
+		pool.stats.Hashed++
+		if !ok {
+			pool.stats.Failed++
+		}
+		pool.stats.HashTime += time.Since(start)
+		pool.stats.WaitTime += start.Sub(job.queued)
+		pool.lock.Unlock()
+
+		job.done(ok)
+
+		pool.lock.Lock()
+		pool.stats.Queued--
+		pool.lock.Unlock()
+		pool.finish(job.pieces)
+	}
+}
+
+// add records a hash or write of the torrent that is not done yet
+func (pool *hashPool) add(pieces *piece.PieceTracker) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.pending[pieces]++
+}
+
+// finish records that a hash or write of the torrent is done
+func (pool *hashPool) finish(pieces *piece.PieceTracker) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.pending[pieces]--
+	if pool.pending[pieces] == 0 {
+		delete(pool.pending, pieces)
+	}
+	pool.changed.Broadcast()
+}
+
+// submitHash queues a piece to be checked against its expected hash by the hash workers of its session.
+// It waits while the queue is full
+func submitHash(pieces *piece.PieceTracker, data []byte, expected []byte, done func(ok bool)) {
+	pool := sessionOf(pieces).hashing
+	pool.startWorkers()
+	pool.lock.Lock()
+	pool.stats.Queued++
+	pool.pending[pieces]++
+	pool.lock.Unlock()
+	pool.jobs <- hashJob{pieces, data, expected, time.Now(), done}
+}
+
+// writerSet holds the verified pieces waiting to be written, per torrent. Every torrent has its own
+// writer so that a slow disk does not hold up the hash workers or the other torrents
+type writerSet struct {
+	lock    sync.Mutex
+	writers map[*piece.PieceTracker][]func()
+}
+
+func newWriterSet() *writerSet {
+	return &writerSet{writers: make(map[*piece.PieceTracker][]func())}
+}
+
+// submitWrite has write run by the writer of the torrent, in order. A writer is started if the
+// torrent has none, it ends once there is nothing left to write
+func submitWrite(pieces *piece.PieceTracker, write func()) {
+	session := sessionOf(pieces)
+	session.hashing.add(pieces)
+
+	writing := session.writing
+	writing.lock.Lock()
+	defer writing.lock.Unlock()
+	queued, running := writing.writers[pieces]
+	writing.writers[pieces] = append(queued, write)
+	if !running {
+		go writing.run(session.hashing, pieces)
+	}
+}
+
+// run writes the queued pieces of a torrent
+func (writing *writerSet) run(pool *hashPool, pieces *piece.PieceTracker) {
+	for {
+		writing.lock.Lock()
+		queued := writing.writers[pieces]
+		if len(queued) == 0 {
+			delete(writing.writers, pieces)
+			writing.lock.Unlock()
+			return
+		}
+		write := queued[0]
+		writing.writers[pieces] = queued[1:]
+		writing.lock.Unlock()
+
+		write()
+		pool.finish(pieces)
+	}
+}
+
+// waitHashed waits until every piece of the torrent submitted for hashing is hashed, and written if verified
+func waitHashed(pieces *piece.PieceTracker) {
+	pool := sessionOf(pieces).hashing
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for pool.pending[pieces] > 0 {
+		pool.changed.Wait()
+	}
+}
+
+// HashStatistics returns the metrics of the hash workers of the default session
+func HashStatistics() HashStats {
+	return defaultSession().HashStatistics()
+}
+
+// HashStatistics returns the metrics of the hash workers of the session
+func (session *Session) HashStatistics() HashStats {
+	pool := session.hashing
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.stats
+}
+
+// retrySet holds the queues of the connected peers of every torrent, with the pieces to put back
+// in each of them. A queue is only touched by its peer, other goroutines leave pieces here
+type retrySet struct {
+	lock   sync.Mutex
+	queues map[*piece.PieceTracker]map[*queue.Queue][]uint32
+}
+
+func newRetrySet() *retrySet {
+	return &retrySet{queues: make(map[*piece.PieceTracker]map[*queue.Queue][]uint32)}
+}
+
+// joinQueues registers the queue of a peer of the torrent
+func joinQueues(pieces *piece.PieceTracker, peerQueue *queue.Queue) {
+	retries := sessionOf(pieces).retries
+	retries.lock.Lock()
+	defer retries.lock.Unlock()
+	queues := retries.queues[pieces]
+	if queues == nil {
+		queues = make(map[*queue.Queue][]uint32)
+		retries.queues[pieces] = queues
+	}
+	queues[peerQueue] = nil
+}
+
+// leaveQueues forgets the queue of a peer that stopped
+func leaveQueues(pieces *piece.PieceTracker, queue *queue.Queue) {
+	retries := sessionOf(pieces).retries
+	retries.lock.Lock()
+	defer retries.lock.Unlock()
+	delete(retries.queues[pieces], queue)
+	if len(retries.queues[pieces]) == 0 {
+		delete(retries.queues, pieces)
+	}
+}
+
+// requeue has the pieces put back in the queue of every peer of the torrent that has them,
+// on its next request
+func requeue(pieces *piece.PieceTracker, indexes ...uint32) {
+	retries := sessionOf(pieces).retries
+	retries.lock.Lock()
+	defer retries.lock.Unlock()
+	queues := retries.queues[pieces]
+	for queue := range queues {
+		queues[queue] = append(queues[queue], indexes...)
+	}
+}
+
+// takeRetries returns and forgets the pieces to put back in the queue
+func takeRetries(pieces *piece.PieceTracker, queue *queue.Queue) []uint32 {
+	retries := sessionOf(pieces).retries
+	retries.lock.Lock()
+	defer retries.lock.Unlock()
+	queues := retries.queues[pieces]
+	indexes := queues[queue]
+	if indexes != nil {
+		queues[queue] = nil
+	}
+	return indexes
+}
+
+// forgetRetries forgets the queues of a torrent once its peers and hashes are done
+func forgetRetries(pieces *piece.PieceTracker) {
+	retries := sessionOf(pieces).retries
+	retries.lock.Lock()
+	defer retries.lock.Unlock()
+	delete(retries.queues, pieces)
+}
@@ -0,0 +1,73 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/queue"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmitHash(t *testing.T) {
+	report, pieces, data := getReaderTorrent()
+	before := HashStatistics()
+	results := make([]bool, 2)
+	hash := sha1.Sum(data[:16])
+	submitHash(pieces, data[:16], hash[:], func(ok bool) { results[0] = ok })
+	submitHash(pieces, data[16:32], hash[:], func(ok bool) { results[1] = ok })
+	waitHashed(pieces)
+	assert.Equal(t, []bool{true, false}, results)
+
+	stats := HashStatistics()
+	assert.Equal(t, before.Hashed+2, stats.Hashed)
+	assert.Equal(t, before.Failed+1, stats.Failed)
+	assert.Equal(t, 0, stats.Queued)
+	assert.Nil(t, report.Storage.Close())
+}
+
+// TestRetries checks that a failed piece is put back in the queues of the remaining peers,
+// even when the peer that sent it left
+func TestRetries(t *testing.T) {
+	report, pieces, _ := getReaderTorrent()
+	left := queue.NewQueue(report.TorrentFile)
+	remaining := queue.NewQueue(report.TorrentFile)
+	joinQueues(pieces, left)
+	joinQueues(pieces, remaining)
+	leaveQueues(pieces, left)
+	pieces.Fill(2)
+	pieceFailed(tracker.Peer{}, pieces, 2, getLog())
+	assert.False(t, pieces.PieceIsDone(2))
+	assert.Equal(t, []uint32{2}, takeRetries(pieces, remaining))
+	assert.Empty(t, takeRetries(pieces, remaining))
+	assert.Empty(t, takeRetries(pieces, left))
+
+	// the queues are forgotten with the torrent
+	pieceFailed(tracker.Peer{}, pieces, 2, getLog())
+	forgetRetries(pieces)
+	assert.Empty(t, takeRetries(pieces, remaining))
+}
+
+// TestSubmitWrite checks that writes of a torrent run in order, apart from the hash workers,
+// and that waitHashed waits for them
+func TestSubmitWrite(t *testing.T) {
+	_, pieces, _ := getReaderTorrent()
+	other := piece.NewPieceTracker(pieces.Torrent)
+	blocked := make(chan struct{})
+	submitWrite(other, func() { <-blocked })
+	defer close(blocked)
+
+	var order []int
+	for i := 0; i < 3; i++ {
+		i := i
+		submitWrite(pieces, func() {
+			time.Sleep(time.Millisecond)
+			order = append(order, i)
+		})
+	}
+	// the blocked writer of the other torrent does not hold up this one
+	waitHashed(pieces)
+	assert.Equal(t, []int{0, 1, 2}, order)
+}
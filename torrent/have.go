@@ -0,0 +1,170 @@
+package torrent
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/tracker"
+)
+
+// LazyBitfield leaves some of our pieces out of the bitfield and announces them with have messages instead, in DefaultConfig
+var LazyBitfield = false
+
+// LazyBitfieldCount is the maximum number of pieces left out of a lazy bitfield
+var LazyBitfieldCount = 8
+
+// swarmSet holds the connected peers of the torrents of a session, so that have messages reach all of them.
+// Connections waiting for our bitfield hold the pieces verified meanwhile
+type swarmSet struct {
+	lock    sync.Mutex
+	peers   map[*piece.PieceTracker]map[net.Conn]tracker.Peer
+	waiting map[net.Conn][]uint32
+}
+
+func newSwarmSet() *swarmSet {
+	return &swarmSet{peers: make(map[*piece.PieceTracker]map[net.Conn]tracker.Peer), waiting: make(map[net.Conn][]uint32)}
+}
+
+// joinSwarm registers a connection before our bitfield is taken, so that no piece verified
+// meanwhile is lost. Its have messages wait until bitfieldSent
+func joinSwarm(pieces *piece.PieceTracker, peer tracker.Peer, conn net.Conn) {
+	swarms := sessionOf(pieces).swarms
+	swarms.lock.Lock()
+	defer swarms.lock.Unlock()
+	if swarms.peers[pieces] == nil {
+		swarms.peers[pieces] = make(map[net.Conn]tracker.Peer)
+	}
+	swarms.peers[pieces][conn] = peer
+	swarms.waiting[conn] = nil
+}
+
+// bitfieldSent lets have messages reach the connection, and returns the pieces verified since it joined
+func bitfieldSent(pieces *piece.PieceTracker, conn net.Conn) (missed []uint32) {
+	swarms := sessionOf(pieces).swarms
+	swarms.lock.Lock()
+	defer swarms.lock.Unlock()
+	missed = swarms.waiting[conn]
+	delete(swarms.waiting, conn)
+	return
+}
+
+// leaveSwarm forgets a closed connection
+func leaveSwarm(pieces *piece.PieceTracker, conn net.Conn) {
+	swarms := sessionOf(pieces).swarms
+	swarms.lock.Lock()
+	defer swarms.lock.Unlock()
+	delete(swarms.peers[pieces], conn)
+	delete(swarms.waiting, conn)
+	if len(swarms.peers[pieces]) == 0 {
+		delete(swarms.peers, pieces)
+	}
+}
+
+// broadcastHave tells every connected peer of the torrent that we have verified the piece
+func broadcastHave(pieces *piece.PieceTracker, pieceIndex uint32, Log Log) {
+	message, err := BuildHave(pieceIndex)
+	if err != nil {
+		return
+	}
+	swarms := sessionOf(pieces).swarms
+	swarms.lock.Lock()
+	peers := make(map[net.Conn]tracker.Peer, len(swarms.peers[pieces]))
+	for conn, peer := range swarms.peers[pieces] {
+		if missed, ok := swarms.waiting[conn]; ok {
+			// a have must not come before the bitfield
+			swarms.waiting[conn] = append(missed, pieceIndex)
+			continue
+		}
+		peers[conn] = peer
+	}
+	swarms.lock.Unlock()
+
+	// a slow peer must not hold up the download
+	go func() {
+		for conn, peer := range peers {
+			if _, err := conn.Write(message.Bytes()); err != nil {
+				Log.Info.Println("peer: <", peer, ">: Could not send have:", err)
+			}
+		}
+	}()
+}
+
+// sendBitfield tells the peer which verified pieces we have right after the handshake.
+// Have all or have none is used instead when the Fast Extension is negotiated
+func sendBitfield(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, fast bool, Log Log) error {
+	var bitfield []byte
+	if pieces != nil {
+		bitfield = pieces.Bitfield()
+	}
+	var owned []uint32
+	for i := range bitfield {
+		for j := uint32(0); j < 8; j++ {
+			if bitfield[i]&(0x80>>j) != 0 {
+				owned = append(owned, uint32(i)*8+j)
+			}
+		}
+	}
+	numPieces := 0
+	if pieces != nil {
+		numPieces = pieces.NumPieces()
+	}
+
+	var message *bytes.Buffer
+	var err error
+	var lazy []uint32
+	if fast && len(owned) == numPieces && numPieces > 0 {
+		message, err = BuildHaveAll()
+	} else if fast && len(owned) == 0 {
+		message, err = BuildHaveNone()
+	} else if len(owned) == 0 {
+		// the bitfield is optional when we have nothing
+		return nil
+	} else {
+		if sessionOf(pieces).config.LazyBitfield {
+			for _, i := range rand.Perm(len(owned)) {
+				if len(lazy) == LazyBitfieldCount {
+					break
+				}
+				index := owned[i]
+				bitfield[index/8] &^= 0x80 >> (index % 8)
+				lazy = append(lazy, index)
+			}
+		}
+		message, err = BuildBitfield(bitfield)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(message.Bytes()); err != nil {
+		return err
+	}
+	for _, index := range lazy {
+		message, err = BuildHave(index)
+		if err != nil {
+			return err
+		}
+		if _, err = conn.Write(message.Bytes()); err != nil {
+			return err
+		}
+	}
+	Log.Info.Println("peer: <", peer, ">: Sent our pieces:", len(owned), "of", numPieces)
+	return nil
+}
+
+// sendMissedHaves sends have messages for the pieces verified while the bitfield was sent
+func sendMissedHaves(peer tracker.Peer, conn net.Conn, pieces *piece.PieceTracker, Log Log) error {
+	for _, index := range bitfieldSent(pieces, conn) {
+		message, err := BuildHave(index)
+		if err != nil {
+			return err
+		}
+		if _, err = conn.Write(message.Bytes()); err != nil {
+			return err
+		}
+		Log.Info.Println("peer: <", peer, ">: Sent have for piece", index, "verified meanwhile")
+	}
+	return nil
+}
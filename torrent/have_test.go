@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+// readMessage reads one length prefixed message from conn
+func readMessage(t *testing.T, conn net.Conn) (id uint8, payload Payload) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(conn, header)
+	assert.Nil(t, err)
+	body := make([]byte, binary.BigEndian.Uint32(header))
+	_, err = io.ReadFull(conn, body)
+	assert.Nil(t, err)
+	_, id, payload = ParseMsg(bytes.NewBuffer(append(header, body...)))
+	return
+}
+
+func TestSendBitfield(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	pieces := piece.NewPieceTracker(file)
+	pieces.Fill(1)
+
+	client, server := net.Pipe()
+	go sendBitfield(tracker.Peer{}, server, pieces, false, getLog())
+	id, payload := readMessage(t, client)
+	assert.Equal(t, uint8(5), id)
+	assert.Equal(t, pieces.Bitfield(), payload["payload"].(*bytes.Buffer).Bytes())
+
+	// Have none with the Fast Extension
+	go sendBitfield(tracker.Peer{}, server, piece.NewPieceTracker(file), true, getLog())
+	id, _ = readMessage(t, client)
+	assert.Equal(t, uint8(15), id)
+
+	// Have all with the Fast Extension
+	for i := 0; i < pieces.NumPieces(); i++ {
+		pieces.Fill(uint32(i))
+	}
+	go sendBitfield(tracker.Peer{}, server, pieces, true, getLog())
+	id, _ = readMessage(t, client)
+	assert.Equal(t, uint8(14), id)
+}
+
+func TestLazyBitfield(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	pieces := piece.NewPieceTracker(file)
+	config := DefaultConfig()
+	config.LazyBitfield = true
+	testSession(t, config, pieces)
+	pieces.Fill(0)
+	pieces.Fill(2)
+
+	client, server := net.Pipe()
+	go sendBitfield(tracker.Peer{}, server, pieces, false, getLog())
+	id, payload := readMessage(t, client)
+	assert.Equal(t, uint8(5), id)
+	assert.Equal(t, make([]byte, len(pieces.Bitfield())), payload["payload"].(*bytes.Buffer).Bytes(), "Pieces not left out")
+
+	// The pieces left out follow as have messages
+	announced := make(map[uint32]bool)
+	for i := 0; i < 2; i++ {
+		id, payload = readMessage(t, client)
+		assert.Equal(t, uint8(4), id)
+		announced[binary.BigEndian.Uint32(payload["payload"].(*bytes.Buffer).Bytes())] = true
+	}
+	assert.Equal(t, map[uint32]bool{0: true, 2: true}, announced)
+}
+
+func TestBroadcastHave(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	pieces := piece.NewPieceTracker(file)
+	client1, server1 := net.Pipe()
+	client2, server2 := net.Pipe()
+	joinSwarm(pieces, tracker.Peer{}, server1)
+	joinSwarm(pieces, tracker.Peer{}, server2)
+	bitfieldSent(pieces, server1)
+	bitfieldSent(pieces, server2)
+
+	broadcastHave(pieces, 7, getLog())
+	done := make(chan uint8)
+	for _, client := range []net.Conn{client1, client2} {
+		go func(client net.Conn) {
+			id, _ := readMessage(t, client)
+			done <- id
+		}(client)
+	}
+	assert.Equal(t, uint8(4), <-done)
+	assert.Equal(t, uint8(4), <-done)
+
+	leaveSwarm(pieces, server1)
+	leaveSwarm(pieces, server2)
+	swarms := sessionOf(pieces).swarms
+	swarms.lock.Lock()
+	assert.Empty(t, swarms.peers[pieces])
+	swarms.lock.Unlock()
+}
+
+// TestHaveBeforeBitfield checks that a piece verified while the bitfield is sent is announced after it
+func TestHaveBeforeBitfield(t *testing.T) {
+	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
+	pieces := piece.NewPieceTracker(file)
+	client, server := net.Pipe()
+	defer leaveSwarm(pieces, server)
+	joinSwarm(pieces, tracker.Peer{}, server)
+	pieces.MarkVerified(3)
+	broadcastHave(pieces, 3, getLog())
+
+	go func() {
+		sendBitfield(tracker.Peer{}, server, pieces, false, getLog())
+		sendMissedHaves(tracker.Peer{}, server, pieces, getLog())
+	}()
+	id, _ := readMessage(t, client)
+	assert.Equal(t, uint8(5), id, "Have sent before the bitfield")
+	id, payload := readMessage(t, client)
+	assert.Equal(t, uint8(4), id)
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(payload["payload"].(*bytes.Buffer).Bytes()))
+}
@@ -0,0 +1,154 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/tracker"
+)
+
+// activeTorrent is a torrent being downloaded, its files can be read over HTTP
+type activeTorrent struct {
+	report *tracker.ClientStatusReport
+	pieces *piece.PieceTracker
+}
+
+// torrentSet holds the torrents being downloaded by their hex info hash
+type torrentSet struct {
+	lock     sync.Mutex
+	torrents map[string]activeTorrent
+}
+
+func newTorrentSet() *torrentSet {
+	return &torrentSet{torrents: make(map[string]activeTorrent)}
+}
+
+// active holds the torrents of the default session, served by HTTPHandler
+var active = newTorrentSet()
+
+// activate makes the files of a torrent available over HTTP
+func (set *torrentSet) activate(report *tracker.ClientStatusReport, pieces *piece.PieceTracker) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	set.torrents[hex.EncodeToString([]byte(report.TorrentFile.InfoHash))] = activeTorrent{report, pieces}
+}
+
+// deactivate removes a torrent activated with activate
+func (set *torrentSet) deactivate(report *tracker.ClientStatusReport) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	delete(set.torrents, hex.EncodeToString([]byte(report.TorrentFile.InfoHash)))
+}
+
+// fileName returns the name of a file of a torrent used in its URL
+func fileName(report *tracker.ClientStatusReport, file int) string {
+	if name := path.Base(report.TorrentFile.Files[file].RelPath); name != "." && name != "/" {
+		return name
+	}
+	return strconv.Itoa(file)
+}
+
+// FileURL returns the path at which a file of a torrent is served, /infohash/index/name
+func FileURL(report *tracker.ClientStatusReport, file int) string {
+	return "/" + hex.EncodeToString([]byte(report.TorrentFile.InfoHash)) + "/" + strconv.Itoa(file) + "/" + url.PathEscape(fileName(report, file))
+}
+
+// HTTPHandler serves the files of the torrents of the default session at FileURL, with range requests.
+// Reads wait for the pieces to be downloaded and the requested pieces are downloaded first
+func HTTPHandler() http.Handler {
+	return active.handler()
+}
+
+// handler serves the files of the torrents of the set, see HTTPHandler
+func (set *torrentSet) handler() http.Handler {
+	return http.HandlerFunc(set.serveHTTP)
+}
+
+// ListenHTTP serves HTTPHandler on address until it fails
+func ListenHTTP(address string) error {
+	return http.ListenAndServe(address, HTTPHandler())
+}
+
+func (set *torrentSet) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 3)
+	if parts[0] == "" {
+		set.serveIndex(w)
+		return
+	}
+	set.lock.Lock()
+	torrent, ok := set.torrents[strings.ToLower(parts[0])]
+	set.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		serveTorrentIndex(w, torrent.report)
+		return
+	}
+	file, err := strconv.Atoi(parts[1])
+	if err != nil || file < 0 || file >= len(torrent.report.TorrentFile.Files) ||
+		(len(parts) == 3 && parts[2] != fileName(torrent.report, file)) {
+		http.NotFound(w, r)
+		return
+	}
+	serveFile(w, r, torrent, file)
+}
+
+// serveFile streams a file of a torrent. The reader is closed once the client goes away
+func serveFile(w http.ResponseWriter, r *http.Request, torrent activeTorrent, file int) {
+	reader, err := NewReader(torrent.report, torrent.pieces, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	go func() {
+		<-r.Context().Done()
+		reader.Close()
+	}()
+
+	name := fileName(torrent.report, file)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
+
+// serveIndex lists the torrents of the set
+func (set *torrentSet) serveIndex(w http.ResponseWriter) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<ul>")
+	for hash, torrent := range set.torrents {
+		fmt.Fprintf(w, "<li><a href=\"/%s/\">%s</a></li>\n", hash, html.EscapeString(torrent.report.TorrentFile.Name))
+	}
+	fmt.Fprintln(w, "</ul>")
+}
+
+// serveTorrentIndex lists the files of a torrent
+func serveTorrentIndex(w http.ResponseWriter, report *tracker.ClientStatusReport) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<ul>")
+	for i, file := range report.TorrentFile.Files {
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> %d bytes</li>\n", FileURL(report, i), html.EscapeString(fileName(report, i)), file.Length)
+	}
+	fmt.Fprintln(w, "</ul>")
+}
@@ -0,0 +1,55 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	report, pieces, data := getReaderTorrent()
+	report.TorrentFile.InfoHash = "\x01\x02"
+	report.TorrentFile.Files[0].RelPath = "name/first.txt"
+	report.TorrentFile.Files[1].RelPath = "name/second.bin"
+	active.activate(report, pieces)
+	defer active.deactivate(report)
+	server := httptest.NewServer(HTTPHandler())
+	defer server.Close()
+	assert.Equal(t, "/0102/0/first.txt", FileURL(report, 0))
+
+	// The range is served once its pieces are verified
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		for i := uint32(0); i < 4; i++ {
+			pieces.MarkVerified(i)
+		}
+	}()
+	request, _ := http.NewRequest("GET", server.URL+FileURL(report, 0), nil)
+	request.Header.Set("Range", "bytes=10-29")
+	response, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "20", response.Header.Get("Content-Length"))
+	assert.Equal(t, "text/plain; charset=utf-8", response.Header.Get("Content-Type"))
+	assert.Equal(t, data[10:30], body)
+
+	response, err = http.Get(server.URL + FileURL(report, 1))
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, "application/octet-stream", response.Header.Get("Content-Type"))
+	assert.Equal(t, data[40:], body)
+
+	for _, path := range []string{"/0103/0/first.txt", "/0102/2/x", "/0102/0/other.txt"} {
+		response, err = http.Get(server.URL + path)
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusNotFound, response.StatusCode, path)
+	}
+}
@@ -3,10 +3,12 @@ package torrent
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	// "github.com/concurrency-8/queue"
 
 	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
 	"github.com/concurrency-8/tracker"
 )
 
@@ -20,8 +22,14 @@ type Payload map[string]interface{}
 //	[8]byte		: reserved	- 8 reserved bytes
 //	[20]byte	: infohash	- SHA1 hash of the info key in the metainfo file. Same as the info hash transmitted in tracker requests
 //	[20]byte	: peerID	- 20 byte unique ID for the client. Usually the same peerID transmitted in tracker requests
-// In version 1.0 of the BitTorrent protocol, pstrlen = 19, and pstr = "BitTorrent protocol"
+// In version 1.0 of the BitTorrent protocol, pstrlen = 19, and pstr = "BitTorrent protocol".
+// The Fast Extension is advertised if FastExtension is set
 func BuildHandshake(report tracker.ClientStatusReport) (handshake *bytes.Buffer, err error) {
+	return buildHandshake(report, FastExtension)
+}
+
+// buildHandshake builds the handshake of BuildHandshake, advertising the Fast Extension if fast is set
+func buildHandshake(report tracker.ClientStatusReport, fast bool) (handshake *bytes.Buffer, err error) {
 	handshake = new(bytes.Buffer)
 
 	// pstrlen
@@ -34,8 +42,12 @@ func BuildHandshake(report tracker.ClientStatusReport) (handshake *bytes.Buffer,
 		return
 	}
 
-	// reserved
-	if err = binary.Write(handshake, binary.BigEndian, uint64(0)); err != nil {
+	// reserved - bit 0x04 of the last byte advertises the Fast Extension (BEP 6)
+	var reserved [8]byte
+	if fast {
+		reserved[7] |= 0x04
+	}
+	if err = binary.Write(handshake, binary.BigEndian, reserved); err != nil {
 		return
 	}
 
@@ -156,6 +168,28 @@ func BuildHave(payload uint32) (have *bytes.Buffer, err error) {
 	return
 }
 
+// BuildBitfield returns pointer to a buffer. This takes the bitfield of pieces we have as an argument
+//	uint32	: length	- Length of remaining part(message) = 1 + len(bitfield)
+//	uint8	: messageType	- for bitfield, messageType = 5
+//	[]byte	: bitfield	- payload, the high bit of the first byte is piece 0
+func BuildBitfield(payload []byte) (bitfield *bytes.Buffer, err error) {
+	bitfield = new(bytes.Buffer)
+
+	if err = binary.Write(bitfield, binary.BigEndian, uint32(1+len(payload))); err != nil {
+		return
+	}
+
+	if err = binary.Write(bitfield, binary.BigEndian, uint8(5)); err != nil {
+		return
+	}
+
+	if err = binary.Write(bitfield, binary.BigEndian, payload); err != nil {
+		return
+	}
+
+	return
+}
+
 // BuildRequest returns pointer to a buffer. This takes parser.PieceBlock as an argument
 //	uint32	: length	- Length of remaining part(message) = 13
 //	uint8	: messageType	- for request, message = 5
@@ -285,6 +319,77 @@ func BuildPort(port uint16) (portBuf *bytes.Buffer, err error) {
 	return
 }
 
+// BuildHaveAll returns pointer to a buffer.
+//	uint32	: length	- Length of remaining part(message) = 1
+//	uint8	: messageType	- For have all, messageType = 14
+func BuildHaveAll() (haveAll *bytes.Buffer, err error) {
+	haveAll = new(bytes.Buffer)
+
+	if err = binary.Write(haveAll, binary.BigEndian, uint32(1)); err != nil {
+		return
+	}
+
+	if err = binary.Write(haveAll, binary.BigEndian, uint8(14)); err != nil {
+		return
+	}
+
+	return
+}
+
+// BuildHaveNone returns pointer to a buffer.
+//	uint32	: length	- Length of remaining part(message) = 1
+//	uint8	: messageType	- For have none, messageType = 15
+func BuildHaveNone() (haveNone *bytes.Buffer, err error) {
+	haveNone = new(bytes.Buffer)
+
+	if err = binary.Write(haveNone, binary.BigEndian, uint32(1)); err != nil {
+		return
+	}
+
+	if err = binary.Write(haveNone, binary.BigEndian, uint8(15)); err != nil {
+		return
+	}
+
+	return
+}
+
+// BuildReject returns pointer to a buffer. Takes parser.PieceBlock object as arg
+//	uint32	: length	- Length of the remaining message = 13
+//	uint8	: messageType	- for reject request, messageType = 16
+//	uint32	: piece index	- parser.PieceBlock.Index for payload
+//	uint32	: piece begin	- parser.PieceBlock.Begin for payload
+//	uint32	: piece length	- parser.PieceBlock.Length for payload
+func BuildReject(payload parser.PieceBlock) (reject *bytes.Buffer, err error) {
+	reject = new(bytes.Buffer)
+
+	// Length of Message
+	if err = binary.Write(reject, binary.BigEndian, uint32(13)); err != nil {
+		return
+	}
+
+	// Message type - Reject Request
+	if err = binary.Write(reject, binary.BigEndian, uint8(16)); err != nil {
+		return
+	}
+
+	// piece index
+	if err = binary.Write(reject, binary.BigEndian, payload.Index); err != nil {
+		return
+	}
+
+	// piece begin
+	if err = binary.Write(reject, binary.BigEndian, payload.Begin); err != nil {
+		return
+	}
+
+	// piece length
+	if err = binary.Write(reject, binary.BigEndian, payload.Length); err != nil {
+		return
+	}
+
+	return
+}
+
 // ParseMsg parses a message
 func ParseMsg(msg *bytes.Buffer) (size uint32, id uint8, payload Payload) {
 	payload = make(Payload)
@@ -295,7 +400,7 @@ func ParseMsg(msg *bytes.Buffer) (size uint32, id uint8, payload Payload) {
 	}
 	if size > 1 {
 
-		if id == 6 || id == 7 || id == 8 {
+		if (id == 6 || id == 7 || id == 8 || id == 16) && msg.Len() >= 8 {
 			rest := bytes.NewBuffer(msg.Bytes()[8:])
 			var index, begin uint32
 			binary.Read(msg, binary.BigEndian, &index)
@@ -317,3 +422,46 @@ func ParseMsg(msg *bytes.Buffer) (size uint32, id uint8, payload Payload) {
 	return
 
 }
+
+// ErrBadMessage is the error of a message from a peer that is truncated or refers to a block
+// out of range. The peer is dropped
+var ErrBadMessage = fmt.Errorf("Malformed message")
+
+// payloadLen is the length of the payload of the messages of fixed length, by id
+var payloadLen = map[uint8]int{0: 0, 1: 0, 2: 0, 3: 0, 4: 4, 6: 12, 8: 12, 9: 2, 13: 4, 14: 0, 15: 0, 16: 12, 17: 4}
+
+// checkMsg tells if a whole message from a peer can be handled: its length matches its id,
+// and the piece and block it refers to are in the torrent of pieces. Without pieces only the
+// length is checked
+func checkMsg(msg []byte, pieces *piece.PieceTracker) error {
+	if len(msg) < 4 || int(binary.BigEndian.Uint32(msg)) != len(msg)-4 {
+		return fmt.Errorf("%w: truncated message of %d bytes", ErrBadMessage, len(msg))
+	}
+	if len(msg) == 4 {
+		return nil
+	}
+	id, payload := msg[4], msg[5:]
+	if length, ok := payloadLen[id]; ok && len(payload) != length || id == 7 && len(payload) < 8 {
+		return fmt.Errorf("%w: message %d with %d bytes of payload", ErrBadMessage, id, len(payload))
+	}
+	if pieces == nil {
+		return nil
+	}
+	switch id {
+	case 4, 6, 8, 13, 17:
+		if index := binary.BigEndian.Uint32(payload); index >= uint32(pieces.NumPieces()) {
+			return fmt.Errorf("%w: piece %d out of range", ErrBadMessage, index)
+		}
+	case 7, 16:
+		index, begin := binary.BigEndian.Uint32(payload), binary.BigEndian.Uint32(payload[4:])
+		length := uint32(len(payload) - 8)
+		if id == 16 {
+			length = binary.BigEndian.Uint32(payload[8:])
+		}
+		if expected, err := parser.BlockLen(pieces.Torrent, index, begin/parser.BLOCK_LEN); err != nil ||
+			begin%parser.BLOCK_LEN != 0 || length != expected {
+			return fmt.Errorf("%w: block %d of %d bytes at %d out of range", ErrBadMessage, index, length, begin)
+		}
+	}
+	return nil
+}
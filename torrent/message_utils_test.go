@@ -3,6 +3,7 @@ package torrent
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
@@ -189,6 +190,21 @@ func TestBuildHave(t *testing.T) {
 	assert.Equal(payload, payloadRead)
 }
 
+func TestBuildBitfield(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := getRandomByteArr(13)
+	bitfield, err := BuildBitfield(payload)
+
+	assert.Nil(err)
+	assert.Equal(5+len(payload), len(bitfield.Bytes()))
+
+	size, id, parsed := ParseMsg(bitfield)
+	assert.Equal(uint32(1+len(payload)), size)
+	assert.Equal(uint8(5), id)
+	assert.Equal(payload, parsed["payload"].(*bytes.Buffer).Bytes())
+}
+
 func TestBuildRequest(t *testing.T) {
 	assert := assert.New(t)
 
@@ -379,7 +395,7 @@ func TestParseMsg(t *testing.T) {
 	assert.Equal(t, p2, p1, "Have: length of payload not zero")
 
 	file, _ := parser.ParseFromFile(parser.GetTorrentFileList()[0])
-	pieceBlock := parser.RandomPieceBlock(file)
+	pieceBlock, _ := parser.RandomPieceBlock(file)
 
 	// BuildRequest
 	requestMessage, _ := BuildRequest(pieceBlock)
@@ -413,3 +429,58 @@ func TestParseMsg(t *testing.T) {
 	assert.Equal(t, p2, p1, "Port: length of payload not zero")
 
 }
+
+func TestBuildFastMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	haveAll, err := BuildHaveAll()
+	assert.Nil(err)
+	size, id, _ := ParseMsg(haveAll)
+	assert.Equal(uint32(1), size)
+	assert.Equal(uint8(14), id)
+
+	haveNone, err := BuildHaveNone()
+	assert.Nil(err)
+	size, id, _ = ParseMsg(haveNone)
+	assert.Equal(uint32(1), size)
+	assert.Equal(uint8(15), id)
+
+	piece := GetRandomPiece()
+	reject, err := BuildReject(piece)
+	assert.Nil(err)
+	size, id, payload := ParseMsg(reject)
+	assert.Equal(uint32(13), size)
+	assert.Equal(uint8(16), id)
+	assert.Equal(piece.Index, payload["index"].(uint32))
+	assert.Equal(piece.Begin, payload["begin"].(uint32))
+	assert.Equal(piece.Length, requestedBlock(payload).Length)
+}
+
+// TestCheckMsg checks that messages referring to blocks out of the torrent are refused
+func TestCheckMsg(t *testing.T) {
+	_, pieces, _ := getReaderTorrent()
+	have, _ := BuildHave(3)
+	assert.Nil(t, checkMsg(have.Bytes(), pieces))
+	have, _ = BuildHave(4)
+	assert.True(t, errors.Is(checkMsg(have.Bytes(), pieces), ErrBadMessage))
+
+	block := func(index uint32, begin uint32, length int) []byte {
+		message := new(bytes.Buffer)
+		binary.Write(message, binary.BigEndian, uint32(9+length))
+		binary.Write(message, binary.BigEndian, uint8(7))
+		binary.Write(message, binary.BigEndian, index)
+		binary.Write(message, binary.BigEndian, begin)
+		message.Write(make([]byte, length))
+		return message.Bytes()
+	}
+	assert.Nil(t, checkMsg(block(3, 0, 16), pieces))
+	assert.NotNil(t, checkMsg(block(4, 0, 16), pieces), "Piece out of range")
+	assert.NotNil(t, checkMsg(block(0, parser.BLOCK_LEN, 16), pieces), "Block out of range")
+	assert.NotNil(t, checkMsg(block(0, 8, 8), pieces), "Block not aligned")
+	assert.NotNil(t, checkMsg(block(0, 0, 20), pieces), "Block too long")
+
+	reject, _ := BuildReject(parser.PieceBlock{Index: 1, Begin: 0, Length: 16})
+	assert.Nil(t, checkMsg(reject.Bytes(), pieces))
+	reject, _ = BuildReject(parser.PieceBlock{Index: 1, Begin: 0, Length: 32})
+	assert.NotNil(t, checkMsg(reject.Bytes(), pieces))
+}
@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"sync"
+
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+)
+
+// pauseSet holds the torrents of a session that request no pieces, with the reason they were paused
+type pauseSet struct {
+	lock    sync.Mutex
+	reasons map[*piece.PieceTracker]error
+}
+
+func newPauseSet() *pauseSet {
+	return &pauseSet{reasons: make(map[*piece.PieceTracker]error)}
+}
+
+// pause stops requesting pieces of the torrent
+func pause(pieces *piece.PieceTracker, reason error) {
+	paused := sessionOf(pieces).paused
+	paused.lock.Lock()
+	_, wasPaused := paused.reasons[pieces]
+	paused.reasons[pieces] = reason
+	paused.lock.Unlock()
+	if !wasPaused {
+		emit(pieces, Event{Kind: TorrentPaused, Err: reason})
+	}
+}
+
+// unpause requests pieces of a paused torrent again. Peers request pieces on their next idle check
+func unpause(pieces *piece.PieceTracker) {
+	paused := sessionOf(pieces).paused
+	paused.lock.Lock()
+	_, wasPaused := paused.reasons[pieces]
+	delete(paused.reasons, pieces)
+	paused.lock.Unlock()
+	if wasPaused {
+		emit(pieces, Event{Kind: TorrentResumed})
+	}
+}
+
+// pauseReason returns why the torrent is paused, nil if it is not
+func pauseReason(pieces *piece.PieceTracker) error {
+	paused := sessionOf(pieces).paused
+	paused.lock.Lock()
+	defer paused.lock.Unlock()
+	return paused.reasons[pieces]
+}
+
+// checkDiskFull unpauses a torrent paused on a full disk once there is room for a piece again
+func checkDiskFull(report *tracker.ClientStatusReport, pieces *piece.PieceTracker, Log Log) {
+	cache, cached := report.Storage.(*storage.Cache)
+	if err := pauseReason(pieces); cached && err == nil && storage.IsDiskFull(cache.Err()) {
+		Log.Error.Println("Disk is full - pausing the torrent")
+		pause(pieces, cache.Err())
+	}
+	if reason := pauseReason(pieces); reason == nil || !storage.IsDiskFull(reason) {
+		return
+	}
+	free, err := storage.FreeSpace(storage.Dir(report.TorrentFile))
+	if err != nil && err != storage.ErrUnsupported {
+		Log.Error.Println("Unable to find free space:", err)
+		return
+	}
+	if err == storage.ErrUnsupported || free >= uint64(report.TorrentFile.PieceLength) {
+		Log.Info.Println("Disk has free space again - resuming the torrent")
+		if cached {
+			cache.Retry()
+		}
+		unpause(pieces)
+	}
+}
@@ -0,0 +1,29 @@
+package torrent
+
+import (
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+)
+
+// FilePriorities are the priorities of files, by index, for new torrents. Files not in it have normal priority
+var FilePriorities = map[int]piece.Priority{}
+
+// filePriority returns the priority of the file in priorities
+func filePriority(priorities map[int]piece.Priority, file int) piece.Priority {
+	if priority, ok := priorities[file]; ok {
+		return priority
+	}
+	return piece.Normal
+}
+
+// SetFilePriority changes the priority of a file of a torrent while it downloads.
+// A skipped file is created on disk once it is wanted
+func SetFilePriority(report *tracker.ClientStatusReport, pieces *piece.PieceTracker, file int, priority piece.Priority) error {
+	if selector, ok := report.Storage.(storage.Selector); ok && priority != piece.Skip {
+		if err := selector.Want(file); err != nil {
+			return err
+		}
+	}
+	return pieces.SetFilePriority(file, priority)
+}
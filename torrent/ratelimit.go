@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/concurrency-8/ratelimit"
+)
+
+// DownloadRate is the download rate in bytes per second of all torrents of a session together, 0 is unlimited
+var DownloadRate int64
+
+// UploadRate is the upload rate in bytes per second of all torrents of a session together, 0 is unlimited
+var UploadRate int64
+
+// TorrentDownloadRate is the download rate in bytes per second of every torrent, 0 is unlimited
+var TorrentDownloadRate int64
+
+// TorrentUploadRate is the upload rate in bytes per second of every torrent, 0 is unlimited
+var TorrentUploadRate int64
+
+// RateSchedule replaces the rates of a session at times of the day
+var RateSchedule ratelimit.Schedule
+
+// torrentLimiters are the limiters of a torrent
+type torrentLimiters struct {
+	download *ratelimit.Limiter
+	upload   *ratelimit.Limiter
+}
+
+// limiterSet holds the limiters of a session with its rates outside the schedule, and the limiters of every torrent by info hash
+type limiterSet struct {
+	lock                sync.Mutex
+	global              torrentLimiters
+	downloadRate        int64
+	uploadRate          int64
+	torrentDownloadRate int64
+	torrentUploadRate   int64
+	schedule            ratelimit.Schedule
+	torrents            map[string]torrentLimiters
+}
+
+func newLimiterSet(config Config) *limiterSet {
+	return &limiterSet{
+		global:              torrentLimiters{ratelimit.NewLimiter(config.DownloadRate), ratelimit.NewLimiter(config.UploadRate)},
+		downloadRate:        config.DownloadRate,
+		uploadRate:          config.UploadRate,
+		torrentDownloadRate: config.TorrentDownloadRate,
+		torrentUploadRate:   config.TorrentUploadRate,
+		schedule:            config.RateSchedule,
+		torrents:            make(map[string]torrentLimiters),
+	}
+}
+
+// torrentLimitersOf returns the limiters of a torrent, created with the torrent rates of the session.
+// The caller must hold limiters.lock
+func (limiters *limiterSet) torrentLimitersOf(infoHash string) torrentLimiters {
+	torrent, ok := limiters.torrents[infoHash]
+	if !ok {
+		torrent = torrentLimiters{ratelimit.NewLimiter(limiters.torrentDownloadRate), ratelimit.NewLimiter(limiters.torrentUploadRate)}
+		limiters.torrents[infoHash] = torrent
+	}
+	return torrent
+}
+
+// rateLimiters returns the limiters of reads and writes of a connection of the torrent
+func (session *Session) rateLimiters(infoHash string) (read []*ratelimit.Limiter, write []*ratelimit.Limiter) {
+	limiters := session.limiters
+	limiters.lock.Lock()
+	defer limiters.lock.Unlock()
+	torrent := limiters.torrentLimitersOf(infoHash)
+	return []*ratelimit.Limiter{limiters.global.download, torrent.download},
+		[]*ratelimit.Limiter{limiters.global.upload, torrent.upload}
+}
+
+// SetRateLimits changes the download and upload rates of the default session, see Session.SetRateLimits
+func SetRateLimits(download int64, upload int64) {
+	defaultSession().SetRateLimits(download, upload)
+}
+
+// SetTorrentRateLimits changes the download and upload rates of a torrent of the default session, by its info hash
+func SetTorrentRateLimits(infoHash string, download int64, upload int64) {
+	defaultSession().SetTorrentRateLimits(infoHash, download, upload)
+}
+
+// RateLimits returns the download and upload rates of the default session, see Session.RateLimits
+func RateLimits() (download int64, upload int64) {
+	return defaultSession().RateLimits()
+}
+
+// SetRateLimits changes the download and upload rates in bytes per second of all torrents of the session together.
+// The rates of the schedule of the session still apply at their times of the day
+func (session *Session) SetRateLimits(download int64, upload int64) {
+	limiters := session.limiters
+	limiters.lock.Lock()
+	limiters.downloadRate, limiters.uploadRate = download, upload
+	limiters.lock.Unlock()
+	session.applyRateSchedule()
+}
+
+// SetTorrentRateLimits changes the download and upload rates in bytes per second of a torrent, by its info hash
+func (session *Session) SetTorrentRateLimits(infoHash string, download int64, upload int64) {
+	limiters := session.limiters
+	limiters.lock.Lock()
+	defer limiters.lock.Unlock()
+	torrent := limiters.torrentLimitersOf(infoHash)
+	torrent.download.SetRate(download)
+	torrent.upload.SetRate(upload)
+}
+
+// RateLimits returns the download and upload rates in bytes per second of all torrents of the session together, as now applied
+func (session *Session) RateLimits() (download int64, upload int64) {
+	limiters := session.limiters
+	return limiters.global.download.Rate(), limiters.global.upload.Rate()
+}
+
+// applyRateSchedule sets the rates of the session from the rule of its schedule for the time of day
+func (session *Session) applyRateSchedule() {
+	limiters := session.limiters
+	limiters.lock.Lock()
+	defer limiters.lock.Unlock()
+	download, upload := limiters.schedule.Rates(time.Now(), limiters.downloadRate, limiters.uploadRate)
+	if limiters.global.download.Rate() != download {
+		limiters.global.download.SetRate(download)
+	}
+	if limiters.global.upload.Rate() != upload {
+		limiters.global.upload.SetRate(upload)
+	}
+}
+
+// forgetRateLimits drops the limiters of a torrent that is done
+func (session *Session) forgetRateLimits(infoHash string) {
+	limiters := session.limiters
+	limiters.lock.Lock()
+	defer limiters.lock.Unlock()
+	delete(limiters.torrents, infoHash)
+}
@@ -0,0 +1,39 @@
+package torrent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRateLimitedWrite checks that writes to a peer wait for the upload limiter of the torrent
+func TestRateLimitedWrite(t *testing.T) {
+	report, _, _ := getReaderTorrent()
+	defer defaultSession().forgetRateLimits(report.TorrentFile.InfoHash)
+	SetTorrentRateLimits(report.TorrentFile.InfoHash, 0, 1000)
+
+	client, server := net.Pipe()
+	conn := newPeerConn(server, defaultSession(), report)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	start := time.Now()
+	_, err := conn.Write(make([]byte, 1500))
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, time.Since(start))
+
+	_, write := defaultSession().rateLimiters(report.TorrentFile.InfoHash)
+	assert.Equal(t, int64(1000), write[1].Rate())
+}
+
+func TestSetRateLimits(t *testing.T) {
+	download, upload := RateLimits()
+	defer SetRateLimits(download, upload)
+	SetRateLimits(2048, 1024)
+	download, upload = RateLimits()
+	assert.Equal(t, []int64{2048, 1024}, []int64{download, upload})
+}
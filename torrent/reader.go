@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/tracker"
+)
+
+// Sequential downloads pieces in order in DefaultConfig, so that files can be read while they download
+var Sequential = false
+
+// ReadAhead is the number of pieces after the read position of a Reader that are downloaded first, in DefaultConfig
+var ReadAhead uint32 = 4
+
+// ErrReaderClosed is returned by reads of a closed Reader
+var ErrReaderClosed = fmt.Errorf("Reader is closed")
+
+// Reader reads a file of a torrent while it downloads. Reads block until the pieces
+// holding the range are verified, the pieces around the read position are downloaded first.
+// ReadAt can be called concurrently, Read and Seek can not
+type Reader struct {
+	report   *tracker.ClientStatusReport
+	pieces   *piece.PieceTracker
+	start    int64
+	length   int64
+	position int64
+	// closed is guarded by pieces.Lock
+	closed bool
+}
+
+// NewReader returns a Reader of a file of the torrent, by its index
+func NewReader(report *tracker.ClientStatusReport, pieces *piece.PieceTracker, file int) (*Reader, error) {
+	files := report.TorrentFile.Files
+	if file < 0 || file >= len(files) {
+		return nil, fmt.Errorf("File index %d out of range", file)
+	}
+	reader := &Reader{report: report, pieces: pieces, length: int64(files[file].Length)}
+	for _, f := range files[:file] {
+		reader.start += int64(f.Length)
+	}
+	reader.setWindow(0, 0)
+	return reader, nil
+}
+
+// Length returns the size of the file
+func (reader *Reader) Length() int64 {
+	return reader.length
+}
+
+// setWindow gives high priority to the pieces holding length bytes at off, and the ReadAhead pieces of the session after them
+func (reader *Reader) setWindow(off int64, length int64) {
+	if off >= reader.length {
+		return
+	}
+	pieceLength := int64(reader.report.TorrentFile.PieceLength)
+	lastPiece := uint32(len(reader.report.TorrentFile.Piece)/20 - 1)
+	first := uint32((reader.start + off) / pieceLength)
+	last := first
+	if length > 0 {
+		last = uint32((reader.start + off + length - 1) / pieceLength)
+	}
+	if last += sessionOf(reader.pieces).config.ReadAhead; last > lastPiece || last < first {
+		last = lastPiece
+	}
+	reader.pieces.SetWindow(reader, first, last)
+}
+
+// wait blocks until the piece is verified or the reader is closed
+func (reader *Reader) wait(index uint32) error {
+	reader.pieces.Lock.Lock()
+	defer reader.pieces.Lock.Unlock()
+	for {
+		if reader.closed {
+			return ErrReaderClosed
+		}
+		if reader.pieces.Verified(index) {
+			return nil
+		}
+		reader.pieces.WaitVerified()
+	}
+}
+
+// ReadAt reads len(p) bytes of the file at off, waiting for them to be downloaded
+func (reader *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset %d", off)
+	}
+	if off >= reader.length {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > reader.length-off {
+		p = p[:reader.length-off]
+		eof = io.EOF
+	}
+	reader.setWindow(off, int64(len(p)))
+
+	pieceLength := int64(reader.report.TorrentFile.PieceLength)
+	for n < len(p) {
+		position := reader.start + off + int64(n)
+		index := uint32(position / pieceLength)
+		if err = reader.wait(index); err != nil {
+			return
+		}
+		var pieceLen uint32
+		if pieceLen, err = parser.PieceLen(reader.report.TorrentFile, index); err != nil {
+			return
+		}
+		begin := position - int64(index)*pieceLength
+		end := len(p)
+		if rest := int64(pieceLen) - begin; int64(end-n) > rest {
+			end = n + int(rest)
+		}
+		var read int
+		read, err = reader.report.Storage.ReadAt(p[n:end], index, uint32(begin))
+		n += read
+		if err != nil {
+			return
+		}
+	}
+	return n, eof
+}
+
+// Read reads from the file at the read position, waiting for the data to be downloaded
+func (reader *Reader) Read(p []byte) (n int, err error) {
+	n, err = reader.ReadAt(p, reader.position)
+	reader.position += int64(n)
+	return
+}
+
+// Seek moves the read position. The pieces at the new position are downloaded first
+func (reader *Reader) Seek(offset int64, whence int) (int64, error) {
+	position := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		position += reader.position
+	case io.SeekEnd:
+		position += reader.length
+	default:
+		return reader.position, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if position < 0 {
+		return reader.position, fmt.Errorf("Negative position %d", position)
+	}
+	reader.position = position
+	reader.setWindow(position, 0)
+	return position, nil
+}
+
+// Close stops the reader. Reads waiting for data return ErrReaderClosed
+func (reader *Reader) Close() error {
+	reader.pieces.Lock.Lock()
+	reader.closed = true
+	reader.pieces.Lock.Unlock()
+	reader.pieces.ClearWindow(reader)
+	reader.pieces.Wake()
+	return nil
+}
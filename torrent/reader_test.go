@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/queue"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+// getReaderTorrent returns a torrent of 4 pieces of 16 bytes over files of 40 and 24 bytes, in memory
+func getReaderTorrent() (*tracker.ClientStatusReport, *piece.PieceTracker, []byte) {
+	data := getRandomByteArr(64)
+	file := parser.TorrentFile{PieceLength: 16, Length: 64, Piece: make([]byte, 4*20)}
+	file.Files = []*parser.File{{Length: 40}, {Length: 24}}
+	report := &tracker.ClientStatusReport{TorrentFile: file, Storage: storage.NewMemory(file)}
+	report.Storage.WriteAt(data, 0, 0)
+	return report, piece.NewPieceTracker(file), data
+}
+
+func TestReader(t *testing.T) {
+	report, pieces, data := getReaderTorrent()
+	config := DefaultConfig()
+	config.ReadAhead = 0
+	testSession(t, config, pieces)
+
+	reader, err := NewReader(report, pieces, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(24), reader.Length())
+	pieces.Lock.Lock()
+	assert.Equal(t, piece.High, pieces.PiecePriority(2))
+	assert.Equal(t, piece.Normal, pieces.PiecePriority(3))
+	pieces.Lock.Unlock()
+
+	// The read waits for both pieces of the file
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pieces.MarkVerified(2)
+		pieces.MarkVerified(3)
+	}()
+	read, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, data[40:], read)
+
+	position, err := reader.Seek(-4, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), position)
+	p := make([]byte, 8)
+	n, err := reader.Read(p)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, data[60:], p[:n])
+	assert.Nil(t, reader.Close())
+	_, err = reader.ReadAt(p, 0)
+	assert.Equal(t, ErrReaderClosed, err)
+}
+
+func TestReaderClose(t *testing.T) {
+	report, pieces, _ := getReaderTorrent()
+	reader, err := NewReader(report, pieces, 0)
+	assert.Nil(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := reader.ReadAt(make([]byte, 8), 0)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	reader.Close()
+	assert.Equal(t, ErrReaderClosed, <-done)
+	pieces.Lock.Lock()
+	assert.Equal(t, piece.Normal, pieces.PiecePriority(0))
+	pieces.Lock.Unlock()
+}
+
+func TestRequestPieceSequential(t *testing.T) {
+	report, pieces, _ := getReaderTorrent()
+	config := DefaultConfig()
+	config.Sequential = true
+	testSession(t, config, pieces)
+	queue := queue.NewQueue(report.TorrentFile)
+	queue.Choked = false
+	for _, index := range []uint32{3, 1, 2} {
+		queue.Enqueue(index)
+	}
+	client, server := net.Pipe()
+	go func() {
+		for i := 0; i < 3; i++ {
+			RequestPiece(tracker.Peer{}, server, pieces, queue, getLog())
+		}
+		server.Close()
+	}()
+	for _, index := range []uint32{1, 2, 3} {
+		resp := make([]byte, 17)
+		_, err := client.Read(resp)
+		assert.Nil(t, err)
+		_, _, payload := ParseMsg(bytes.NewBuffer(resp))
+		assert.Equal(t, index, payload["index"].(uint32))
+	}
+}
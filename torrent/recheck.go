@@ -0,0 +1,145 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+)
+
+// RecheckWorkers is the number of pieces hashed at once during a recheck
+var RecheckWorkers = runtime.NumCPU()
+
+// checkResult is the outcome of hashing one piece
+type checkResult struct {
+	index uint32
+	ok    bool
+}
+
+// Recheck reads every piece from storage and verifies its SHA-1 in a pool of RecheckWorkers.
+// The piece tracker is rebuilt from the result: verified pieces are done, all others are reset.
+// progress, if not nil, is called after every piece. The pieces that failed are returned
+func Recheck(report *tracker.ClientStatusReport, pieces *piece.PieceTracker, progress func(done int, total int)) (failed []uint32) {
+	numPieces := len(report.TorrentFile.Piece) / 20
+	indexes := make(chan uint32)
+	results := make(chan checkResult)
+	workers := RecheckWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for index := range indexes {
+				results <- checkResult{index, checkPiece(report, index)}
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < numPieces; i++ {
+			indexes <- uint32(i)
+		}
+		close(indexes)
+	}()
+
+	for done := 1; done <= numPieces; done++ {
+		result := <-results
+		if result.ok {
+			pieces.Fill(result.index)
+		} else {
+			pieces.Reset(result.index)
+			failed = append(failed, result.index)
+		}
+		if progress != nil {
+			progress(done, numPieces)
+		}
+	}
+	return
+}
+
+// checkPiece tells if the piece in storage matches its hash
+func checkPiece(report *tracker.ClientStatusReport, index uint32) bool {
+	length, err := parser.PieceLen(report.TorrentFile, index)
+	if err != nil {
+		return false
+	}
+	data := make([]byte, length)
+	if _, err = report.Storage.ReadAt(data, index, 0); err != nil {
+		return false
+	}
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], report.TorrentFile.Piece[index*20:(index+1)*20])
+}
+
+// FileCompleteness returns, for every file of the torrent, the number of its pieces that are done
+// and the number of pieces it spans
+func FileCompleteness(torrent parser.TorrentFile, pieces *piece.PieceTracker) (done []int, total []int) {
+	bitfield := pieces.Bitfield()
+	start := uint64(0)
+	for _, file := range torrent.Files {
+		fileDone, fileTotal := 0, 0
+		if file.Length > 0 {
+			first := uint32(start / uint64(torrent.PieceLength))
+			last := uint32((start + file.Length - 1) / uint64(torrent.PieceLength))
+			for index := first; index <= last; index++ {
+				fileTotal++
+				if bitfield[index/8]&(0x80>>(index%8)) != 0 {
+					fileDone++
+				}
+			}
+		}
+		done = append(done, fileDone)
+		total = append(total, fileTotal)
+		start += file.Length
+	}
+	return
+}
+
+// Verify checks the downloaded data of the torrent at path in the folders of the default session,
+// see Session.Verify
+func Verify(path string, out io.Writer) (ok bool, err error) {
+	return defaultSession().Verify(path, out)
+}
+
+// Verify checks the downloaded data of the torrent at path, in the folders of the session, against
+// its piece hashes without changing anything on disk. Per file completeness is written to out.
+// ok is false if any piece does not match
+func (session *Session) Verify(path string, out io.Writer) (ok bool, err error) {
+	config := session.config.Args
+	config.ReadOnly = true
+	torrentFile, err := parser.ParseFromFileWithArgs(path, nil, &config)
+	if err != nil {
+		return false, err
+	}
+	files := storage.NewFiles(torrentFile)
+	defer files.Close()
+
+	report := &tracker.ClientStatusReport{TorrentFile: torrentFile, Storage: files}
+	pieces := piece.NewPieceTracker(torrentFile)
+	failed := Recheck(report, pieces, func(done int, total int) {
+		fmt.Fprintf(out, "\rChecking %s: %d%%", torrentFile.Name, done*100/total)
+	})
+	fmt.Fprintln(out)
+
+	done, total := FileCompleteness(torrentFile, pieces)
+	for i, file := range torrentFile.Files {
+		percent := 100.0
+		if total[i] > 0 {
+			percent = float64(done[i]*100) / float64(total[i])
+		}
+		missing := ""
+		if file.FilePointer == nil {
+			missing = " (missing)"
+		}
+		fmt.Fprintf(out, "%6.2f%%  %d/%d pieces  %s%s\n", percent, done[i], total[i], strings.Join(file.Path, "/"), missing)
+	}
+	numPieces := len(torrentFile.Piece) / 20
+	fmt.Fprintf(out, "%d of %d pieces match\n", numPieces-len(failed), numPieces)
+	return len(failed) == 0, nil
+}
@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/resume"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+)
+
+// ResumeFile is the name of the resume file in the download folder of a torrent
+var ResumeFile = "resume.json"
+
+// ResumeInterval is how often the resume file is written while downloading
+var ResumeInterval time.Duration = 30
+
+func resumePath(torrent parser.TorrentFile) string {
+	return filepath.Join(torrent.Dir, torrent.Name, ResumeFile)
+}
+
+// loadResume reads the resume file of the torrent. The storage kind saved in it is used for the torrent,
+// as are the saved file priorities unless priorities were given
+func loadResume(torrent parser.TorrentFile, kind storage.Kind, priorities map[int]piece.Priority, Log Log) (*resume.State, storage.Kind, map[int]piece.Priority) {
+	state, err := resume.Load(resumePath(torrent))
+	if err != nil {
+		Log.Info.Println("No usable resume file:", err)
+		return nil, kind, priorities
+	}
+	if saved, err := storage.ParseKind(state.Settings.Storage); err == nil {
+		kind = saved
+	}
+	if len(priorities) == 0 && len(state.Settings.Priorities) > 0 {
+		priorities = make(map[int]piece.Priority)
+		for file, name := range state.Settings.Priorities {
+			if priority, err := piece.ParsePriority(name); err == nil {
+				priorities[file] = priority
+			}
+		}
+	}
+	return &state, kind, priorities
+}
+
+// restoreResume marks the pieces of a valid resume file as done. If there is no resume file,
+// or it does not match the files on disk, every piece is rechecked instead
+func restoreResume(state *resume.State, report *tracker.ClientStatusReport, pieces *piece.PieceTracker, progress func(int, int), Log Log) {
+	if state != nil {
+		err := state.Validate(report.TorrentFile)
+		if err == nil {
+			for i := 0; i < pieces.NumPieces(); i++ {
+				if state.Has(uint32(i)) {
+					pieces.Fill(uint32(i))
+				}
+			}
+			Log.Info.Println("Resumed from", resumePath(report.TorrentFile))
+			return
+		}
+		Log.Info.Println("Resume file not trusted:", err)
+	}
+	Log.Info.Println("Rechecking all pieces")
+	failed := Recheck(report, pieces, progress)
+	Log.Info.Println("Recheck done,", pieces.NumPieces()-len(failed), "of", pieces.NumPieces(), "pieces are valid")
+}
+
+// saveResume writes the resume file of the torrent
+func saveResume(report *tracker.ClientStatusReport, pieces *piece.PieceTracker, kind storage.Kind, Log Log) {
+	if kind == storage.Memory {
+		// nothing survives the process
+		return
+	}
+	settings := resume.Settings{Storage: kind.String(), Priorities: make(map[int]string)}
+	for i := range report.TorrentFile.Files {
+		if priority := pieces.FilePriority(i); priority != piece.Normal {
+			settings.Priorities[i] = priority.String()
+		}
+	}
+	// Only verified pieces are saved, pieces received but not hashed or written yet are not.
+	// They are taken before the flush: the resume file must not claim pieces that are only in the cache
+	bitfield := pieces.Bitfield()
+	if flusher, ok := report.Storage.(storage.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			Log.Error.Println("Unable to write resume file:", err)
+			return
+		}
+	}
+	moving.Lock()
+	state, err := resume.Snapshot(report.TorrentFile, bitfield, settings)
+	moving.Unlock()
+	if err == nil {
+		err = resume.Save(resumePath(report.TorrentFile), state)
+	}
+	if err != nil {
+		Log.Error.Println("Unable to write resume file:", err)
+	}
+}
+
+// saveResumePeriodically writes the resume file every ResumeInterval until done is closed
+func saveResumePeriodically(report *tracker.ClientStatusReport, pieces *piece.PieceTracker, kind storage.Kind, done chan struct{}, Log Log) {
+	ticker := time.NewTicker(ResumeInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			saveResume(report, pieces, kind, Log)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/concurrency-8/args"
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+// getStoredTorrent returns a torrent of four pieces in one file, of which pieces 0 and 2 are on disk
+func getStoredTorrent(t *testing.T) (report *tracker.ClientStatusReport, data []byte) {
+	dir, err := ioutil.TempDir("", "torrent")
+	assert.Nil(t, err)
+	data = getRandomByteArr(4 * 16)
+	file, err := os.Create(filepath.Join(dir, "data"))
+	assert.Nil(t, err)
+	torrent := parser.TorrentFile{Name: dir, InfoHash: "01234567890123456789", PieceLength: 16, Length: uint64(len(data))}
+	torrent.Files = []*parser.File{{Path: []string{"data"}, Length: torrent.Length, FilePointer: file}}
+	for i := 0; i < 4; i++ {
+		hash := sha1.Sum(data[i*16 : (i+1)*16])
+		torrent.Piece = append(torrent.Piece, hash[:]...)
+	}
+	report = &tracker.ClientStatusReport{TorrentFile: torrent, Storage: storage.NewFiles(torrent)}
+	report.Storage.WriteAt(data[:16], 0, 0)
+	report.Storage.WriteAt(data[32:48], 2, 0)
+	return
+}
+
+func TestRecheck(t *testing.T) {
+	report, _ := getStoredTorrent(t)
+	defer os.RemoveAll(report.TorrentFile.Name)
+	pieces := piece.NewPieceTracker(report.TorrentFile)
+
+	// Without a resume file every piece is rechecked
+	restoreResume(nil, report, pieces, nil, getLog())
+	assert.Equal(t, []byte{0xA0}, pieces.Bitfield())
+}
+
+func TestResume(t *testing.T) {
+	report, _ := getStoredTorrent(t)
+	defer os.RemoveAll(report.TorrentFile.Name)
+	pieces := piece.NewPieceTracker(report.TorrentFile)
+	pieces.Fill(0)
+	// piece 2 is received but not verified, it is not saved
+	pieces.AddReceived(parser.PieceBlock{Index: 2, Begin: 0})
+	saveResume(report, pieces, storage.Files, getLog())
+
+	// The resume file is trusted while the files are unchanged
+	state, kind, _ := loadResume(report.TorrentFile, storage.MMap, nil, getLog())
+	assert.NotNil(t, state)
+	assert.Equal(t, storage.Files, kind, "Saved storage not restored")
+	resumed := piece.NewPieceTracker(report.TorrentFile)
+	restoreResume(state, report, resumed, nil, getLog())
+	assert.Equal(t, []byte{0x80}, resumed.Bitfield())
+
+	// Data written after the resume file falls back to a recheck
+	report.Storage.WriteAt(make([]byte, 20), 3, 0)
+	rechecked := piece.NewPieceTracker(report.TorrentFile)
+	restoreResume(state, report, rechecked, nil, getLog())
+	assert.Equal(t, []byte{0xA0}, rechecked.Bitfield())
+}
+
+func TestRecheckWorkers(t *testing.T) {
+	report, _ := getStoredTorrent(t)
+	defer os.RemoveAll(report.TorrentFile.Name)
+	pieces := piece.NewPieceTracker(report.TorrentFile)
+	pieces.Fill(1)
+
+	workers := RecheckWorkers
+	RecheckWorkers = 3
+	defer func() { RecheckWorkers = workers }()
+	calls := 0
+	failed := Recheck(report, pieces, func(done int, total int) {
+		calls++
+		assert.Equal(t, calls, done)
+		assert.Equal(t, 4, total)
+	})
+	assert.Equal(t, 4, calls)
+	assert.ElementsMatch(t, []uint32{1, 3}, failed)
+	// Pieces that do not match are reset
+	assert.Equal(t, []byte{0xA0}, pieces.Bitfield())
+}
+
+func TestFileCompleteness(t *testing.T) {
+	torrent := parser.TorrentFile{PieceLength: 4, Length: 14, Piece: make([]byte, 4*20)}
+	for _, length := range []uint64{6, 0, 2, 6} {
+		torrent.Files = append(torrent.Files, &parser.File{Length: length})
+	}
+	pieces := piece.NewPieceTracker(torrent)
+	pieces.Fill(0)
+	pieces.Fill(3)
+	done, total := FileCompleteness(torrent, pieces)
+	assert.Equal(t, []int{1, 0, 0, 1}, done)
+	assert.Equal(t, []int{2, 0, 1, 2}, total)
+}
+
+func TestVerifyMissingData(t *testing.T) {
+	out := new(bytes.Buffer)
+	ok, err := Verify("../test_torrents/big-buck-bunny.torrent", out)
+	assert.Nil(t, err)
+	assert.False(t, ok, "Missing data verified")
+	assert.Contains(t, out.String(), "(missing)")
+	assert.False(t, args.ARGS.ReadOnly, "ReadOnly not restored")
+}
@@ -0,0 +1,719 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/concurrency-8/args"
+	"github.com/concurrency-8/mse"
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/ratelimit"
+	"github.com/concurrency-8/resume"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+)
+
+// Config is the configuration of a Session. Limits of 0 use the package variables of the same name
+type Config struct {
+	// Args are the folders and the resume options of the torrents
+	Args args.Args
+	// Port is the port of the first torrent, the next torrents take the ports after it
+	Port           int
+	StorageKind    storage.Kind
+	AllocationMode storage.Allocation
+	CacheSize      int64
+	DiskWorkers    int
+	FilePriorities map[int]piece.Priority
+	// MaxConnections and MaxConnectionsPerTorrent limit the connections of the session, MaxHalfOpen its connection attempts
+	MaxConnections           int
+	MaxConnectionsPerTorrent int
+	MaxHalfOpen              int
+	// UTP, EncryptionPolicy, FastExtension and LazyBitfield are how the session talks to peers
+	UTP              bool
+	EncryptionPolicy mse.Policy
+	FastExtension    bool
+	LazyBitfield     bool
+	// Sequential downloads pieces in order, ReadAhead pieces after the read position of a Reader come first
+	Sequential bool
+	ReadAhead  uint32
+	// MaxBuffers is the number of pieces of every torrent being downloaded at once
+	MaxBuffers int
+	// HashWorkers is the number of goroutines verifying the pieces of the session
+	HashWorkers int
+	// DownloadRate and UploadRate limit all torrents of the session together, the torrent rates every torrent,
+	// in bytes per second. 0 is unlimited. RateSchedule replaces the session rates at times of the day
+	DownloadRate        int64
+	UploadRate          int64
+	TorrentDownloadRate int64
+	TorrentUploadRate   int64
+	RateSchedule        ratelimit.Schedule
+	// BanThreshold and BanDuration in seconds are how peers that send bad data are banned from the session
+	BanThreshold int
+	BanDuration  time.Duration
+	// HTTPAddress serves the files of the torrents over HTTP when not empty, see HTTPHandler
+	HTTPAddress string
+	// LogDir is the folder of the log files of the torrents
+	LogDir string
+}
+
+// DefaultConfig returns the configuration given by args.ARGS and the variables of the package
+func DefaultConfig() Config {
+	priorities := make(map[int]piece.Priority, len(FilePriorities))
+	for file, priority := range FilePriorities {
+		priorities[file] = priority
+	}
+	return Config{
+		Args:                *args.ARGS,
+		Port:                20000,
+		StorageKind:         StorageKind,
+		AllocationMode:      AllocationMode,
+		CacheSize:           CacheSize,
+		DiskWorkers:         storage.DiskWorkers,
+		FilePriorities:      priorities,
+		MaxHalfOpen:         MaxHalfOpen,
+		UTP:                 UTP,
+		EncryptionPolicy:    EncryptionPolicy,
+		FastExtension:       FastExtension,
+		LazyBitfield:        LazyBitfield,
+		Sequential:          Sequential,
+		ReadAhead:           ReadAhead,
+		MaxBuffers:          piece.MaxBuffers,
+		HashWorkers:         HashWorkers,
+		DownloadRate:        DownloadRate,
+		UploadRate:          UploadRate,
+		TorrentDownloadRate: TorrentDownloadRate,
+		TorrentUploadRate:   TorrentUploadRate,
+		RateSchedule:        append(ratelimit.Schedule(nil), RateSchedule...),
+		BanThreshold:        BanThreshold,
+		BanDuration:         BanDuration,
+		LogDir:              "Logs",
+	}
+}
+
+// withDefaults replaces the limits of 0 with the package variables
+func (config Config) withDefaults() Config {
+	if config.DiskWorkers <= 0 {
+		config.DiskWorkers = storage.DiskWorkers
+	}
+	if config.MaxHalfOpen <= 0 {
+		config.MaxHalfOpen = MaxHalfOpen
+	}
+	if config.MaxBuffers <= 0 {
+		config.MaxBuffers = piece.MaxBuffers
+	}
+	if config.HashWorkers <= 0 {
+		config.HashWorkers = HashWorkers
+	}
+	if config.BanThreshold <= 0 {
+		config.BanThreshold = BanThreshold
+	}
+	if config.BanDuration <= 0 {
+		config.BanDuration = BanDuration
+	}
+	return config
+}
+
+// Session is an instance of the client. It owns its configuration, its HTTP listener, its connection
+// manager, its hash workers, its rate limiters, its ban list and its torrents, so that several sessions
+// in one process share nothing. Peers are only dialed, a session does not accept them
+type Session struct {
+	config   Config
+	active   *torrentSet
+	conns    *connManager
+	server   *http.Server
+	lock     sync.Mutex
+	torrents map[string]*Torrent
+	nextPort int
+	closed   bool
+	// subscribers receive the events of every torrent
+	subscribers subscribers
+
+	// the state of the running torrents, by piece tracker
+	events      *eventSet
+	swarms      *swarmSet
+	hashing     *hashPool
+	writing     *writerSet
+	retries     *retrySet
+	attribution *attributionSet
+	paused      *pauseSet
+	// bans and limiters apply to every torrent of the session
+	bans     *banList
+	limiters *limiterSet
+}
+
+// Torrent is a torrent being downloaded by a Session
+type Torrent struct {
+	session *Session
+	path    string
+	kind    storage.Kind
+	report  *tracker.ClientStatusReport
+	pieces  *piece.PieceTracker
+	Log     Log
+	logFile *os.File
+	// resumeState is the resume file read when the torrent was added, nil if none
+	resumeState *resume.State
+
+	// ctx ends when the context the torrent was added with ends, or when it is removed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// parent is the context the torrent was added with
+	parent   context.Context
+	done     chan struct{}
+	lock     sync.Mutex
+	progress int
+	err      error
+	// filesDone are the files for which FileCompleted was sent, guarded by lock
+	filesDone   map[int]bool
+	subscribers subscribers
+}
+
+// ErrSessionClosed is returned when adding a torrent to a closed session
+var ErrSessionClosed = fmt.Errorf("Session is closed")
+
+// ErrUnknownTorrent is returned for a torrent of another session
+var ErrUnknownTorrent = fmt.Errorf("Torrent is not in the session")
+
+// ErrTorrentExists is wrapped by the error of adding a torrent that is already in the session
+var ErrTorrentExists = fmt.Errorf("Torrent is already in the session")
+
+// ErrNoPeers is the error of a torrent for which no tracker gave peers. The error of the last
+// tracker tried, a *tracker.AnnounceError, is wrapped with it
+var ErrNoPeers = fmt.Errorf("Unable to receive peers! Problem with the torrent or internet")
+
+// noPeersError is ErrNoPeers wrapping the error of the last tracker tried
+type noPeersError struct {
+	last error
+}
+
+func (e *noPeersError) Error() string {
+	if e.last == nil {
+		return ErrNoPeers.Error()
+	}
+	return fmt.Sprintf("%v: %v", ErrNoPeers, e.last)
+}
+
+func (e *noPeersError) Is(target error) bool {
+	return target == ErrNoPeers
+}
+
+func (e *noPeersError) Unwrap() error {
+	return e.last
+}
+
+// StorageError is returned when the storage of a torrent can not be set up: the disk is too small
+// (storage.ErrNoSpace), the files can not be allocated or the storage kind is unavailable
+type StorageError struct {
+	Kind storage.Kind
+	Err  error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("Unable to open %v storage: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns the error of the storage
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// errPausedByUser is the reason of a torrent paused with Session.Pause
+var errPausedByUser = fmt.Errorf("Paused")
+
+var defaultSessionOnce sync.Once
+
+var defaultSessionInstance *Session
+
+// defaultSession returns the session of DownloadFromFile, HTTPHandler and the package level functions,
+// configured by DefaultConfig the first time it is used. It serves the package level HTTP handler
+func defaultSession() *Session {
+	defaultSessionOnce.Do(func() {
+		defaultSessionInstance = newSession(DefaultConfig(), active)
+	})
+	return defaultSessionInstance
+}
+
+func newSession(config Config, set *torrentSet) *Session {
+	config = config.withDefaults()
+	return &Session{
+		config:      config,
+		active:      set,
+		conns:       newConnManager(config),
+		torrents:    make(map[string]*Torrent),
+		nextPort:    config.Port,
+		events:      newEventSet(),
+		swarms:      newSwarmSet(),
+		hashing:     newHashPool(config.HashWorkers),
+		writing:     newWriterSet(),
+		retries:     newRetrySet(),
+		attribution: newAttributionSet(),
+		paused:      newPauseSet(),
+		bans:        newBanList(),
+		limiters:    newLimiterSet(config),
+	}
+}
+
+// NewSession returns a session with its own configuration. Its files are served over HTTP if
+// config.HTTPAddress is set
+func NewSession(config Config) (*Session, error) {
+	session := newSession(config, newTorrentSet())
+	if config.HTTPAddress != "" {
+		listener, err := net.Listen("tcp", config.HTTPAddress)
+		if err != nil {
+			return nil, err
+		}
+		session.server = &http.Server{Handler: session.HTTPHandler()}
+		go session.server.Serve(listener)
+	}
+	return session, nil
+}
+
+// sessions holds the session of every running torrent by its piece tracker, so that the peers
+// and pieces of a torrent find the state of its session
+var sessions = struct {
+	lock     sync.Mutex
+	trackers map[*piece.PieceTracker]*Session
+}{trackers: make(map[*piece.PieceTracker]*Session)}
+
+// attach makes pieces a torrent of the session
+func attach(session *Session, pieces *piece.PieceTracker) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	sessions.trackers[pieces] = session
+}
+
+// detach forgets the session of pieces once its torrent ended
+func detach(pieces *piece.PieceTracker) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	delete(sessions.trackers, pieces)
+}
+
+// sessionOf returns the session of the torrent of pieces. Pieces of no session, as those given to
+// DownloadFromPeer, belong to the default session
+func sessionOf(pieces *piece.PieceTracker) *Session {
+	sessions.lock.Lock()
+	session := sessions.trackers[pieces]
+	sessions.lock.Unlock()
+	if session == nil {
+		return defaultSession()
+	}
+	return session
+}
+
+// Config returns the configuration of the session
+func (session *Session) Config() Config {
+	return session.config
+}
+
+// HTTPHandler serves the files of the torrents of the session, see the package level HTTPHandler
+func (session *Session) HTTPHandler() http.Handler {
+	return session.active.handler()
+}
+
+// Torrents returns the torrents of the session
+func (session *Session) Torrents() (torrents []*Torrent) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	for _, t := range session.torrents {
+		torrents = append(torrents, t)
+	}
+	return
+}
+
+// AddTorrent starts downloading the torrent file at path, on the next free port of the session
+func (session *Session) AddTorrent(path string) (*Torrent, error) {
+	return session.AddTorrentContext(context.Background(), path)
+}
+
+// AddTorrentContext is AddTorrent for a torrent that is stopped when ctx ends, as if removed.
+// Its Err is then the error of ctx
+func (session *Session) AddTorrentContext(ctx context.Context, path string) (*Torrent, error) {
+	session.lock.Lock()
+	port := session.nextPort
+	session.nextPort++
+	session.lock.Unlock()
+	return session.addTorrent(ctx, path, port)
+}
+
+// addTorrent opens the torrent file at path and its storage, then downloads it in the background
+func (session *Session) addTorrent(ctx context.Context, path string, port int) (*Torrent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session.lock.Lock()
+	closed := session.closed
+	session.lock.Unlock()
+	if closed {
+		return nil, ErrSessionClosed
+	}
+
+	// Set up logs
+	logFolder := filepath.Join(session.config.LogDir, path)
+	os.MkdirAll(logFolder, os.ModePerm)
+	logFile, _ := os.Create(filepath.Join(logFolder, "Download.log"))
+	t := &Torrent{session: session, path: path, logFile: logFile, parent: ctx, done: make(chan struct{}), filesDone: make(map[int]bool)}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.Log.Info = log.New(logFile, "INFO ", log.Ldate|log.Ltime|log.Lshortfile)
+	t.Log.Error = log.New(logFile, "ERROR ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	if err := t.open(port); err != nil {
+		t.Log.Error.Println(err)
+		t.cancel()
+		logFile.Close()
+		return nil, err
+	}
+
+	infoHash := t.report.TorrentFile.InfoHash
+	session.lock.Lock()
+	_, exists := session.torrents[infoHash]
+	closed = session.closed
+	if !closed && !exists {
+		session.torrents[infoHash] = t
+	}
+	session.lock.Unlock()
+	if closed || exists {
+		t.cancel()
+		t.closeStorage()
+		logFile.Close()
+		if exists {
+			return nil, fmt.Errorf("%w: %s", ErrTorrentExists, hex.EncodeToString([]byte(infoHash)))
+		}
+		return nil, ErrSessionClosed
+	}
+
+	registerEvents(t)
+	t.emit(Event{Kind: MetadataReceived})
+	go t.run()
+	return t, nil
+}
+
+// open parses the torrent file with the files of the wanted priorities and opens its storage
+func (t *Torrent) open(port int) (err error) {
+	config := &t.session.config
+	// No file is opened until the file priorities are known
+	torrentFile, err := parser.ParseFromFileWithArgs(t.path, func(int) bool { return false }, &config.Args)
+	if err != nil {
+		return fmt.Errorf("Unable to open torrentfile: %w", err)
+	}
+	t.kind = config.StorageKind
+	priorities := config.FilePriorities
+	if config.Args.Resume {
+		t.resumeState, t.kind, priorities = loadResume(torrentFile, t.kind, priorities, t.Log)
+	}
+	torrentFile, err = parser.ParseFromFileWithArgs(t.path, func(file int) bool {
+		return filePriority(priorities, file) != piece.Skip
+	}, &config.Args)
+	if err != nil {
+		return fmt.Errorf("Unable to open torrentfile: %w", err)
+	}
+	t.Log.Info.Println("TorrentFile parsed")
+	t.report = tracker.GetClientStatusReport(torrentFile, uint16(port))
+	defer func() {
+		if err != nil {
+			t.closeStorage()
+		}
+	}()
+
+	if t.kind != storage.Memory {
+		if err = storage.CheckFreeSpace(torrentFile); err != nil {
+			return &StorageError{Kind: t.kind, Err: err}
+		}
+		if err = storage.Allocate(torrentFile, config.AllocationMode); err != nil {
+			return &StorageError{Kind: t.kind, Err: err}
+		}
+	}
+	t.report.Storage, err = storage.New(t.kind, torrentFile)
+	if err != nil {
+		return &StorageError{Kind: t.kind, Err: err}
+	}
+	if t.kind != storage.Memory && config.CacheSize > 0 {
+		t.report.Storage = storage.NewCacheWorkers(torrentFile, t.report.Storage, config.CacheSize, config.DiskWorkers)
+	}
+
+	t.pieces = piece.NewPieceTracker(torrentFile)
+	t.pieces.Buffers.Max = config.MaxBuffers
+	for file, priority := range priorities {
+		if err := t.pieces.SetFilePriority(file, priority); err != nil {
+			t.Log.Error.Println("Unable to set priority of file", file, err)
+		}
+	}
+	return nil
+}
+
+// announce gets the peer list from the first tracker that answers. It gives up when the torrent stops
+func (t *Torrent) announce() (*tracker.AnnounceResponse, error) {
+	var last error
+	for _, announceURL := range t.report.TorrentFile.Announce {
+		u, err := url.Parse(announceURL)
+		if err != nil {
+			last = &tracker.AnnounceError{URL: announceURL, Err: err}
+			t.emit(Event{Kind: Announced, Tracker: announceURL, Err: last})
+			continue
+		}
+		t.Log.Info.Println("Contacting tracker[", announceURL, "] for peer list...")
+		for count := 0; count < MaxTryTracker; count++ {
+			announceResp, err := tracker.GetPeersContext(t.ctx, u, t.report)
+			if err == nil {
+				t.emit(Event{Kind: Announced, Tracker: announceURL, Peers: len(announceResp.Peers)})
+				return announceResp, nil
+			}
+			if t.ctx.Err() != nil {
+				return nil, t.ctx.Err()
+			}
+			t.emit(Event{Kind: Announced, Tracker: announceURL, Err: err})
+			last = err
+			t.Log.Info.Println("Failed(", err, "). Trying again...")
+		}
+	}
+	return nil, &noPeersError{last: last}
+}
+
+// run downloads the torrent until it is done or stopped
+func (t *Torrent) run() {
+	defer close(t.done)
+	defer t.session.remove(t)
+	config := &t.session.config
+	report, pieces := t.report, t.pieces
+
+	announceResp, err := t.announce()
+	if err != nil {
+		t.Log.Error.Println(err)
+		if t.ctx.Err() != nil {
+			// removed while announcing
+			err = t.stopReason()
+		}
+		t.finish(err)
+		return
+	}
+	if config.Args.Resume {
+		restoreResume(t.resumeState, report, pieces, func(done int, total int) {
+			t.setProgress(done * 100 / total)
+		}, t.Log)
+	}
+	moveCompleted(report, pieces, allFiles(report.TorrentFile), t.Log)
+	// files complete on disk already are not completed again
+	for _, file := range allFiles(report.TorrentFile) {
+		if fileVerified(report.TorrentFile, pieces, file) {
+			t.lock.Lock()
+			t.filesDone[file] = true
+			t.lock.Unlock()
+		}
+	}
+	t.session.active.activate(report, pieces)
+	stopResume := make(chan struct{})
+	if config.Args.ResumeCapability {
+		go saveResumePeriodically(report, pieces, t.kind, stopResume, t.Log)
+	}
+	// Peers are connected to within the connection limits, best first
+	startConnections(t.ctx, t.session, report, pieces, t.Log)
+	addPeers(pieces, announceResp.Peers)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for stopped := false; !stopped && !pieces.IsDone(); {
+		checkDiskFull(report, pieces, t.Log)
+		t.session.applyRateSchedule()
+		t.updateProgress()
+		select {
+		case <-t.ctx.Done():
+			stopped = true
+		case <-ticker.C:
+		}
+	}
+
+	// hashes finish while the peers are connected, a piece failing is put back in their queues
+	waitHashed(pieces)
+	stopConnections(pieces)
+	waitHashed(pieces)
+	forgetRetries(pieces)
+	forgetAttribution(pieces)
+	stats := t.session.HashStatistics()
+	t.Log.Info.Println("The hash workers of the session hashed", stats.Hashed, "pieces,", stats.Failed, "failed, in", stats.HashTime, "- waited", stats.WaitTime, "in the queue")
+	t.updateProgress()
+	close(stopResume)
+	if config.Args.ResumeCapability {
+		saveResume(report, pieces, t.kind, t.Log)
+	}
+	t.session.active.deactivate(report)
+	t.Log.Info.Println("All peer threads finished!")
+	t.finish(t.stopReason())
+}
+
+// stopReason is the error of the context the torrent was added with, nil if the torrent
+// was removed or is done
+func (t *Torrent) stopReason() error {
+	return t.parent.Err()
+}
+
+// finish closes the storage and the log of the torrent, records why it ended and sends
+// TorrentCompleted or TorrentError
+func (t *Torrent) finish(err error) {
+	t.session.forgetRateLimits(t.report.TorrentFile.InfoHash)
+	if closeErr := t.closeStorage(); closeErr != nil {
+		t.Log.Error.Println("Unable to write the torrent to disk:", closeErr)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	t.lock.Lock()
+	t.err = err
+	t.lock.Unlock()
+	if err != nil {
+		t.emit(Event{Kind: TorrentError, Err: err})
+	} else if t.pieces.IsDone() {
+		t.emit(Event{Kind: TorrentCompleted})
+	}
+	t.subscribers.close()
+	unpause(t.pieces)
+	forgetEvents(t.pieces)
+	// Closing log files
+	t.logFile.Close()
+}
+
+// closeStorage closes the storage and the files of the torrent
+func (t *Torrent) closeStorage() (err error) {
+	if t.report.Storage != nil {
+		err = t.report.Storage.Close()
+	}
+	for _, file := range t.report.TorrentFile.Files {
+		if file.FilePointer != nil {
+			file.FilePointer.Close()
+		}
+	}
+	return
+}
+
+// remove forgets a torrent that ended
+func (session *Session) remove(t *Torrent) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.torrents[t.InfoHash()] == t {
+		delete(session.torrents, t.InfoHash())
+	}
+}
+
+// RemoveTorrent stops downloading a torrent and waits until its connections and files are closed.
+// The downloaded data and the resume file are kept
+func (session *Session) RemoveTorrent(t *Torrent) error {
+	if t.session != session {
+		return ErrUnknownTorrent
+	}
+	t.cancel()
+	<-t.done
+	return nil
+}
+
+// Pause stops requesting pieces of a torrent. Its peers stay connected
+func (session *Session) Pause(t *Torrent) error {
+	if t.session != session {
+		return ErrUnknownTorrent
+	}
+	pause(t.pieces, errPausedByUser)
+	return nil
+}
+
+// Resume requests pieces of a torrent paused with Pause again
+func (session *Session) Resume(t *Torrent) error {
+	if t.session != session {
+		return ErrUnknownTorrent
+	}
+	if pauseReason(t.pieces) == errPausedByUser {
+		unpause(t.pieces)
+	}
+	return nil
+}
+
+// Close removes every torrent and stops the HTTP listener and hash workers of the session. If ctx ends first,
+// Close returns its error and the torrents keep closing in the background
+func (session *Session) Close(ctx context.Context) error {
+	session.lock.Lock()
+	session.closed = true
+	session.lock.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		for _, t := range session.Torrents() {
+			session.RemoveTorrent(t)
+		}
+		session.hashing.stop()
+		session.subscribers.close()
+		close(closed)
+	}()
+	var err error
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if session.server != nil {
+		if shutdownErr := session.server.Shutdown(ctx); err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+// InfoHash returns the info hash of the torrent
+func (t *Torrent) InfoHash() string {
+	return t.report.TorrentFile.InfoHash
+}
+
+// Name returns the name of the torrent
+func (t *Torrent) Name() string {
+	return t.report.TorrentFile.Name
+}
+
+// Report returns the status report of the torrent, with its files and storage
+func (t *Torrent) Report() *tracker.ClientStatusReport {
+	return t.report
+}
+
+// Pieces returns the piece tracker of the torrent
+func (t *Torrent) Pieces() *piece.PieceTracker {
+	return t.pieces
+}
+
+// Done is closed once the torrent is downloaded or removed and its files are closed
+func (t *Torrent) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns why the torrent ended, nil while it runs or if it ended normally
+func (t *Torrent) Err() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err
+}
+
+// Paused tells if the torrent requests no pieces, as when paused or when the disk is full
+func (t *Torrent) Paused() bool {
+	return pauseReason(t.pieces) != nil
+}
+
+// Progress returns the percentage of the wanted pieces downloaded, or rechecked while resuming
+func (t *Torrent) Progress() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.progress
+}
+
+func (t *Torrent) setProgress(percent int) {
+	t.lock.Lock()
+	t.progress = percent
+	t.lock.Unlock()
+}
+
+// updateProgress sets the progress from the pieces received
+func (t *Torrent) updateProgress() {
+	t.setProgress(t.pieces.PrintPercentageDone())
+}
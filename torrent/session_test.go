@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/concurrency-8/args"
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeebo/bencode"
+)
+
+// getSession returns a session downloading into a new folder, and a torrent file of one piece
+// announced to a tracker that gives no peers
+func getSession(t *testing.T) (session *Session, path string, dir string) {
+	dir, err := ioutil.TempDir("", "session")
+	assert.Nil(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := bencode.EncodeBytes(map[string]interface{}{"interval": 60, "peers": ""})
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	path = writeTorrent(t, dir, server.URL)
+
+	config := DefaultConfig()
+	config.Args = args.Args{IncompleteDir: dir}
+	config.StorageKind = storage.Memory
+	config.LogDir = filepath.Join(dir, "Logs")
+	session, err = NewSession(config)
+	assert.Nil(t, err)
+	return
+}
+
+// testSession returns a new session of config with pieces as its torrent, the way AddTorrent adds it
+func testSession(t *testing.T, config Config, pieces *piece.PieceTracker) *Session {
+	session := newSession(config, newTorrentSet())
+	attach(session, pieces)
+	t.Cleanup(func() { detach(pieces) })
+	return session
+}
+
+// writeTorrent writes a torrent file of one piece announced to announce into dir
+func writeTorrent(t *testing.T, dir string, announce string) string {
+	info, err := bencode.EncodeBytes(map[string]interface{}{"name": "session", "length": 16, "piece length": 16, "pieces": string(make([]byte, 20))})
+	assert.Nil(t, err)
+	data, err := bencode.EncodeBytes(map[string]interface{}{"announce": announce, "info": bencode.RawMessage(info)})
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "session.torrent")
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	return path
+}
+
+func TestSession(t *testing.T) {
+	session, path, dir := getSession(t)
+	defer os.RemoveAll(dir)
+
+	torrent, err := session.AddTorrent(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "session", torrent.Name())
+	assert.Equal(t, dir, torrent.Report().TorrentFile.Dir)
+	assert.Equal(t, []*Torrent{torrent}, session.Torrents())
+	_, err = session.AddTorrent(path)
+	assert.True(t, errors.Is(err, ErrTorrentExists), "Torrent added twice")
+
+	assert.Nil(t, session.Pause(torrent))
+	assert.True(t, torrent.Paused())
+	assert.Nil(t, session.Resume(torrent))
+	assert.False(t, torrent.Paused())
+
+	assert.Nil(t, session.RemoveTorrent(torrent))
+	<-torrent.Done()
+	assert.Nil(t, torrent.Err())
+	assert.Empty(t, session.Torrents())
+
+	other, _, otherDir := getSession(t)
+	defer os.RemoveAll(otherDir)
+	assert.Equal(t, ErrUnknownTorrent, other.RemoveTorrent(torrent))
+}
+
+func TestSessionClose(t *testing.T) {
+	session, path, dir := getSession(t)
+	defer os.RemoveAll(dir)
+	torrent, err := session.AddTorrent(path)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, session.Close(ctx))
+	select {
+	case <-torrent.Done():
+	default:
+		t.Fatal("Torrent not stopped by Close")
+	}
+	_, err = session.AddTorrent(path)
+	assert.Equal(t, ErrSessionClosed, err)
+}
+
+func TestSessionContext(t *testing.T) {
+	session, path, dir := getSession(t)
+	defer os.RemoveAll(dir)
+	defer session.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	torrent, err := session.AddTorrentContext(ctx, path)
+	assert.Nil(t, err)
+	cancel()
+	select {
+	case <-torrent.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Torrent not stopped when its context ended")
+	}
+	assert.Equal(t, context.Canceled, torrent.Err())
+	assert.Empty(t, session.Torrents())
+
+	_, err = session.AddTorrentContext(ctx, path)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSessionErrors(t *testing.T) {
+	session, _, dir := getSession(t)
+	defer os.RemoveAll(dir)
+	defer session.Close(context.Background())
+
+	// no tracker answers
+	torrent, err := session.AddTorrent(writeTorrent(t, dir, "wss://tracker"))
+	assert.Nil(t, err)
+	<-torrent.Done()
+	assert.True(t, errors.Is(torrent.Err(), ErrNoPeers))
+	var announceErr *tracker.AnnounceError
+	assert.True(t, errors.As(torrent.Err(), &announceErr))
+
+	path := filepath.Join(dir, "bad.torrent")
+	ioutil.WriteFile(path, []byte("not a torrent"), 0644)
+	_, err = session.AddTorrent(path)
+	assert.True(t, errors.Is(err, parser.ErrInvalidMetainfo))
+}
+
+func TestSessionsIndependent(t *testing.T) {
+	first := newSession(DefaultConfig(), newTorrentSet())
+	second := newSession(DefaultConfig(), newTorrentSet())
+	defer first.hashing.stop()
+	defer second.hashing.stop()
+
+	peer := tracker.Peer{IPAdress: 0x7f000001, Port: 6881}
+	first.Ban(peer, time.Minute)
+	assert.True(t, first.Banned(peer))
+	assert.False(t, second.Banned(peer))
+	assert.False(t, Banned(peer))
+
+	first.SetRateLimits(1000, 2000)
+	download, upload := second.RateLimits()
+	assert.Equal(t, int64(0), download)
+	assert.Equal(t, int64(0), upload)
+}
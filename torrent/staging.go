@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+)
+
+// moving serializes moves of files, it guards DiskPath and FinalPath of the files of active torrents
+var moving sync.Mutex
+
+// filePieces returns the first and last piece holding the file. ok is false for empty files
+func filePieces(torrent parser.TorrentFile, file int) (first uint32, last uint32, ok bool) {
+	start := uint64(0)
+	for _, f := range torrent.Files[:file] {
+		start += f.Length
+	}
+	length := torrent.Files[file].Length
+	if length == 0 {
+		return 0, 0, false
+	}
+	first = uint32(start / uint64(torrent.PieceLength))
+	last = uint32((start + length - 1) / uint64(torrent.PieceLength))
+	return first, last, true
+}
+
+// fileVerified tells if every piece of the file is verified
+func fileVerified(torrent parser.TorrentFile, pieces *piece.PieceTracker, file int) bool {
+	first, last, ok := filePieces(torrent, file)
+	if !ok {
+		return true
+	}
+	pieces.Lock.Lock()
+	defer pieces.Lock.Unlock()
+	for index := first; index <= last; index++ {
+		if !pieces.Verified(index) {
+			return false
+		}
+	}
+	return true
+}
+
+// pieceFiles returns the files holding the piece
+func pieceFiles(torrent parser.TorrentFile, index uint32) (files []int) {
+	for _, span := range storage.PieceSpans(torrent, index) {
+		files = append(files, span.File)
+	}
+	return
+}
+
+// allFiles returns the indexes of all files of the torrent
+func allFiles(torrent parser.TorrentFile) (files []int) {
+	for i := range torrent.Files {
+		files = append(files, i)
+	}
+	return
+}
+
+// moveCompleted moves staged files to their final path once all their pieces are verified
+func moveCompleted(report *tracker.ClientStatusReport, pieces *piece.PieceTracker, files []int, Log Log) {
+	mover, ok := report.Storage.(storage.Mover)
+	if !ok {
+		return
+	}
+	moving.Lock()
+	defer moving.Unlock()
+	for _, index := range files {
+		file := report.TorrentFile.Files[index]
+		if file.FilePointer == nil || file.DiskPath == file.FinalPath || !fileVerified(report.TorrentFile, pieces, index) {
+			continue
+		}
+		Log.Info.Println("Moving complete file", file.DiskPath, "to", file.FinalPath)
+		if err := mover.Move(index, file.FinalPath); err != nil {
+			Log.Error.Println("Unable to move", file.DiskPath, "to", file.FinalPath, err)
+		}
+	}
+}
+
+// MoveStorage moves the files of an active torrent into dir. Incomplete files stay in the
+// incomplete folder if there is one, the others are moved at once
+func MoveStorage(report *tracker.ClientStatusReport, dir string) error {
+	mover, ok := report.Storage.(storage.Mover)
+	if !ok {
+		return fmt.Errorf("Storage of %s is not on disk", report.TorrentFile.Name)
+	}
+	moving.Lock()
+	defer moving.Unlock()
+	for i, file := range report.TorrentFile.Files {
+		finalPath := filepath.Join(dir, file.RelPath)
+		path := file.DiskPath
+		if strings.HasPrefix(file.DiskPath, file.FinalPath) {
+			// complete, or staged next to its final path with a suffix
+			path = finalPath + strings.TrimPrefix(file.DiskPath, file.FinalPath)
+		}
+		if err := mover.Move(i, path); err != nil {
+			return err
+		}
+		file.FinalPath = finalPath
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/piece"
+	"github.com/concurrency-8/storage"
+	"github.com/concurrency-8/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+// getStagedTorrent returns a torrent of 4 pieces of 16 bytes over files of 40 and 24 bytes,
+// downloaded into dir/incomplete with a .part suffix
+func getStagedTorrent(t *testing.T) (*tracker.ClientStatusReport, *piece.PieceTracker, string) {
+	dir, err := ioutil.TempDir("", "staging")
+	assert.Nil(t, err)
+	file := parser.TorrentFile{Name: "name", PieceLength: 16, Length: 64, Piece: make([]byte, 4*20)}
+	for i, length := range []uint64{40, 24} {
+		relPath := filepath.Join("name", string(rune('a'+i)))
+		diskPath := filepath.Join(dir, "incomplete", relPath) + ".part"
+		os.MkdirAll(filepath.Dir(diskPath), os.ModePerm)
+		pointer, err := os.Create(diskPath)
+		assert.Nil(t, err)
+		file.Files = append(file.Files, &parser.File{Length: length, FilePointer: pointer, DiskPath: diskPath,
+			FinalPath: filepath.Join(dir, "complete", relPath), RelPath: relPath})
+	}
+	report := &tracker.ClientStatusReport{TorrentFile: file, Storage: storage.NewFiles(file)}
+	return report, piece.NewPieceTracker(file), dir
+}
+
+func TestMoveCompleted(t *testing.T) {
+	report, pieces, dir := getStagedTorrent(t)
+	defer os.RemoveAll(dir)
+	defer report.Storage.Close()
+	files := report.TorrentFile.Files
+
+	// Piece 2 holds both files, the second is not complete without piece 3
+	for i := uint32(0); i < 3; i++ {
+		pieces.MarkVerified(i)
+	}
+	moveCompleted(report, pieces, pieceFiles(report.TorrentFile, 2), getLog())
+	assert.Equal(t, files[0].FinalPath, files[0].DiskPath)
+	assert.NotEqual(t, files[1].FinalPath, files[1].DiskPath)
+	_, err := os.Stat(files[0].FinalPath)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "incomplete", "name", "a.part"))
+	assert.True(t, os.IsNotExist(err))
+
+	pieces.MarkVerified(3)
+	moveCompleted(report, pieces, allFiles(report.TorrentFile), getLog())
+	assert.Equal(t, files[1].FinalPath, files[1].DiskPath)
+}
+
+func TestMoveStorage(t *testing.T) {
+	report, pieces, dir := getStagedTorrent(t)
+	defer os.RemoveAll(dir)
+	defer report.Storage.Close()
+	files := report.TorrentFile.Files
+	for i := uint32(0); i < 3; i++ {
+		pieces.MarkVerified(i)
+	}
+	moveCompleted(report, pieces, []int{0}, getLog())
+
+	moved := filepath.Join(dir, "moved")
+	assert.Nil(t, MoveStorage(report, moved))
+	assert.Equal(t, filepath.Join(moved, "name", "a"), files[0].DiskPath)
+	assert.Equal(t, filepath.Join(moved, "name", "b"), files[1].FinalPath)
+	// The incomplete file stays in the incomplete folder
+	assert.Equal(t, filepath.Join(dir, "incomplete", "name", "b.part"), files[1].DiskPath)
+
+	_, err := report.Storage.WriteAt(make([]byte, 16), 0, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, MoveStorage(&tracker.ClientStatusReport{Storage: storage.NewMemory(report.TorrentFile)}, moved))
+}
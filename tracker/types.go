@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"github.com/concurrency-8/parser"
+	"github.com/concurrency-8/storage"
 )
 
 // ConnectResponse is struture to hoild details from ConnectResponse
@@ -25,6 +27,21 @@ func GetMockConnectResponseBuf(transactionID uint32, connectionID uint64) bytes.
 	return mockConnectResponseBuf
 }
 
+// AnnounceError is returned when a tracker can not be reached or gives a bad answer
+type AnnounceError struct {
+	URL string
+	Err error
+}
+
+func (e *AnnounceError) Error() string {
+	return fmt.Sprintf("Announce to %s failed: %v", e.URL, e.Err)
+}
+
+// Unwrap returns the error of the announce
+func (e *AnnounceError) Unwrap() error {
+	return e.Err
+}
+
 // AnnounceResponse is structure to hold details from announce request sent to tracker
 type AnnounceResponse struct {
 	Action        uint32
@@ -75,7 +92,7 @@ type ClientStatusReport struct {
 	Uploaded    uint64
 	Downloaded  uint64
 	Left        uint64
-	Data        []parser.Piece // This is for seeding
+	Storage     storage.Storage
 }
 
 // GetRandomClientReport gives a test ClientStatusReport object pointer.
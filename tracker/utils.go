@@ -3,13 +3,13 @@ package tracker
 import (
 	"bufio"
 	"bytes"
+	"context"
 
 	//"crypto"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -183,17 +183,29 @@ func parseAnnounceResp(response bytes.Buffer) *AnnounceResponse {
 	return &result
 }
 
-// getPeersUDP return the list of peers from tracker using UDP urls
-func getPeersUDP(u *url.URL, report *ClientStatusReport) (resp *AnnounceResponse, err error) {
-	serverAddr, err := net.ResolveUDPAddr("udp", u.Host)
-	if err != nil {
-		return
-	}
-	con, err := net.DialUDP("udp", nil, serverAddr)
+// getPeersUDP return the list of peers from tracker using UDP urls. The socket is closed when ctx ends
+func getPeersUDP(ctx context.Context, u *url.URL, report *ClientStatusReport) (resp *AnnounceResponse, err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.Host)
 	if err != nil {
 		return
 	}
+	con := conn.(*net.UDPConn)
 	defer con.Close()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			con.Close()
+		case <-finished:
+		}
+	}()
+	defer func() {
+		if ctx.Err() != nil {
+			resp, err = nil, ctx.Err()
+		}
+	}()
 
 	var connectionID uint64
 	for retry := uint(0); retry < uint(8); retry++ {
@@ -304,8 +316,8 @@ func (tr *AnnounceResponse) decodePeerBytes() {
 	}
 }
 
-// getPeersHTTP returns the list of peers from tracker using HTTP urls
-func getPeersHTTP(u *url.URL, report *ClientStatusReport) (tr *AnnounceResponse, err error) {
+// getPeersHTTP returns the list of peers from tracker using HTTP urls. The request is cancelled when ctx ends
+func getPeersHTTP(ctx context.Context, u *url.URL, report *ClientStatusReport) (tr *AnnounceResponse, err error) {
 	uq := u.Query()
 
 	uq.Add("info_hash", report.TorrentFile.InfoHash)
@@ -318,7 +330,11 @@ func getPeersHTTP(u *url.URL, report *ClientStatusReport) (tr *AnnounceResponse,
 
 	u.RawQuery = uq.Encode()
 
-	resp, err := http.Get(u.String())
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 
 	if err != nil {
 		return
@@ -341,16 +357,26 @@ func getPeersHTTP(u *url.URL, report *ClientStatusReport) (tr *AnnounceResponse,
 
 // GetPeers returns the peer list given a valid udp/http announce url
 func GetPeers(u *url.URL, report *ClientStatusReport) (tr *AnnounceResponse, err error) {
+	return GetPeersContext(context.Background(), u, report)
+}
+
+// GetPeersContext is GetPeers that gives up and returns the error of ctx when ctx ends.
+// Other failures are returned as an *AnnounceError
+func GetPeersContext(ctx context.Context, u *url.URL, report *ClientStatusReport) (tr *AnnounceResponse, err error) {
+	announce := u.String()
 
 	switch u.Scheme {
 	case "http":
-		tr, err = getPeersHTTP(u, report)
+		tr, err = getPeersHTTP(ctx, u, report)
 	case "udp":
-		tr, err = getPeersUDP(u, report)
+		tr, err = getPeersUDP(ctx, u, report)
 	default:
 		err = fmt.Errorf("Announce url not recognized")
 	}
 
+	if err != nil && ctx.Err() == nil {
+		return nil, &AnnounceError{URL: announce, Err: err}
+	}
 	return
 }
 
@@ -363,12 +389,6 @@ func GetClientStatusReport(torrent parser.TorrentFile, port uint16) (report *Cli
 	report.Left = torrent.Length
 	report.Port = port
 	report.Event = ""
-	report.Data = make([]parser.Piece, len(torrent.Piece)/20)
-
-	for i := range report.Data {
-		report.Data[i].Blocks = make([]parser.PieceBlock, int(math.Ceil(float64(torrent.PieceLength)/float64(parser.BLOCK_LEN))))
-	}
-
 	return
 }
 
@@ -6,12 +6,17 @@ package tracker
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"math/rand"
+	"net"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func getErrorMsg(varName, functionName string) string {
@@ -186,6 +191,35 @@ func TestParseAnnounceResp(t *testing.T) {
 	fmt.Println("PASS")
 }
 
+func TestGetPeersContext(t *testing.T) {
+	fmt.Print("Testing tracker/utils.go : GetPeersContext(): ")
+	// a tracker that never answers
+	con, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer con.Close()
+	u, _ := url.Parse("udp://" + con.LocalAddr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = GetPeersContext(ctx, u, GetRandomClientReport())
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "Announce not cancelled")
+
+	fmt.Println("PASS")
+}
+
+func TestAnnounceError(t *testing.T) {
+	fmt.Print("Testing tracker/utils.go : AnnounceError: ")
+	u, _ := url.Parse("wss://tracker")
+	_, err := GetPeersContext(context.Background(), u, GetRandomClientReport())
+	var announceErr *AnnounceError
+	assert.True(t, errors.As(err, &announceErr))
+	assert.Equal(t, "wss://tracker", announceErr.URL)
+
+	fmt.Println("PASS")
+}
+
 /*
 func TestGetPeers(t *testing.T) {
 
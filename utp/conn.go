@@ -0,0 +1,576 @@
+package utp
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// PacketSize is the largest payload of a data packet. Small enough to avoid IP fragmentation
+var PacketSize = 1200
+
+// TargetDelay is the queuing delay LEDBAT aims for. Above it the congestion window shrinks
+var TargetDelay = 100 * time.Millisecond
+
+// MaxCwndIncrease is the maximum growth of the congestion window per round trip in bytes
+var MaxCwndIncrease = 3000
+
+// RecvWindow is the number of bytes we buffer for a connection
+var RecvWindow = 1 << 20
+
+// MaxRetransmissions is the number of times a packet is resent before the connection fails
+var MaxRetransmissions = 6
+
+// CloseTimeout is how long Close waits for outstanding data to be acked. The connection is reset after it
+var CloseTimeout = 5 * time.Second
+
+// connection states
+const (
+	csSynSent = iota
+	csConnected
+	csFinSent
+	csClosed
+)
+
+const minRTO = 500 * time.Millisecond
+const maxRTO = 10 * time.Second
+const tickInterval = 50 * time.Millisecond
+
+// outPacket is a sent packet waiting to be acked
+type outPacket struct {
+	packet        *packet
+	sentAt        time.Time
+	transmissions int
+	fastResent    bool
+}
+
+// Conn is a uTP connection. It implements net.Conn
+type Conn struct {
+	socket *socket
+	remote *net.UDPAddr
+	recvID uint16
+	sendID uint16
+
+	lock  sync.Mutex
+	cond  *sync.Cond
+	state int
+	err   error
+	done  chan struct{}
+
+	seqNr uint16
+	ackNr uint16
+
+	// send side
+	outbuf     []*outPacket
+	inFlight   int
+	cwnd       int
+	peerWnd    int
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	delays     delayHistory
+	lastAck    uint16
+	dupAcks    int
+	recovering bool
+	recoverSeq uint16
+
+	// receive side
+	inbuf      map[uint16][]byte
+	inbufSize  int
+	readBuf    []byte
+	gotFin     bool
+	finSeq     uint16
+	eof        bool
+	replyDelay uint32
+	lastWnd    int
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(socket *socket, remote *net.UDPAddr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		socket:  socket,
+		remote:  remote,
+		recvID:  recvID,
+		sendID:  sendID,
+		done:    make(chan struct{}),
+		cwnd:    2 * PacketSize,
+		peerWnd: PacketSize,
+		rto:     time.Second,
+		inbuf:   make(map[uint16][]byte),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	go c.loop()
+	return c
+}
+
+// timeoutError is returned when a deadline passes. It is a net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "utp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type connError string
+
+func (e connError) Error() string { return string(e) }
+
+const (
+	errClosed = connError("utp: use of closed connection")
+	errReset  = connError("utp: connection reset by peer")
+	errGaveUp = connError("utp: peer not responding")
+
+	errCloseTimeout = connError("utp: close timed out before the peer acked all data")
+)
+
+// loop retransmits packets and wakes up waiters whose deadline passed
+func (c *Conn) loop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.lock.Lock()
+			c.checkTimeout()
+			c.cond.Broadcast()
+			c.lock.Unlock()
+		}
+	}
+}
+
+// checkTimeout resends the oldest packet once its retransmission timer expires
+func (c *Conn) checkTimeout() {
+	if len(c.outbuf) == 0 || c.err != nil {
+		return
+	}
+	oldest := c.outbuf[0]
+	if time.Since(oldest.sentAt) < c.rto {
+		return
+	}
+	if oldest.transmissions > MaxRetransmissions {
+		c.fail(errGaveUp)
+		return
+	}
+	// A timeout means heavy congestion, restart from the smallest window
+	c.cwnd = PacketSize
+	c.rto *= 2
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.transmit(oldest)
+}
+
+// fail closes the connection with err. Must hold the lock
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	if c.state != csClosed {
+		c.state = csClosed
+		close(c.done)
+		go c.socket.remove(c)
+	}
+	c.cond.Broadcast()
+}
+
+// recvWindow is the free space in our receive buffer
+func (c *Conn) recvWindow() int {
+	free := RecvWindow - len(c.readBuf) - c.inbufSize
+	if free < 0 {
+		free = 0
+	}
+	return free
+}
+
+// send fills in the header fields describing our state and sends the packet
+func (c *Conn) send(p *packet) {
+	p.connID = c.sendID
+	if p.typ == stSyn {
+		// the responder sends on the id in the SYN and receives on the next one
+		p.connID = c.recvID
+	}
+	p.timestamp = timestamp()
+	p.timestampDiff = c.replyDelay
+	c.lastWnd = c.recvWindow()
+	p.wndSize = uint32(c.lastWnd)
+	p.ackNr = c.ackNr
+	c.socket.send(p.marshal(), c.remote)
+}
+
+func (c *Conn) transmit(out *outPacket) {
+	out.sentAt = time.Now()
+	out.transmissions++
+	c.send(out.packet)
+}
+
+// sendPacket sends a packet that consumes a sequence number and must be acked
+func (c *Conn) sendPacket(typ uint8, payload []byte) {
+	out := &outPacket{packet: &packet{typ: typ, seqNr: c.seqNr, payload: payload}}
+	c.seqNr++
+	c.outbuf = append(c.outbuf, out)
+	c.inFlight += len(payload)
+	c.transmit(out)
+}
+
+// sendState acks what we received, with selective acks for packets received out of order
+func (c *Conn) sendState() {
+	p := &packet{typ: stState, seqNr: c.seqNr}
+	if len(c.inbuf) > 0 {
+		p.sack = make([]byte, 4)
+		for seq := range c.inbuf {
+			bit := int(seq - c.ackNr - 2)
+			if bit >= 0 && bit < 8*len(p.sack) {
+				p.sack[bit/8] |= 1 << uint(bit%8)
+			}
+		}
+	}
+	c.send(p)
+}
+
+// receive handles a packet for this connection. Called by the socket
+func (c *Conn) receive(p *packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == csClosed {
+		return
+	}
+	if p.typ == stReset {
+		c.fail(errReset)
+		return
+	}
+	c.replyDelay = timestamp() - p.timestamp
+	c.peerWnd = int(p.wndSize)
+
+	if c.state == csSynSent {
+		if p.typ != stState || p.ackNr != c.seqNr-1 {
+			return
+		}
+		c.state = csConnected
+		c.ackNr = p.seqNr - 1
+		c.lastAck = p.ackNr
+	}
+
+	if p.typ == stSyn {
+		// our ack was lost
+		c.sendState()
+		return
+	}
+
+	c.acked(p)
+
+	if p.typ == stData || p.typ == stFin {
+		c.data(p)
+		c.sendState()
+	}
+}
+
+// acked processes the ack_nr and selective acks of a packet
+func (c *Conn) acked(p *packet) {
+	now := time.Now()
+	ackedBytes := 0
+	newAck := false
+	remaining := c.outbuf[:0]
+	for i, out := range c.outbuf {
+		seq := out.packet.seqNr
+		isAcked := !seqLess(p.ackNr, seq)
+		if !isAcked && len(p.sack) > 0 {
+			bit := int(seq - p.ackNr - 2)
+			isAcked = bit >= 0 && bit < 8*len(p.sack) && p.sack[bit/8]&(1<<uint(bit%8)) != 0
+		}
+		if !isAcked {
+			remaining = append(remaining, c.outbuf[i])
+			continue
+		}
+		newAck = true
+		ackedBytes += len(out.packet.payload)
+		if out.transmissions == 1 {
+			c.updateRTT(now.Sub(out.sentAt))
+		}
+	}
+	c.outbuf = remaining
+	c.inFlight -= ackedBytes
+
+	if c.recovering && !seqLess(p.ackNr, c.recoverSeq) {
+		c.recovering = false
+	}
+	if newAck {
+		c.dupAcks = 0
+		c.lastAck = p.ackNr
+		c.delays.add(p.timestampDiff)
+		c.ledbat(ackedBytes, p.timestampDiff)
+	} else if p.typ == stState && p.ackNr == c.lastAck && len(c.outbuf) > 0 {
+		c.dupAcks++
+	}
+	c.detectLoss(p)
+}
+
+// detectLoss resends a packet after three duplicate acks or when three later packets were selectively acked
+func (c *Conn) detectLoss(p *packet) {
+	if len(c.outbuf) == 0 {
+		return
+	}
+	lost := c.dupAcks >= 3
+	if !lost && len(p.sack) > 0 {
+		count := 0
+		for _, b := range p.sack {
+			for ; b != 0; b &= b - 1 {
+				count++
+			}
+		}
+		lost = count >= 3
+	}
+	first := c.outbuf[0]
+	if !lost || first.fastResent {
+		return
+	}
+	first.fastResent = true
+	c.dupAcks = 0
+	if !c.recovering {
+		// halve the window once per window of data
+		c.recovering = true
+		c.recoverSeq = c.seqNr - 1
+		c.cwnd /= 2
+		if c.cwnd < PacketSize {
+			c.cwnd = PacketSize
+		}
+	}
+	c.transmit(first)
+}
+
+// updateRTT updates the round trip time estimate and the retransmission timeout
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// ledbat grows the congestion window while the queuing delay is below TargetDelay and shrinks it above
+func (c *Conn) ledbat(ackedBytes int, delaySample uint32) {
+	if ackedBytes == 0 {
+		return
+	}
+	queuing := time.Duration(delaySample-c.delays.base()) * time.Microsecond
+	offTarget := float64(TargetDelay-queuing) / float64(TargetDelay)
+	windowFactor := float64(ackedBytes) / float64(maxInt(c.cwnd, ackedBytes))
+	c.cwnd += int(float64(MaxCwndIncrease) * offTarget * windowFactor)
+	if c.cwnd < PacketSize {
+		c.cwnd = PacketSize
+	}
+	if c.cwnd > RecvWindow {
+		c.cwnd = RecvWindow
+	}
+}
+
+// data stores the payload of a data packet and delivers everything that is in order
+func (c *Conn) data(p *packet) {
+	if p.typ == stFin {
+		c.gotFin = true
+		c.finSeq = p.seqNr
+	}
+	if !seqLess(c.ackNr, p.seqNr) {
+		return // duplicate
+	}
+	if p.typ == stData {
+		if _, ok := c.inbuf[p.seqNr]; !ok && len(p.payload) <= c.recvWindow() {
+			c.inbuf[p.seqNr] = append([]byte(nil), p.payload...)
+			c.inbufSize += len(p.payload)
+		}
+	}
+	for {
+		next := c.ackNr + 1
+		if payload, ok := c.inbuf[next]; ok {
+			delete(c.inbuf, next)
+			c.inbufSize -= len(payload)
+			c.readBuf = append(c.readBuf, payload...)
+			c.ackNr = next
+		} else if c.gotFin && next == c.finSeq {
+			c.ackNr = next
+			c.eof = true
+			return
+		} else {
+			return
+		}
+	}
+}
+
+// Read reads data from the connection
+func (c *Conn) Read(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.readBuf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.state == csClosed {
+			return 0, errClosed
+		}
+		if !c.readDeadline.IsZero() && time.Now().After(c.readDeadline) {
+			return 0, timeoutError{}
+		}
+		c.cond.Wait()
+	}
+	n = copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+	// tell the peer when a full window opens up again
+	if c.lastWnd < PacketSize && c.recvWindow() >= PacketSize && c.state != csClosed {
+		c.sendState()
+	}
+	return
+}
+
+// Write writes data to the connection. It blocks while the send window is full
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(b) > 0 {
+		size := minInt(len(b), PacketSize)
+		for {
+			if c.err != nil {
+				return n, c.err
+			}
+			if c.state != csConnected {
+				return n, errClosed
+			}
+			if !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline) {
+				return n, timeoutError{}
+			}
+			if c.inFlight == 0 || c.inFlight+size <= minInt(c.cwnd, c.peerWnd) {
+				break
+			}
+			c.cond.Wait()
+		}
+		c.sendPacket(stData, append([]byte(nil), b[:size]...))
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// Close sends a FIN and waits for the outstanding data to be acked. If the peer does not ack it within
+// CloseTimeout the connection is reset, so that the peer does not wait for the rest, and an error is returned
+func (c *Conn) Close() (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == csClosed {
+		return nil
+	}
+	if c.state == csConnected && c.err == nil {
+		c.sendPacket(stFin, nil)
+		c.state = csFinSent
+		deadline := time.Now().Add(CloseTimeout)
+		for len(c.outbuf) > 0 && c.err == nil && time.Now().Before(deadline) {
+			c.cond.Wait()
+		}
+		err = c.err
+		if err == nil && len(c.outbuf) > 0 {
+			c.send(&packet{typ: stReset, seqNr: c.seqNr})
+			err = errCloseTimeout
+		}
+	}
+	c.fail(errClosed)
+	return
+}
+
+// LocalAddr returns the address of the UDP socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Read calls
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+	return nil
+}
+
+// delayHistory keeps the minimum delay of the last two minutes as the base delay
+type delayHistory struct {
+	current, previous uint32
+	started           time.Time
+}
+
+func (h *delayHistory) add(sample uint32) {
+	if h.started.IsZero() {
+		h.current, h.previous, h.started = sample, sample, time.Now()
+		return
+	}
+	if time.Since(h.started) > time.Minute {
+		h.previous, h.current, h.started = h.current, sample, time.Now()
+	}
+	if sample < h.current {
+		h.current = sample
+	}
+}
+
+func (h *delayHistory) base() uint32 {
+	if h.previous < h.current {
+		return h.previous
+	}
+	return h.current
+}
+
+func randomID() uint16 {
+	return uint16(rand.Uint32())
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,117 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+// version of the uTP protocol
+const version = 1
+
+// headerLen is the length of the fixed packet header
+const headerLen = 20
+
+// extension number of selective acks
+const extSelectiveAck = 1
+
+// packet is a uTP packet. The header looks like:
+//	uint4	: type		- one of stData, stFin, stState, stReset, stSyn
+//	uint4	: version	- 1
+//	uint8	: extension	- type of the first extension, 0 if none
+//	uint16	: connection_id	- identifies the connection
+//	uint32	: timestamp	- microseconds at the time of sending
+//	uint32	: timestamp_diff	- delay measured from the last packet received
+//	uint32	: wnd_size	- bytes the sender is willing to receive
+//	uint16	: seq_nr	- sequence number of this packet
+//	uint16	: ack_nr	- last sequence number received in order
+type packet struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	// sack is the selective ack bitmask, bit i is set if ack_nr + 2 + i was received
+	sack    []byte
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	size := headerLen + len(p.payload)
+	if len(p.sack) > 0 {
+		size += 2 + len(p.sack)
+	}
+	data := make([]byte, headerLen, size)
+	data[0] = p.typ<<4 | version
+	if len(p.sack) > 0 {
+		data[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(data[2:], p.connID)
+	binary.BigEndian.PutUint32(data[4:], p.timestamp)
+	binary.BigEndian.PutUint32(data[8:], p.timestampDiff)
+	binary.BigEndian.PutUint32(data[12:], p.wndSize)
+	binary.BigEndian.PutUint16(data[16:], p.seqNr)
+	binary.BigEndian.PutUint16(data[18:], p.ackNr)
+	if len(p.sack) > 0 {
+		data = append(data, 0, uint8(len(p.sack)))
+		data = append(data, p.sack...)
+	}
+	return append(data, p.payload...)
+}
+
+func unmarshal(data []byte) (p *packet, err error) {
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("Packet too short")
+	}
+	if data[0]&0x0F != version {
+		return nil, fmt.Errorf("Unsupported uTP version %d", data[0]&0x0F)
+	}
+	p = &packet{
+		typ:           data[0] >> 4,
+		connID:        binary.BigEndian.Uint16(data[2:]),
+		timestamp:     binary.BigEndian.Uint32(data[4:]),
+		timestampDiff: binary.BigEndian.Uint32(data[8:]),
+		wndSize:       binary.BigEndian.Uint32(data[12:]),
+		seqNr:         binary.BigEndian.Uint16(data[16:]),
+		ackNr:         binary.BigEndian.Uint16(data[18:]),
+	}
+	if p.typ > stSyn {
+		return nil, fmt.Errorf("Unknown packet type %d", p.typ)
+	}
+	extension := data[1]
+	offset := headerLen
+	for extension != 0 {
+		if len(data) < offset+2 || len(data) < offset+2+int(data[offset+1]) {
+			return nil, fmt.Errorf("Invalid extension")
+		}
+		next, length := data[offset], int(data[offset+1])
+		if extension == extSelectiveAck {
+			p.sack = data[offset+2 : offset+2+length]
+		}
+		extension = next
+		offset += 2 + length
+	}
+	p.payload = data[offset:]
+	return
+}
+
+// seqLess compares sequence numbers that wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// timestamp returns the current time in microseconds, wrapping around
+func timestamp() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
@@ -0,0 +1,256 @@
+package utp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptBacklog is the number of incoming connections waiting for Accept
+var AcceptBacklog = 32
+
+// socket multiplexes uTP connections over one UDP socket
+type socket struct {
+	conn     *net.UDPConn
+	lock     sync.Mutex
+	conns    map[string]*Conn
+	accepted chan *Conn
+	// owned sockets were created for a single Dial and are closed with the connection
+	owned  bool
+	closed bool
+}
+
+func newSocket(address string, listen bool) (s *socket, err error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return
+	}
+	s = &socket{conn: conn, conns: make(map[string]*Conn)}
+	if listen {
+		s.accepted = make(chan *Conn, AcceptBacklog)
+	}
+	go s.readLoop()
+	return
+}
+
+func connKey(addr *net.UDPAddr, recvID uint16) string {
+	return fmt.Sprintf("%s/%d", addr, recvID)
+}
+
+func (s *socket) send(data []byte, addr *net.UDPAddr) {
+	s.conn.WriteToUDP(data, addr)
+}
+
+// readLoop reads packets and hands them to their connections
+func (s *socket) readLoop() {
+	buffer := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			s.close()
+			return
+		}
+		p, err := unmarshal(buffer[:n])
+		if err != nil {
+			continue
+		}
+		// the payload must outlive the buffer
+		p.payload = append([]byte(nil), p.payload...)
+		p.sack = append([]byte(nil), p.sack...)
+
+		if p.typ == stSyn {
+			s.syn(p, addr)
+			continue
+		}
+		s.lock.Lock()
+		c := s.conns[connKey(addr, p.connID)]
+		s.lock.Unlock()
+		if c != nil {
+			c.receive(p)
+		} else if p.typ != stReset {
+			s.send((&packet{typ: stReset, connID: p.connID, ackNr: p.seqNr}).marshal(), addr)
+		}
+	}
+}
+
+// syn handles a connection request. The responder receives on connection_id + 1
+func (s *socket) syn(p *packet, addr *net.UDPAddr) {
+	s.lock.Lock()
+	key := connKey(addr, p.connID+1)
+	c, ok := s.conns[key]
+	if !ok && s.accepted != nil && !s.closed {
+		c = newConn(s, addr, p.connID+1, p.connID)
+		c.state = csConnected
+		c.seqNr = randomID()
+		c.ackNr = p.seqNr
+		select {
+		case s.accepted <- c:
+			s.conns[key] = c
+		default:
+			// backlog full, refuse the connection
+			c.fail(errClosed)
+			c = nil
+		}
+	}
+	s.lock.Unlock()
+	if c != nil {
+		c.receive(p)
+	} else {
+		s.send((&packet{typ: stReset, connID: p.connID, ackNr: p.seqNr}).marshal(), addr)
+	}
+}
+
+// dial opens a connection to address over this socket. It gives up when ctx ends
+func (s *socket) dial(ctx context.Context, address string) (c *Conn, err error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, errClosed
+	}
+	recvID := randomID()
+	for s.conns[connKey(addr, recvID)] != nil {
+		recvID = randomID()
+	}
+	c = newConn(s, addr, recvID, recvID+1)
+	s.conns[connKey(addr, recvID)] = c
+	s.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seqNr = 1
+	c.sendPacket(stSyn, nil)
+	for c.state == csSynSent && c.err == nil {
+		if err := ctx.Err(); err == context.DeadlineExceeded {
+			c.fail(timeoutError{})
+			break
+		} else if err != nil {
+			c.fail(err)
+			break
+		}
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return
+}
+
+// remove forgets a closed connection
+func (s *socket) remove(c *Conn) {
+	s.lock.Lock()
+	key := connKey(c.remote, c.recvID)
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+	closeSocket := s.owned && len(s.conns) == 0
+	s.lock.Unlock()
+	if closeSocket {
+		s.close()
+	}
+}
+
+// close closes the socket and every connection on it
+func (s *socket) close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	if s.accepted != nil {
+		close(s.accepted)
+	}
+	s.lock.Unlock()
+	s.conn.Close()
+	for _, c := range conns {
+		c.lock.Lock()
+		c.fail(errClosed)
+		c.lock.Unlock()
+	}
+}
+
+// Listener accepts incoming uTP connections. It implements net.Listener
+type Listener struct {
+	socket *socket
+}
+
+// Listen listens for uTP connections on the UDP address
+func Listen(address string) (*Listener, error) {
+	s, err := newSocket(address, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{s}, nil
+}
+
+// Accept waits for the next incoming connection
+func (l *Listener) Accept() (net.Conn, error) {
+	c, ok := <-l.socket.accepted
+	if !ok {
+		return nil, errClosed
+	}
+	return c, nil
+}
+
+// Close stops listening and closes all connections of the listener
+func (l *Listener) Close() error {
+	l.socket.close()
+	return nil
+}
+
+// Addr returns the UDP address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.socket.conn.LocalAddr()
+}
+
+// DialTimeout connects to address from the listening socket, so that the peer sees our listening port
+func (l *Listener) DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return l.DialContext(ctx, address)
+}
+
+// DialContext is DialTimeout that gives up when ctx ends
+func (l *Listener) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	c, err := l.socket.dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialTimeout connects to the uTP peer at address from a new UDP socket
+func DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return DialContext(ctx, address)
+}
+
+// DialContext is DialTimeout that gives up when ctx ends
+func DialContext(ctx context.Context, address string) (net.Conn, error) {
+	s, err := newSocket(":0", false)
+	if err != nil {
+		return nil, err
+	}
+	s.owned = true
+	c, err := s.dial(ctx, address)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return c, nil
+}
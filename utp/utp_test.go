@@ -0,0 +1,266 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketMarshal(t *testing.T) {
+	p := &packet{
+		typ:           stState,
+		connID:        uint16(rand.Uint32()),
+		timestamp:     rand.Uint32(),
+		timestampDiff: rand.Uint32(),
+		wndSize:       rand.Uint32(),
+		seqNr:         uint16(rand.Uint32()),
+		ackNr:         uint16(rand.Uint32()),
+		sack:          []byte{1, 2, 3, 4},
+		payload:       []byte("payload"),
+	}
+	parsed, err := unmarshal(p.marshal())
+	assert.Nil(t, err)
+	assert.Equal(t, p, parsed)
+
+	_, err = unmarshal(make([]byte, 10))
+	assert.NotNil(t, err, "Short packet accepted")
+}
+
+func TestSeqLess(t *testing.T) {
+	assert.True(t, seqLess(1, 2))
+	assert.False(t, seqLess(2, 1))
+	assert.True(t, seqLess(65535, 0), "Sequence numbers must wrap around")
+}
+
+func getRandomData(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+// transfer sends data from client to server and back and checks that it arrives intact
+func transfer(t *testing.T, address string, size int) {
+	listener, err := Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	if address == "" {
+		address = listener.Addr().String()
+	}
+
+	upload, download := getRandomData(size), getRandomData(size/4)
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+		conn, err := listener.Accept()
+		if !assert.Nil(t, err) {
+			return
+		}
+		received := make([]byte, len(upload))
+		_, err = io.ReadFull(conn, received)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(upload, received), "Data corrupted on the way to the server")
+		_, err = conn.Write(download)
+		assert.Nil(t, err)
+		// the client closes after reading everything
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		conn.Close()
+	}()
+
+	conn, err := DialTimeout(address, 10*time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = conn.Write(upload)
+	assert.Nil(t, err)
+	received := make([]byte, len(download))
+	_, err = io.ReadFull(conn, received)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(download, received), "Data corrupted on the way to the client")
+	conn.Close()
+	<-done
+}
+
+func TestTransfer(t *testing.T) {
+	transfer(t, "", 1<<20)
+}
+
+// lossyRelay forwards packets between the first client and target, dropping some of them
+func lossyRelay(t *testing.T, target string, loss float64) (relay *net.UDPConn) {
+	return filterRelay(t, target, func(packet []byte, toTarget bool) bool {
+		return rand.Float64() < loss
+	})
+}
+
+// filterRelay forwards packets between the first client and target, dropping those drop tells
+func filterRelay(t *testing.T, target string, drop func(packet []byte, toTarget bool) bool) (relay *net.UDPConn) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	targetAddr, _ := net.ResolveUDPAddr("udp", target)
+	go func() {
+		var client *net.UDPAddr
+		buffer := make([]byte, 65536)
+		for {
+			n, addr, err := relay.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if drop(buffer[:n], addr.String() != targetAddr.String()) {
+				continue
+			}
+			if addr.String() == targetAddr.String() {
+				if client != nil {
+					relay.WriteToUDP(buffer[:n], client)
+				}
+			} else {
+				client = addr
+				relay.WriteToUDP(buffer[:n], targetAddr)
+			}
+		}
+	}()
+	return
+}
+
+func TestPacketLoss(t *testing.T) {
+	closeTimeout := CloseTimeout
+	CloseTimeout = 30 * time.Second
+	defer func() { CloseTimeout = closeTimeout }()
+	listener, err := Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	relay := lossyRelay(t, listener.Addr().String(), 0.1)
+	defer relay.Close()
+
+	data := getRandomData(256 << 10)
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+		conn, err := listener.Accept()
+		if !assert.Nil(t, err) {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Minute))
+		received, err := ioutilReadAll(conn)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(data, received), "Data corrupted with packet loss")
+		conn.Close()
+	}()
+
+	conn, err := DialTimeout(relay.LocalAddr().String(), 10*time.Second)
+	if !assert.Nil(t, err) {
+		listener.Close()
+		return
+	}
+	_, err = conn.Write(data)
+	assert.Nil(t, err)
+	conn.Close()
+	<-done
+	listener.Close()
+}
+
+func ioutilReadAll(conn net.Conn) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	_, err := io.Copy(buffer, conn)
+	return buffer.Bytes(), err
+}
+
+// TestCloseTimeout checks that a connection whose data is never acked is reset when it is closed,
+// which ends the reads of the peer
+func TestCloseTimeout(t *testing.T) {
+	closeTimeout := CloseTimeout
+	CloseTimeout = 300 * time.Millisecond
+	defer func() { CloseTimeout = closeTimeout }()
+	listener, err := Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	relay := filterRelay(t, listener.Addr().String(), func(packet []byte, toTarget bool) bool {
+		return toTarget && packet[0]>>4 == stData
+	})
+	defer relay.Close()
+
+	done := make(chan error)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = conn.Read(make([]byte, 10))
+		done <- err
+	}()
+
+	conn, err := DialTimeout(relay.LocalAddr().String(), 5*time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte("lost"))
+	assert.Nil(t, err)
+	assert.Equal(t, errCloseTimeout, conn.Close())
+	assert.Equal(t, errReset, <-done)
+}
+
+func TestReadDeadline(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go listener.Accept()
+
+	conn, err := DialTimeout(listener.Addr().String(), 5*time.Second)
+	assert.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 10))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "Read deadline must give a timeout error")
+	conn.Close()
+}
+
+func TestDialTimeout(t *testing.T) {
+	// nothing answers on this socket
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer silent.Close()
+
+	start := time.Now()
+	_, err = DialTimeout(silent.LocalAddr().String(), 300*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "Dial did not give up in time")
+}
+
+func TestDialContext(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer silent.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = DialContext(ctx, silent.LocalAddr().String())
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "Dial did not give up when cancelled")
+}
+
+func TestLedbat(t *testing.T) {
+	c := &Conn{cwnd: 10 * PacketSize}
+	c.delays.add(1000)
+
+	// no queuing delay - the window grows
+	c.ledbat(PacketSize, 1000)
+	assert.True(t, c.cwnd > 10*PacketSize)
+
+	// queuing delay far above target - the window shrinks
+	cwnd := c.cwnd
+	c.ledbat(PacketSize, 1000+uint32(4*TargetDelay/time.Microsecond))
+	assert.True(t, c.cwnd < cwnd)
+
+	// never below one packet
+	for i := 0; i < 100; i++ {
+		c.ledbat(PacketSize, 1000+uint32(4*TargetDelay/time.Microsecond))
+	}
+	assert.Equal(t, PacketSize, c.cwnd)
+}